@@ -3,10 +3,13 @@ package main
 import (
 	"embed"
 	"fmt"
+	"html"
 	"html/template"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,32 +18,111 @@ import (
 type APIServer struct {
 	listenAddr string
 	store      Storage
-	scraper    Scraper
+	scraper    *Scraper
+	// secrets encrypts the credentials of the result sources.
+	secrets *secretBox
+
+	importsMu sync.Mutex
+	imports   map[string]*pendingImport
+
+	laser  *Laser
+	stream *eventStream
+	logins *loginLimiter
 }
 
-func NewAPIServer(listenAddr string, store Storage, scraper Scraper) *APIServer {
-	return &APIServer{
+func NewAPIServer(listenAddr string, store Storage, scraper *Scraper, secrets *secretBox) *APIServer {
+	s := &APIServer{
 		listenAddr: listenAddr,
 		store:      store,
 		scraper:    scraper,
+		secrets:    secrets,
+		imports:    map[string]*pendingImport{},
+		laser:      NewLaser(),
+		stream:     newEventStream(),
+		logins:     newLoginLimiter(),
 	}
+	scraper.OnUpdate(func() {
+		s.stream.publish("", StreamScrape, StreamQueue, StreamHistory)
+	})
+	s.laser.OnChange(func() {
+		s.stream.publish("", StreamLaser)
+	})
+	s.loadTimePolicy()
+	// results stored before the places were kept get theirs
+	s.updateAllPlaces()
+	s.restoreSources()
+	return s
 }
 
 func (s *APIServer) Run() {
+	log.Println("JSON API server running on port: ", s.listenAddr)
+	log.Printf("http://localhost%s\n", s.listenAddr)
+	log.Fatal(http.ListenAndServe(s.listenAddr, s.routes()))
+}
+
+func (s *APIServer) routes() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(s.requireSession)
 
+	router.HandleFunc("/login", s.HandleLoginPage).Methods("GET")
+	router.HandleFunc("/login", s.HandleLogin).Methods("POST")
+	router.HandleFunc("/setup", s.HandleSetup).Methods("POST")
+	router.HandleFunc("/logout", s.HandleLogout).Methods("POST")
+	router.HandleFunc("/users", s.admin(s.HandleGetUsers)).Methods("GET")
+	router.HandleFunc("/users", s.admin(s.HandleSaveUser)).Methods("POST")
+	router.HandleFunc("/users/{name}", s.admin(s.HandleDeleteUser)).Methods("DELETE")
 	router.HandleFunc("/", s.handleIndexPage)
 	router.HandleFunc("/search", s.handleSearchBib)
-	router.HandleFunc("/archive", s.HandleArchiveRecord)
 	router.HandleFunc("/pupdate", s.HandlePartialDBUpdate)
-	router.HandleFunc("/auto-update-start", s.HandleStartAutoDBUpdate)
-	router.HandleFunc("/auto-update-stop", s.HandleStopAutoDBUpdate)
-	router.HandleFunc("/history", s.HandleDeleteHistory)
-	router.HandleFunc("/config", s.HandleCreateConfig)
-
-	log.Println("JSON API server running on port: ", s.listenAddr)
-	log.Printf("http://localhost%s\n", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, router)
+	router.HandleFunc("/auto-update-start", s.admin(s.HandleStartAutoDBUpdate))
+	router.HandleFunc("/auto-update-stop", s.admin(s.HandleStopAutoDBUpdate))
+	router.HandleFunc("/status", s.HandleScrapeStatus)
+	router.HandleFunc("/stream", s.HandleStream).Methods("GET")
+	router.Handle("/static/stream.js", http.FileServer(http.FS(res))).Methods("GET")
+	router.HandleFunc("/refresh", s.HandleRefresh).Methods("GET")
+	router.HandleFunc("/history", s.admin(s.HandleDeleteHistory)).Methods("DELETE")
+	router.HandleFunc("/history", s.HandleGetHistory).Methods("GET")
+	router.HandleFunc("/history/summary", s.HandleHistorySummary).Methods("GET")
+	router.HandleFunc("/station", s.HandleSetStation).Methods("POST")
+	router.HandleFunc("/config", s.admin(s.HandleConfigForm)).Methods("GET")
+	router.HandleFunc("/config", s.admin(s.HandleCreateConfig)).Methods("POST")
+	router.HandleFunc("/events", s.HandleEventsList).Methods("GET")
+	router.HandleFunc("/events/{id}/activate", s.admin(s.HandleActivateEvent)).Methods("POST")
+	router.HandleFunc("/events/{id}/reset", s.admin(s.HandleResetEvent)).Methods("POST")
+	router.HandleFunc("/events/{id}", s.admin(s.HandleDeleteEvent)).Methods("DELETE")
+	router.HandleFunc("/import", s.admin(s.HandleImportUpload))
+	router.HandleFunc("/import/preview", s.admin(s.HandleImportPreview))
+	router.HandleFunc("/import/apply", s.admin(s.HandleImportApply))
+	router.HandleFunc("/templates/editor", s.HandleTemplateEditor).Methods("GET")
+	router.HandleFunc("/templates/preview", s.HandleTemplatePreview).Methods("POST")
+	router.HandleFunc("/templates", s.admin(s.HandleSaveTemplate)).Methods("POST")
+	router.HandleFunc("/templates", s.admin(s.HandleDeleteTemplate)).Methods("DELETE")
+	router.HandleFunc("/queue", s.HandleGetQueue).Methods("GET")
+	router.HandleFunc("/queue", s.HandleEnqueue).Methods("POST")
+	router.HandleFunc("/queue/athlete", s.HandleJobControls).Methods("GET")
+	router.HandleFunc("/queue/{id}/status", s.HandleUpdateJobStatus).Methods("POST")
+	router.HandleFunc("/queue/{id}/laser", s.HandleLaserJob).Methods("POST")
+	router.HandleFunc("/laser/status", s.HandleLaserStatus).Methods("GET")
+	router.HandleFunc("/laser/abort", s.HandleLaserAbort).Methods("POST")
+	router.HandleFunc("/laser/settings", s.HandleGetGrblSettings).Methods("GET")
+	router.HandleFunc("/laser/settings", s.admin(s.HandleSaveGrblSettings)).Methods("POST")
+	router.HandleFunc("/time-policy", s.HandleGetTimePolicy).Methods("GET")
+	router.HandleFunc("/time-policy", s.admin(s.HandleSaveTimePolicy)).Methods("POST")
+	router.HandleFunc("/lightburn/send", s.HandleSendToLightBurn).Methods("POST")
+	router.HandleFunc("/lightburn/ping", s.HandlePingLightBurn).Methods("POST")
+	router.HandleFunc("/lightburn/bridge", s.HandleGetLightBurnBridge).Methods("GET")
+	router.HandleFunc("/lightburn/bridge", s.admin(s.HandleSaveLightBurnBridge)).Methods("POST")
+	router.HandleFunc("/export/gcode", s.HandleExportGCode).Methods("GET")
+	router.HandleFunc("/export/svg", s.HandleExportSVG).Methods("GET")
+	router.HandleFunc("/export/svg/queue", s.HandleExportQueueSVG).Methods("GET")
+	router.HandleFunc("/export/layout", s.HandleGetPlateLayout).Methods("GET")
+	router.HandleFunc("/export/layout", s.admin(s.HandleSavePlateLayout)).Methods("POST")
+	router.HandleFunc("/export/lightburn", s.HandleExportLightBurn).Methods("GET")
+	router.HandleFunc("/export/lightburn/batch", s.HandleExportLightBurnBatch).Methods("GET")
+	router.HandleFunc("/export/lightburn/template", s.HandleGetLightBurnTemplate).Methods("GET")
+	router.HandleFunc("/export/lightburn/template", s.admin(s.HandleUploadLightBurnTemplate)).Methods("POST")
+	s.registerAPIv1(router)
+	return router
 }
 
 var (
@@ -58,23 +140,79 @@ func (s *APIServer) handleIndexPage(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	records, err := s.store.GetHistoryRecords()
+	event, err := s.store.GetActiveEvent()
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	eventID := s.activeEventID()
+	records, err := s.store.GetHistoryRecords(eventID, "")
 
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	races, err := s.store.GetRaceNames(eventID)
 	if err != nil {
 		fmt.Println("error", err)
 	}
 	templ := template.Must(template.ParseFS(res, page))
 
-	data := map[string][]*Athlete{
-		"Records": {},
+	data := map[string]any{
+		"Event":      event,
+		"Records":    records,
+		"Races":      races,
+		"AutoUpdate": s.scraper.Status().AutoUpdate,
+		"Interval":   int(DefaultUpdateInterval.Minutes()),
+		// Tab tells the stream which tab made a change, see tabHeader.
+		"Tab":     newToken(),
+		"Station": stationName(r),
+		"User":    currentUser(r),
+		"Admin":   currentUser(r).Role == RoleAdmin,
+		"CSRF":    currentSession(r).CSRF,
 	}
-	data["Records"] = records
 	templ.Execute(w, data)
 }
 
+// activeEventID returns the ID of the active event or "" if there is none.
+func (s *APIServer) activeEventID() string {
+	event, err := s.store.GetActiveEvent()
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	if event == nil {
+		return ""
+	}
+	return event.EventID
+}
+
+// handleSearchBib looks the bib up in the active event, or in the event
+// given in the form. With all_events set every event is searched, a single
+// match is shown right away and several matches are offered for picking.
+// A query made of letters is a name search, it only lists the candidates.
 func (s *APIServer) handleSearchBib(w http.ResponseWriter, r *http.Request) {
-	bib := r.PostFormValue("bib")
-	a, err := s.store.GetRecordByBib(bib)
+	bib := strings.TrimSpace(r.PostFormValue("bib"))
+	activeID := s.activeEventID()
+	eventID := r.PostFormValue("event")
+	if eventID == "" && isNameQuery(bib) {
+		s.searchName(w, r, bib)
+		return
+	}
+	if eventID == "" && r.PostFormValue("all_events") != "" {
+		matches, err := s.store.FindRecordsByBib(bib)
+		if err != nil {
+			fmt.Println("error", err)
+		}
+		if len(matches) > 1 {
+			renderEventCandidates(w, matches, r.PostFormValue("with_race"))
+			return
+		}
+		if len(matches) == 1 {
+			eventID = matches[0].EventID
+		}
+	}
+	if eventID == "" {
+		eventID = activeID
+	}
+	a, err := s.store.GetRecordByBib(eventID, bib)
 	if err != nil {
 		fmt.Println("error", err)
 	}
@@ -83,33 +221,147 @@ func (s *APIServer) handleSearchBib(w http.ResponseWriter, r *http.Request) {
 	if a == nil {
 		htmlStr = fmt.Sprintf(`
 			<button type='button' class='list-group-item list-group-item-action list-group-item-danger' id='copy-data'>Участник %s не найден</button>
-			`, bib)
+			`, html.EscapeString(bib))
 	} else {
+		text, err := s.engravingText(a)
+		var templateNote string
+		if err != nil {
+			templateNote = fmt.Sprintf(`<div class='list-group-item small text-danger'>Ошибка шаблона гравировки, использован стандартный: %s</div>`,
+				html.EscapeString(err.Error()))
+		}
+		if r.PostFormValue("with_race") != "" && a.ResultsRaceName != "" {
+			text = fmt.Sprintf("%s %s", text, a.ResultsRaceName)
+		}
+		var eventNote string
+		if a.EventID != activeID {
+			eventNote = fmt.Sprintf(`<div class='list-group-item small text-muted'>Соревнование: <span class='badge bg-info text-dark'>%s</span></div>`,
+				html.EscapeString(a.EventName))
+		}
+		resultClass := "list-group-item-success"
+		if a.Blocked() {
+			resultClass = "list-group-item-danger"
+		}
 		htmlStr = fmt.Sprintf(`
-			<button type='button' class='list-group-item list-group-item-action list-group-item-success' id='copy-data' onclick='copyToClipboard()'>%s %s %s</button>
+			%s
+			%s
+			<button type='button' class='list-group-item list-group-item-action %s' id='copy-data' style='white-space: pre-line' onclick='copyToClipboard()'>%s</button>
+			%s
+			%s
+			%s
+			%s
+			%s
+			%s
 			`,
-			a.ResultsFirstName, a.ResultsLastName, a.ResultsTime)
+			statusNote(a), s.engravedNote(a), resultClass, html.EscapeString(text), s.lightburnButton(a), templateNote, raceBadge(a.ResultsRaceName), placeNote(a), splitsNote(a), eventNote)
+	}
+	fmt.Fprint(w, htmlStr)
+	if a != nil {
+		s.renderJobControls(w, a, "")
+	}
+}
+
+var eventCandidatesTmpl = template.Must(template.New("candidates").Parse(`
+	<div class='list-group-item list-group-item-warning'>Номер {{ .Bib }} найден в нескольких соревнованиях:</div>
+	{{ range .Athletes }}
+	<button type='button' class='list-group-item list-group-item-action'
+		hx-post='/search' hx-target='#participants' hx-swap='innerHTML'
+		hx-vals='{"bib": "{{ .ResultsBib }}", "event": "{{ .EventID }}", "with_race": "{{ $.WithRace }}"}'>
+		<span class='badge bg-info text-dark'>{{ .EventName }}</span>
+		{{ .ResultsFirstName }} {{ .ResultsLastName }} {{ .ResultsRaceName }}
+	</button>
+	{{ end }}
+`))
 
-		w.Header().Add("HX-Trigger", "found")
+func renderEventCandidates(w http.ResponseWriter, athletes []*Athlete, withRace string) {
+	data := map[string]any{
+		"Bib":      athletes[0].ResultsBib,
+		"Athletes": athletes,
+		"WithRace": withRace,
+	}
+	if err := eventCandidatesTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
 	}
-	templ, _ := template.New("t").Parse(htmlStr)
-	templ.Execute(w, nil)
 }
 
-func (s *APIServer) HandleArchiveRecord(w http.ResponseWriter, r *http.Request) {
-	a, err := s.store.GetLatestHistoryRecord()
+var nameCandidatesTmpl = template.Must(template.New("names").Parse(`
+	{{ if .Athletes }}
+	<div class='list-group-item list-group-item-warning'>Найдено по запросу «{{ .Query }}»: {{ len .Athletes }}. Выберите участника:</div>
+	{{ range .Athletes }}
+	<button type='button' class='list-group-item list-group-item-action'
+		hx-post='/search' hx-target='#participants' hx-swap='innerHTML'
+		hx-vals='{"bib": "{{ .ResultsBib }}", "event": "{{ .EventID }}", "with_race": "{{ $.WithRace }}"}'>
+		<strong>{{ .ResultsBib }}</strong> {{ .ResultsFirstName }} {{ .ResultsLastName }}
+		{{ if .ResultsRaceName }}<span class='badge bg-secondary'>{{ .ResultsRaceName }}</span>{{ end }}
+		{{ .OfficialTime }}
+		{{ if .StatusLabel }}<span class='badge {{ .StatusClass }}' title='{{ .StatusTitle }}'>{{ .StatusLabel }}</span>{{ end }}
+		{{ if $.AllEvents }}<span class='badge bg-info text-dark'>{{ .EventName }}</span>{{ end }}
+	</button>
+	{{ end }}
+	{{ else }}
+	<button type='button' class='list-group-item list-group-item-action list-group-item-danger' id='copy-data'>Участник «{{ .Query }}» не найден</button>
+	{{ end }}
+`))
+
+// searchName lists the participants matching the name. The history entry is
+// only made once the operator picks one of them.
+func (s *APIServer) searchName(w http.ResponseWriter, r *http.Request, query string) {
+	allEvents := r.PostFormValue("all_events") != ""
+	eventID := ""
+	if !allEvents {
+		eventID = s.activeEventID()
+	}
+	athletes, err := s.store.FindRecordsByName(eventID, query)
 	if err != nil {
 		fmt.Println("error", err)
 	}
-	htmlStr := fmt.Sprintf(`
+	for _, a := range athletes {
+		// a row without a valid time is still worth showing
+		processTimeForRecord(a)
+	}
+	data := map[string]any{
+		"Query":     query,
+		"Athletes":  athletes,
+		"WithRace":  r.PostFormValue("with_race"),
+		"AllEvents": allEvents,
+	}
+	if err := nameCandidatesTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func raceBadge(raceName string) string {
+	if raceName == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<div class='list-group-item small text-muted'>Дистанция: <span class='badge bg-secondary'>%s</span></div>`,
+		html.EscapeString(raceName))
+}
+
+var historyRowsTmpl = template.Must(template.New("history").Parse(`
+	{{ range . }}
+	{{ $entry := . }}
+	{{ with .Athlete }}
           <tr class='table-secondary'>
-            <th scope='row'>%s</th>
-            <td>%s %s</td>
-            <td>%s</td>
+            <th scope='row'>{{ .ResultsBib }}</th>
+            <td>{{ .ResultsFirstName }} {{ .ResultsLastName }}</td>
+            <td>{{ .ResultsRaceName }}</td>
+            <td>{{ .OfficialTime }}{{ if .StatusLabel }} <span class='badge {{ .StatusClass }}' title='{{ .StatusTitle }}'>{{ .StatusLabel }}</span>{{ end }}</td>
+            <td class='small'>{{ $entry.Place }}{{ if $entry.Reprint }} <span class='badge bg-warning text-dark'>повторно</span>{{ end }}
+              {{ if $entry.Reason }}<div class='text-muted'>{{ $entry.Reason }}</div>{{ end }}</td>
+            <td class='text-end'><a class='btn btn-sm btn-outline-secondary' href='/export/svg?event={{ .EventID }}&bib={{ .ResultsBib }}' download>SVG</a>
+              <a class='btn btn-sm btn-outline-secondary' href='/export/lightburn?event={{ .EventID }}&bib={{ .ResultsBib }}' download>LightBurn</a></td>
           </tr>
-	`, a.ResultsBib, a.ResultsFirstName, a.ResultsLastName, a.ResultsTime)
-	templ, _ := template.New("a").Parse(htmlStr)
-	templ.Execute(w, nil)
+	{{ end }}
+	{{ end }}
+`))
+
+func (s *APIServer) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
+	records, err := s.store.GetHistoryRecords(s.activeEventID(), r.FormValue("race"))
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	historyRowsTmpl.Execute(w, records)
 }
 
 func alertDangerResponse(w http.ResponseWriter, header string, errText string) {
@@ -119,151 +371,152 @@ func alertDangerResponse(w http.ResponseWriter, header string, errText string) {
 		<p>%s</p>
 		</div>
 	`, header, errText)
-	templ, _ := template.New("alert").Parse(htmlStr)
-	templ.Execute(w, nil)
+	fmt.Fprint(w, htmlStr)
 
 }
 
 func (s *APIServer) HandlePartialDBUpdate(w http.ResponseWriter, r *http.Request) {
-	if s.scraper.config.clientID == "" || s.scraper.config.eventID == "" || s.scraper.config.source == "" {
+	if !s.scraper.Configured() {
 		alertDangerResponse(w, "Соревнование не настроено", "Заполните поля в разделе 'Настройка соревнования'")
 		return
 	}
-	recordsAdded := s.scraper.StartPartialScraping()
+	stats, err := s.scraper.Update(r.Context())
+	if err == ErrScrapeRunning {
+		alertDangerResponse(w, "База данных не обновлена", err.Error())
+		return
+	}
+	if err != nil {
+		alertDangerResponse(w, "Ошибка обновления базы данных",
+			fmt.Sprintf("%s<br>Сохранено: %d новых, %d изменено. Ранее загруженные результаты доступны для поиска.",
+				html.EscapeString(err.Error()), stats.New, stats.Changed))
+		return
+	}
 	updTime := time.Now().Format(time.TimeOnly)
 	htmlStr := fmt.Sprintf(`
 		<div class="alert alert-info" role="alert">
 		<h4 class="alert-heading">База данных обновлена!</h4>
-		<p>Добавлено %d записей в %s.</p>
+		<p>%d новых, %d изменено в %s.</p>
+		%s
 		</div>
-	`, recordsAdded, updTime)
-	templ, _ := template.New("count").Parse(htmlStr)
-	templ.Execute(w, nil)
+	`, stats.New, stats.Changed, updTime, engravedChangedNote(stats.EngravedChanged))
+	fmt.Fprint(w, htmlStr)
 }
 
-func (s *APIServer) HandleStartAutoDBUpdate(w http.ResponseWriter, r *http.Request) {
-	if s.scraper.config.clientID == "" || s.scraper.config.eventID == "" || s.scraper.config.source == "" {
-		alertDangerResponse(w, "Соревнование не настроено", "Заполните поля в разделе 'Настройка соревнования'")
-		return
+// engravedChangedNote warns about results that changed after the plaque was
+// already engraved.
+func engravedChangedNote(bibs []string) string {
+	if len(bibs) == 0 {
+		return ""
 	}
-	// recordsAdded := s.scraper.StartPartialScraping()
-	nextUpdTime := time.Now().Add(time.Minute * 5).Format(time.TimeOnly)
-	htmlStr := fmt.Sprintf(`
-		<div class="alert alert-info" role="alert">
-		<h4 class="alert-heading">Автообновление запущено</h4>
-		<p>База данных будет обновляться каждые 5 минут</p>
-		<p>Следующее обновление в <strong>%s</strong></p>
-		</div>
-
-		<button type="button"
-		hx-post="/pupdate" 
-		hx-target="#notification" 
-		hx-swap="innerHTML"
-		hx-swap-oob="true"
-		hx-indicator="#spinner"
-		hx-trigger="every 5m, click"
-		id="btn-manual-update"
-		class="btn btn-primary">
-			Обновить базу
-			<div class="htmx-indicator spinner-border spinner-border-sm" role="status" id="spinner"></div>
-		</button>
+	return fmt.Sprintf(`<p class="text-danger">Изменилось время у уже выгравированных номеров: <strong>%s</strong></p>`,
+		html.EscapeString(strings.Join(bibs, ", ")))
+}
 
+// autoUpdateButton renders the auto update toggle for the given state. It is
+// swapped out of band so the page always reflects the server schedule.
+func autoUpdateButton(running bool) string {
+	if running {
+		return `
 		<button type="button" 
 		hx-post="/auto-update-stop" 
 		hx-target="#notification" 
 		hx-swap="innerHTML" 
 		hx-swap-oob="true"
-		hx-indicator="#spinner-auto" 
 		id="btn-auto-update" 
 		class="btn btn-warning">
 			Остановить
 		</button>
-	`, nextUpdTime)
-	templ, _ := template.New("count").Parse(htmlStr)
-	templ.Execute(w, nil)
-}
-
-func (s *APIServer) HandleStopAutoDBUpdate(w http.ResponseWriter, r *http.Request) {
-	if s.scraper.config.clientID == "" || s.scraper.config.eventID == "" || s.scraper.config.source == "" {
-		alertDangerResponse(w, "Соревнование не настроено", "Заполните поля в разделе 'Настройка соревнования'")
-		return
+		`
 	}
-	// recordsAdded := s.scraper.StartPartialScraping()
-	updTime := time.Now().Format(time.TimeOnly)
-	htmlStr := fmt.Sprintf(`
-		<div class="alert alert-info" role="alert">
-		<h4 class="alert-heading">Автообновление остановлено</h4>
-		<p>%s</p>
-		</div>
-
-		<button type="button"
-		hx-post="/pupdate" 
-		hx-target="#notification" 
-		hx-swap="innerHTML"
-		hx-swap-oob="true"
-		hx-indicator="#spinner"
-		hx-trigger="click"
-		id="btn-manual-update"
-		class="btn btn-primary">
-			Обновить базу
-			<div class="htmx-indicator spinner-border spinner-border-sm" role="status" id="spinner"></div>
-		</button>
-
+	return `
 		<button type="button" 
 		hx-post="/auto-update-start" 
+		hx-include="#update-interval"
 		hx-target="#notification" 
 		hx-swap="innerHTML" 
 		hx-swap-oob="true"
-		hx-indicator="#spinner-auto" 
 		id="btn-auto-update" 
 		class="btn btn-secondary">
 			Автообновление
 		</button>
-	`, updTime)
-	templ, _ := template.New("count").Parse(htmlStr)
-	templ.Execute(w, nil)
+		`
 }
 
-func (s *APIServer) HandleDeleteHistory(w http.ResponseWriter, r *http.Request) {
-	s.store.ClearHistory()
-	// http.Redirect(w, r, "/index", http.StatusSeeOther)
+func (s *APIServer) HandleStartAutoDBUpdate(w http.ResponseWriter, r *http.Request) {
+	if !s.scraper.Configured() {
+		alertDangerResponse(w, "Соревнование не настроено", "Заполните поля в разделе 'Настройка соревнования'")
+		return
+	}
+	interval := DefaultUpdateInterval
+	if minutes, err := strconv.Atoi(r.PostFormValue("interval")); err == nil && minutes > 0 {
+		interval = time.Duration(minutes) * time.Minute
+	}
+	s.scraper.StartAutoUpdate(interval)
+	s.notify(w, r, StreamScrape)
+
+	htmlStr := fmt.Sprintf(`
+		<div class="alert alert-info" role="alert">
+		<h4 class="alert-heading">Автообновление запущено</h4>
+		<p>База данных будет обновляться каждые %d мин.</p>
+		</div>
+		%s
+	`, int(interval.Minutes()), autoUpdateButton(true))
+	fmt.Fprint(w, htmlStr)
 }
 
-func (s *APIServer) HandleCreateConfig(w http.ResponseWriter, r *http.Request) {
-	login := r.PostFormValue("login")
-	password := r.PostFormValue("password")
-	clienID := r.PostFormValue("clientID")
-	eventID := r.PostFormValue("eventID")
+func (s *APIServer) HandleStopAutoDBUpdate(w http.ResponseWriter, r *http.Request) {
+	s.scraper.StopAutoUpdate()
+	s.notify(w, r, StreamScrape)
+	updTime := time.Now().Format(time.TimeOnly)
+	htmlStr := fmt.Sprintf(`
+		<div class="alert alert-info" role="alert">
+		<h4 class="alert-heading">Автообновление остановлено</h4>
+		<p>%s</p>
+		</div>
+		%s
+	`, updTime, autoUpdateButton(false))
+	fmt.Fprint(w, htmlStr)
+}
 
-	s.scraper.config = *s.scraper.config.Default(login, password, clienID, eventID)
+func (s *APIServer) HandleScrapeStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.scraper.Status()
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.TimeOnly)
+	}
 
-	event, err := s.scraper.CheckEventURL()
-	if err != nil {
-		alertDangerResponse(w, "Конфигурация Chronotrack API НЕ НАСТРОЕНА!", fmt.Sprintf("Ошибка %s", err))
-		return
+	state := "остановлено"
+	if status.AutoUpdate {
+		state = fmt.Sprintf("каждые %d мин.", int(status.Interval.Minutes()))
 	}
-	timeParsed, err := strconv.Atoi(event.StartTime)
-	if err != nil {
-		log.Fatal(err)
+	if status.Running {
+		state += ", идёт обновление"
+	}
+	lastError := "-"
+	if status.LastError != "" {
+		lastError = fmt.Sprintf(`<span class="text-danger">%s</span>`, html.EscapeString(status.LastError))
 	}
-	startTime := time.Unix(int64(timeParsed), 0).Format(time.TimeOnly)
 	htmlStr := fmt.Sprintf(`
-		<div class="alert alert-info" role="alert">
-		<h4 class="alert-heading">Конфигурация Chronotrack API настроена!</h4>
-		<p>Соревнование <strong>%s</strong></p>
-		<p>Начало в %s</p>
-		</div>
-	`, event.EventName, startTime)
-	templ, _ := template.New("config").Parse(htmlStr)
-	templ.Execute(w, nil)
+		<ul class="list-group list-group-flush small">
+		<li class="list-group-item">Автообновление: %s</li>
+		<li class="list-group-item">Последнее обновление: %s (%d новых, %d изменено)</li>
+		<li class="list-group-item">Следующее обновление: %s</li>
+		<li class="list-group-item">Последняя ошибка: %s</li>
+		</ul>
+	`, state, formatTime(status.LastRun), status.LastStats.New, status.LastStats.Changed, formatTime(status.NextRun), lastError)
+	fmt.Fprint(w, htmlStr)
 }
 
-// decorator to decorate all apiFuncs to HandleFuncs
-// func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
-// 	return func(w http.ResponseWriter, r *http.Request) {
-// 		if err := f(w, r); err != nil {
-// 			//handle the error
-// 			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
-// 		}
-// 	}
-// }
+func (s *APIServer) HandleDeleteHistory(w http.ResponseWriter, r *http.Request) {
+	event, err := s.store.GetActiveEvent()
+	if err != nil || event == nil {
+		return
+	}
+	if err := s.store.ClearHistory(event.EventID); err != nil {
+		fmt.Println("error", err)
+	}
+	s.notify(w, r, StreamHistory)
+	// http.Redirect(w, r, "/index", http.StatusSeeOther)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer runs the server on a fresh SQLite database.
+func newTestServer(t *testing.T) (*APIServer, *SqliteStore) {
+	t.Helper()
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "laser.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := newSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPIServer(":0", store, NewScraper(store), secrets), store
+}
+
+// addTestUser stores a user with the password "password1".
+func addTestUser(t *testing.T, store Storage, username string, role Role) {
+	t.Helper()
+	hash, err := hashPassword("password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveUser(&User{Username: username, PasswordHash: hash, Role: role}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSession logs the user in and returns the session.
+func testSession(t *testing.T, store Storage, username string) *Session {
+	t.Helper()
+	session := &Session{Token: newToken(), Username: username, CSRF: newToken(), ExpiresAt: time.Now().Add(sessionTTL)}
+	if err := store.CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// serve sends a form request through the router. A session adds its
+// cookie, the CSRF token is only sent when given.
+func serve(handler http.Handler, method, target string, form url.Values, session *Session, csrf string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if session != nil {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.Token})
+	}
+	if csrf != "" {
+		r.Header.Set(csrfHeader, csrf)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The /api/v1 handlers speak JSON only. They are thin wrappers around the
+// same store and scraper calls the HTMX handlers use.
+
+type apiFunc func(w http.ResponseWriter, r *http.Request) error
+
+// ApiError is the body of every failed /api/v1 response.
+type ApiError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// apiStatusError lets an apiFunc choose the status code of its error.
+type apiStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *apiStatusError) Error() string {
+	return e.msg
+}
+
+func apiErrorf(status int, format string, a ...any) error {
+	return &apiStatusError{status: status, msg: fmt.Sprintf(format, a...)}
+}
+
+// decorator to decorate all apiFuncs to HandleFuncs
+func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := f(w, r); err != nil {
+			status := http.StatusInternalServerError
+			var statusErr *apiStatusError
+			if errors.As(err, &statusErr) {
+				status = statusErr.status
+			}
+			WriteJSON(w, status, ApiError{Status: status, Error: err.Error()})
+		}
+	}
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func readJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return apiErrorf(http.StatusBadRequest, "invalid request body: %s", err)
+	}
+	return nil
+}
+
+func (s *APIServer) registerAPIv1(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.requireBasicAuth)
+
+	api.HandleFunc("/openapi.json", makeHTTPHandleFunc(s.handleAPIOpenAPI)).Methods("GET")
+	api.HandleFunc("/athletes", makeHTTPHandleFunc(s.handleAPIFindAthletes)).Methods("GET")
+	api.HandleFunc("/events", makeHTTPHandleFunc(s.handleAPIListEvents)).Methods("GET")
+	api.HandleFunc("/events", makeHTTPHandleFunc(apiAdmin(s.handleAPICreateEvent))).Methods("POST")
+	api.HandleFunc("/events/{id}", makeHTTPHandleFunc(s.handleAPIGetEvent)).Methods("GET")
+	api.HandleFunc("/events/{id}", makeHTTPHandleFunc(apiAdmin(s.handleAPIDeleteEvent))).Methods("DELETE")
+	api.HandleFunc("/events/{id}/activate", makeHTTPHandleFunc(apiAdmin(s.handleAPIActivateEvent))).Methods("POST")
+	api.HandleFunc("/events/{id}/reset", makeHTTPHandleFunc(apiAdmin(s.handleAPIResetEvent))).Methods("POST")
+	api.HandleFunc("/events/{id}/athletes", makeHTTPHandleFunc(s.handleAPIFindAthletes)).Methods("GET")
+	api.HandleFunc("/events/{id}/athletes/{bib}", makeHTTPHandleFunc(s.handleAPIGetAthlete)).Methods("GET")
+	api.HandleFunc("/events/{id}/athletes/{bib}/engraving", makeHTTPHandleFunc(s.handleAPIEngravingText)).Methods("GET")
+	api.HandleFunc("/events/{id}/athletes/{bib}/svg", makeHTTPHandleFunc(s.handleAPIAthleteSVG)).Methods("GET")
+	api.HandleFunc("/events/{id}/athletes/{bib}/lightburn", makeHTTPHandleFunc(s.handleAPIAthleteLightBurn)).Methods("GET")
+	api.HandleFunc("/events/{id}/athletes/{bib}/gcode", makeHTTPHandleFunc(s.handleAPIAthleteGCode)).Methods("GET")
+	api.HandleFunc("/events/{id}/athletes/{bib}/lightburn/send", makeHTTPHandleFunc(s.handleAPISendToLightBurn)).Methods("POST")
+	api.HandleFunc("/events/{id}/templates", makeHTTPHandleFunc(s.handleAPIGetTemplates)).Methods("GET")
+	api.HandleFunc("/events/{id}/templates", makeHTTPHandleFunc(apiAdmin(s.handleAPISaveTemplate))).Methods("PUT")
+	api.HandleFunc("/events/{id}/templates", makeHTTPHandleFunc(apiAdmin(s.handleAPIDeleteTemplate))).Methods("DELETE")
+	api.HandleFunc("/events/{id}/history", makeHTTPHandleFunc(s.handleAPIGetHistory)).Methods("GET")
+	api.HandleFunc("/events/{id}/history", makeHTTPHandleFunc(apiAdmin(s.handleAPIClearHistory))).Methods("DELETE")
+	api.HandleFunc("/events/{id}/queue", makeHTTPHandleFunc(s.handleAPIGetQueue)).Methods("GET")
+	api.HandleFunc("/events/{id}/queue", makeHTTPHandleFunc(s.handleAPIEnqueue)).Methods("POST")
+	api.HandleFunc("/events/{id}/queue/svg", makeHTTPHandleFunc(s.handleAPIQueueSVG)).Methods("GET")
+	api.HandleFunc("/events/{id}/lightburn", makeHTTPHandleFunc(s.handleAPIBatchLightBurn)).Methods("GET")
+	api.HandleFunc("/queue/{job}", makeHTTPHandleFunc(s.handleAPIGetJob)).Methods("GET")
+	api.HandleFunc("/queue/{job}", makeHTTPHandleFunc(s.handleAPIUpdateJob)).Methods("PATCH")
+	api.HandleFunc("/queue/{job}/laser", makeHTTPHandleFunc(s.handleAPILaserJob)).Methods("POST")
+	api.HandleFunc("/laser", makeHTTPHandleFunc(s.handleAPILaserStatus)).Methods("GET")
+	api.HandleFunc("/laser/abort", makeHTTPHandleFunc(s.handleAPILaserAbort)).Methods("POST")
+	api.HandleFunc("/scrape", makeHTTPHandleFunc(s.handleAPIScrapeStatus)).Methods("GET")
+	api.HandleFunc("/scrape", makeHTTPHandleFunc(s.handleAPIScrape)).Methods("POST")
+	api.HandleFunc("/scrape/schedule", makeHTTPHandleFunc(apiAdmin(s.handleAPIStartSchedule))).Methods("PUT")
+	api.HandleFunc("/scrape/schedule", makeHTTPHandleFunc(apiAdmin(s.handleAPIStopSchedule))).Methods("DELETE")
+	api.HandleFunc("/settings/layout", makeHTTPHandleFunc(s.handleAPIGetLayout)).Methods("GET")
+	api.HandleFunc("/settings/layout", makeHTTPHandleFunc(apiAdmin(s.handleAPISaveLayout))).Methods("PUT")
+	api.HandleFunc("/settings/lightburn", makeHTTPHandleFunc(s.handleAPIGetLightBurnTemplate)).Methods("GET")
+	api.HandleFunc("/settings/lightburn", makeHTTPHandleFunc(apiAdmin(s.handleAPISaveLightBurnTemplate))).Methods("PUT")
+	api.HandleFunc("/settings/grbl", makeHTTPHandleFunc(s.handleAPIGetGrblSettings)).Methods("GET")
+	api.HandleFunc("/settings/grbl", makeHTTPHandleFunc(apiAdmin(s.handleAPISaveGrblSettings))).Methods("PUT")
+	api.HandleFunc("/settings/time", makeHTTPHandleFunc(s.handleAPIGetTimePolicy)).Methods("GET")
+	api.HandleFunc("/settings/time", makeHTTPHandleFunc(apiAdmin(s.handleAPISaveTimePolicy))).Methods("PUT")
+	api.HandleFunc("/settings/lightburn-bridge", makeHTTPHandleFunc(s.handleAPIGetLightBurnBridge)).Methods("GET")
+	api.HandleFunc("/settings/lightburn-bridge", makeHTTPHandleFunc(apiAdmin(s.handleAPISaveLightBurnBridge))).Methods("PUT")
+	api.NotFoundHandler = makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return apiErrorf(http.StatusNotFound, "no such endpoint: %s %s", r.Method, r.URL.Path)
+	})
+	api.MethodNotAllowedHandler = makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return apiErrorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+	})
+}
+
+type athleteJSON struct {
+	EventID   string `json:"event_id"`
+	EventName string `json:"event_name"`
+	Bib       string `json:"bib"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Time      string `json:"time"`
+	GunTime   string `json:"gun_time"`
+	// OfficialTime is the chip or the gun time, as the race is set up.
+	OfficialTime string `json:"official_time"`
+	RaceName     string `json:"race_name"`
+	Sex          string `json:"sex"`
+	Category     string `json:"category"`
+	Age          string `json:"age"`
+	// Places come from the source, or are worked out from the times.
+	Place         string `json:"place"`
+	SexPlace      string `json:"sex_place"`
+	CategoryPlace string `json:"category_place"`
+	// Status is DNF, DNS, DSQ or UNOFFICIAL, empty for an official finish.
+	Status string `json:"status"`
+	// Splits are only filled in for a single athlete.
+	Splits []splitJSON `json:"splits,omitempty"`
+}
+
+type splitJSON struct {
+	Name string `json:"name"`
+	Time string `json:"time"`
+}
+
+func newAthleteJSON(a *Athlete) athleteJSON {
+	aj := athleteJSON{
+		EventID:       a.EventID,
+		EventName:     a.EventName,
+		Bib:           a.ResultsBib,
+		FirstName:     a.ResultsFirstName,
+		LastName:      a.ResultsLastName,
+		Time:          a.ResultsTime,
+		GunTime:       a.ResultsGunTime,
+		OfficialTime:  a.OfficialTime(),
+		RaceName:      a.ResultsRaceName,
+		Sex:           a.ResultsSex,
+		Category:      a.ResultsCategory,
+		Age:           a.ResultsAge,
+		Place:         a.ResultsRank,
+		SexPlace:      a.ResultsSexRank,
+		CategoryPlace: a.ResultsCategoryRank,
+		Status:        a.ResultsStatus,
+	}
+	for _, split := range a.Splits {
+		aj.Splits = append(aj.Splits, splitJSON{Name: split.Name, Time: split.Time})
+	}
+	return aj
+}
+
+func newAthletesJSON(athletes []*Athlete) []athleteJSON {
+	list := make([]athleteJSON, 0, len(athletes))
+	for _, a := range athletes {
+		list = append(list, newAthleteJSON(a))
+	}
+	return list
+}
+
+type eventJSON struct {
+	EventID    string `json:"event_id"`
+	EventName  string `json:"event_name"`
+	SourceType string `json:"source_type"`
+	StartTime  string `json:"start_time"`
+	Active     bool   `json:"active"`
+	Results    int    `json:"results"`
+	Connected  bool   `json:"connected"`
+	// Reprints counts the plaques engraved again, on top of one per athlete.
+	Reprints int `json:"reprints"`
+}
+
+func (s *APIServer) newEventJSON(e *Event) eventJSON {
+	return eventJSON{
+		EventID:    e.EventID,
+		EventName:  e.EventName,
+		SourceType: e.SourceType,
+		StartTime:  e.StartTime,
+		Active:     e.Active,
+		Results:    s.store.GetRecordsCount(e.EventID),
+		Connected:  s.scraper.HasSource(e.EventID),
+		Reprints:   s.store.GetReprintCount(e.EventID),
+	}
+}
+
+type jobJSON struct {
+	ID        int         `json:"id"`
+	Status    JobStatus   `json:"status"`
+	Reason    string      `json:"reason"`
+	Failure   string      `json:"failure"`
+	Operator  string      `json:"operator"`
+	Station   string      `json:"station"`
+	Position  int         `json:"position"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Athlete   athleteJSON `json:"athlete"`
+}
+
+type historyJSON struct {
+	ID        int         `json:"id"`
+	Operator  string      `json:"operator"`
+	Station   string      `json:"station"`
+	Reason    string      `json:"reason"`
+	Reprint   bool        `json:"reprint"`
+	CreatedAt time.Time   `json:"created_at"`
+	Athlete   athleteJSON `json:"athlete"`
+}
+
+func newHistoryJSON(e *HistoryEntry) historyJSON {
+	return historyJSON{
+		ID:        e.ID,
+		Operator:  e.Operator,
+		Station:   e.Station,
+		Reason:    e.Reason,
+		Reprint:   e.Reprint,
+		CreatedAt: e.CreatedAt,
+		Athlete:   newAthleteJSON(e.Athlete),
+	}
+}
+
+func newJobJSON(j *QueueJob) jobJSON {
+	return jobJSON{
+		ID:        j.ID,
+		Status:    j.Status,
+		Reason:    j.Reason,
+		Failure:   j.Failure,
+		Operator:  j.Operator,
+		Station:   j.Station,
+		Position:  j.Position,
+		CreatedAt: j.CreatedAt,
+		UpdatedAt: j.UpdatedAt,
+		Athlete:   newAthleteJSON(j.Athlete),
+	}
+}
+
+type scrapeStatusJSON struct {
+	AutoUpdate      bool        `json:"auto_update"`
+	IntervalSeconds int         `json:"interval_seconds"`
+	Running         bool        `json:"running"`
+	LastRun         *time.Time  `json:"last_run"`
+	NextRun         *time.Time  `json:"next_run"`
+	LastError       string      `json:"last_error"`
+	LastStats       UpsertStats `json:"last_stats"`
+}
+
+func newScrapeStatusJSON(status ScrapeStatus) scrapeStatusJSON {
+	optionalTime := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return scrapeStatusJSON{
+		AutoUpdate:      status.AutoUpdate,
+		IntervalSeconds: int(status.Interval.Seconds()),
+		Running:         status.Running,
+		LastRun:         optionalTime(status.LastRun),
+		NextRun:         optionalTime(status.NextRun),
+		LastError:       status.LastError,
+		LastStats:       status.LastStats,
+	}
+}
+
+func (s *APIServer) handleAPIOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	doc, err := res.ReadFile("static/openapi.json")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(doc)
+	return err
+}
+
+// apiEvent returns the event named in the path. The ID "active" stands for
+// the active event.
+func (s *APIServer) apiEvent(r *http.Request) (*Event, error) {
+	eventID := mux.Vars(r)["id"]
+	events, err := s.store.GetEvents()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if e.EventID == eventID || (eventID == "active" && e.Active) {
+			return e, nil
+		}
+	}
+	if eventID == "active" {
+		return nil, apiErrorf(http.StatusNotFound, "no active event")
+	}
+	return nil, apiErrorf(http.StatusNotFound, "event %s not found", eventID)
+}
+
+func (s *APIServer) handleAPIListEvents(w http.ResponseWriter, r *http.Request) error {
+	events, err := s.store.GetEvents()
+	if err != nil {
+		return err
+	}
+	list := make([]eventJSON, 0, len(events))
+	for _, e := range events {
+		list = append(list, s.newEventJSON(e))
+	}
+	return WriteJSON(w, http.StatusOK, list)
+}
+
+type eventConfigRequest struct {
+	Source    string `json:"source"`
+	EventID   string `json:"event_id"`
+	EventName string `json:"event_name"`
+	Login     string `json:"login"`
+	Password  string `json:"password"`
+	ClientID  string `json:"client_id"`
+	URL       string `json:"url"`
+	Activate  bool   `json:"activate"`
+}
+
+// handleAPICreateEvent adds an event or replaces the source of an existing
+// one, like the configuration form does.
+func (s *APIServer) handleAPICreateEvent(w http.ResponseWriter, r *http.Request) error {
+	req := eventConfigRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	config := SourceConfig{
+		Type:      req.Source,
+		EventName: req.EventName,
+		Login:     req.Login,
+		Password:  req.Password,
+		ClientID:  req.ClientID,
+		EventID:   req.EventID,
+		URL:       req.URL,
+	}
+	if err := s.keepPassword(&config); err != nil {
+		return apiErrorf(http.StatusConflict, "%s", err)
+	}
+	source, err := NewResultSource(config)
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	event, err := source.EventInfo(r.Context())
+	if err != nil {
+		return apiErrorf(http.StatusBadGateway, "event info: %s", err)
+	}
+	if _, err := s.addEvent(config, event, source, req.Activate); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamEvents)
+	return WriteJSON(w, http.StatusCreated, s.newEventJSON(event))
+}
+
+func (s *APIServer) handleAPIGetEvent(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, s.newEventJSON(event))
+}
+
+func (s *APIServer) handleAPIDeleteEvent(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteEvent(event.EventID); err != nil {
+		return err
+	}
+	s.scraper.RemoveSource(event.EventID)
+	w.WriteHeader(http.StatusNoContent)
+	s.stream.publish("", StreamEvents)
+	return nil
+}
+
+func (s *APIServer) handleAPIActivateEvent(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetActiveEvent(event.EventID); err != nil {
+		return err
+	}
+	event.Active = true
+	s.stream.publish("", StreamActivate)
+	return WriteJSON(w, http.StatusOK, s.newEventJSON(event))
+}
+
+func (s *APIServer) handleAPIResetEvent(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ResetEvent(event.EventID); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamReset, StreamEvents, StreamQueue, StreamHistory)
+	return WriteJSON(w, http.StatusOK, s.newEventJSON(event))
+}
+
+// handleAPIFindAthletes looks athletes up by bib or by name without adding
+// them to the history. Without an event in the path all events are searched.
+func (s *APIServer) handleAPIFindAthletes(w http.ResponseWriter, r *http.Request) error {
+	eventID := ""
+	if _, ok := mux.Vars(r)["id"]; ok {
+		event, err := s.apiEvent(r)
+		if err != nil {
+			return err
+		}
+		eventID = event.EventID
+	}
+	bib := strings.TrimSpace(r.URL.Query().Get("bib"))
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	filter, err := parseAthleteFilter(r.URL.Query())
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	var athletes []*Athlete
+	switch {
+	case bib != "":
+		athletes, err = s.store.FindRecordsByBib(bib)
+		if eventID != "" {
+			inEvent := []*Athlete{}
+			for _, a := range athletes {
+				if a.EventID == eventID {
+					inEvent = append(inEvent, a)
+				}
+			}
+			athletes = inEvent
+		}
+	case name != "":
+		athletes, err = s.store.FindRecordsByName(eventID, name)
+	case eventID != "" && !filter.empty():
+		athletes, err = s.store.GetRecords(eventID)
+	default:
+		return apiErrorf(http.StatusBadRequest, "either bib, name or a filter within an event is required")
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range athletes {
+		processTimeForRecord(a)
+	}
+	return WriteJSON(w, http.StatusOK, newAthletesJSON(filter.apply(athletes)))
+}
+
+func (s *APIServer) handleAPIGetAthlete(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	bib := mux.Vars(r)["bib"]
+	athletes, err := s.store.FindRecordsByBib(bib)
+	if err != nil {
+		return err
+	}
+	for _, a := range athletes {
+		if a.EventID == event.EventID {
+			processTimeForRecord(a)
+			s.loadSplits(a)
+			return WriteJSON(w, http.StatusOK, newAthleteJSON(a))
+		}
+	}
+	return apiErrorf(http.StatusNotFound, "bib %s not found in event %s", bib, event.EventID)
+}
+
+// apiAthlete returns the athlete named in the path.
+func (s *APIServer) apiAthlete(r *http.Request) (*Athlete, error) {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return nil, err
+	}
+	bib := mux.Vars(r)["bib"]
+	a, err := s.store.GetRecordByBib(event.EventID, bib)
+	if err == sql.ErrNoRows {
+		return nil, apiErrorf(http.StatusNotFound, "bib %s not found in event %s", bib, event.EventID)
+	}
+	return a, err
+}
+
+type engravingTextJSON struct {
+	Text          string `json:"text"`
+	TemplateError string `json:"template_error,omitempty"`
+}
+
+// handleAPIEngravingText renders the engraving text of the athlete. A broken
+// template falls back to the default one and reports why.
+func (s *APIServer) handleAPIEngravingText(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.apiAthlete(r)
+	if err != nil {
+		return err
+	}
+	resp := engravingTextJSON{}
+	resp.Text, err = s.engravingText(a)
+	if err != nil {
+		resp.TemplateError = err.Error()
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+func (s *APIServer) handleAPIAthleteSVG(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.apiAthlete(r)
+	if err != nil {
+		return err
+	}
+	text, err := s.engravingText(a)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	writeSVG(w, fmt.Sprintf("%s.svg", a.ResultsBib), s.plateLayout().renderSVG([]string{text}))
+	return nil
+}
+
+type templateJSON struct {
+	RaceName string `json:"race_name"`
+	Body     string `json:"body"`
+}
+
+func (s *APIServer) handleAPIGetTemplates(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	templates, err := s.store.GetTemplates(event.EventID)
+	if err != nil {
+		return err
+	}
+	list := make([]templateJSON, 0, len(templates))
+	for _, t := range templates {
+		list = append(list, templateJSON{RaceName: t.RaceName, Body: t.Body})
+	}
+	return WriteJSON(w, http.StatusOK, list)
+}
+
+func (s *APIServer) handleAPISaveTemplate(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	req := templateJSON{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		return apiErrorf(http.StatusBadRequest, "body is required")
+	}
+	if _, err := parseEngravingTemplate(req.Body); err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	t := &EngravingTemplate{EventID: event.EventID, RaceName: req.RaceName, Body: req.Body}
+	if err := s.store.SaveTemplate(t); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamConfig)
+	return WriteJSON(w, http.StatusOK, req)
+}
+
+func (s *APIServer) handleAPIDeleteTemplate(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteTemplate(event.EventID, r.URL.Query().Get("race")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	s.stream.publish("", StreamConfig)
+	return nil
+}
+
+func (s *APIServer) handleAPIGetHistory(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	entries, err := s.store.GetHistoryRecords(event.EventID, r.URL.Query().Get("race"))
+	if err != nil {
+		return err
+	}
+	list := make([]historyJSON, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, newHistoryJSON(e))
+	}
+	return WriteJSON(w, http.StatusOK, list)
+}
+
+func (s *APIServer) handleAPIClearHistory(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ClearHistory(event.EventID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	s.stream.publish("", StreamHistory)
+	return nil
+}
+
+func (s *APIServer) handleAPIGetQueue(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	jobs, err := s.store.GetQueue(event.EventID)
+	if err != nil {
+		return err
+	}
+	list := make([]jobJSON, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, newJobJSON(j))
+	}
+	return WriteJSON(w, http.StatusOK, list)
+}
+
+// handleAPIQueueSVG lays out the plates of the queued jobs as one grid.
+func (s *APIServer) handleAPIQueueSVG(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	texts, err := s.queuedTexts(event.EventID)
+	if err != nil {
+		return err
+	}
+	if len(texts) == 0 {
+		return apiErrorf(http.StatusNotFound, "no queued jobs in event %s", event.EventID)
+	}
+	writeSVG(w, "queue.svg", s.plateLayout().renderSVG(texts))
+	return nil
+}
+
+type enqueueRequest struct {
+	Bib    string `json:"bib"`
+	Reason string `json:"reason"`
+	// Override queues a DNF, DNS or DSQ athlete, the reason is required.
+	Override bool `json:"override"`
+	// Reprint confirms a new plaque for an athlete engraved already.
+	Reprint bool `json:"reprint"`
+}
+
+func (s *APIServer) handleAPIEnqueue(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	req := enqueueRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Bib == "" {
+		return apiErrorf(http.StatusBadRequest, "bib is required")
+	}
+	a, err := s.store.GetRecordByBib(event.EventID, req.Bib)
+	if err == sql.ErrNoRows {
+		return apiErrorf(http.StatusNotFound, "bib %s not found in event %s", req.Bib, event.EventID)
+	}
+	if err != nil {
+		return err
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if err := checkResultStatus(a, req.Override, reason); err != nil {
+		if errors.Is(err, ErrNotFinisher) {
+			return apiErrorf(http.StatusConflict, "%s", err)
+		}
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := s.checkReprint(a, req.Reprint); err == ErrReprintConfirm {
+		return apiErrorf(http.StatusConflict, "%s", err)
+	} else if err != nil {
+		return err
+	}
+	job, err := s.store.EnqueueJob(event.EventID, req.Bib, reason, stamp(r))
+	switch {
+	case err == sql.ErrNoRows:
+		return apiErrorf(http.StatusNotFound, "bib %s not found in event %s", req.Bib, event.EventID)
+	case err == ErrJobActive:
+		return apiErrorf(http.StatusConflict, "%s", err)
+	case err == ErrReprintReason:
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	case err != nil:
+		return err
+	}
+	s.stream.publish("", StreamQueue)
+	return WriteJSON(w, http.StatusCreated, newJobJSON(job))
+}
+
+func apiJobID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["job"])
+	if err != nil {
+		return 0, apiErrorf(http.StatusBadRequest, "invalid job id")
+	}
+	return id, nil
+}
+
+func (s *APIServer) handleAPIGetJob(w http.ResponseWriter, r *http.Request) error {
+	id, err := apiJobID(r)
+	if err != nil {
+		return err
+	}
+	job, err := s.store.GetJob(id)
+	if err == sql.ErrNoRows {
+		return apiErrorf(http.StatusNotFound, "job %d not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, newJobJSON(job))
+}
+
+type jobUpdateRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	// Station is recorded in the history, the X-Golaser-Station header is
+	// used when it is empty.
+	Station string `json:"station"`
+}
+
+func (s *APIServer) handleAPIUpdateJob(w http.ResponseWriter, r *http.Request) error {
+	id, err := apiJobID(r)
+	if err != nil {
+		return err
+	}
+	req := jobUpdateRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	status, err := parseJobStatus(req.Status)
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	by := stamp(r)
+	if station := strings.TrimSpace(req.Station); station != "" {
+		by.Station = station
+	}
+	job, err := s.store.UpdateJobStatus(id, status, strings.TrimSpace(req.Reason), by)
+	switch {
+	case err == sql.ErrNoRows:
+		return apiErrorf(http.StatusNotFound, "job %d not found", id)
+	case errors.Is(err, ErrJobTransition):
+		return apiErrorf(http.StatusConflict, "%s", err)
+	case err != nil:
+		return err
+	}
+	s.stream.publish("", StreamQueue, StreamHistory)
+	return WriteJSON(w, http.StatusOK, newJobJSON(job))
+}
+
+func (s *APIServer) handleAPIScrapeStatus(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, newScrapeStatusJSON(s.scraper.Status()))
+}
+
+// handleAPIScrape runs an update and waits for it to finish.
+func (s *APIServer) handleAPIScrape(w http.ResponseWriter, r *http.Request) error {
+	if !s.scraper.Configured() {
+		return apiErrorf(http.StatusConflict, "no event is configured")
+	}
+	_, err := s.scraper.Update(r.Context())
+	if err == ErrScrapeRunning {
+		return apiErrorf(http.StatusConflict, "%s", err)
+	}
+	if err != nil {
+		return apiErrorf(http.StatusBadGateway, "%s", err)
+	}
+	return WriteJSON(w, http.StatusOK, newScrapeStatusJSON(s.scraper.Status()))
+}
+
+type scheduleRequest struct {
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+func (s *APIServer) handleAPIStartSchedule(w http.ResponseWriter, r *http.Request) error {
+	if !s.scraper.Configured() {
+		return apiErrorf(http.StatusConflict, "no event is configured")
+	}
+	req := scheduleRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.IntervalSeconds < 0 {
+		return apiErrorf(http.StatusBadRequest, "interval_seconds must not be negative")
+	}
+	s.scraper.StartAutoUpdate(time.Duration(req.IntervalSeconds) * time.Second)
+	s.stream.publish("", StreamScrape)
+	return WriteJSON(w, http.StatusOK, newScrapeStatusJSON(s.scraper.Status()))
+}
+
+func (s *APIServer) handleAPIStopSchedule(w http.ResponseWriter, r *http.Request) error {
+	s.scraper.StopAutoUpdate()
+	s.stream.publish("", StreamScrape)
+	return WriteJSON(w, http.StatusOK, newScrapeStatusJSON(s.scraper.Status()))
+}
+
+func (s *APIServer) handleAPIGetLayout(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, s.plateLayout())
+}
+
+func (s *APIServer) handleAPISaveLayout(w http.ResponseWriter, r *http.Request) error {
+	layout := defaultPlateLayout
+	if err := readJSON(r, &layout); err != nil {
+		return err
+	}
+	if err := layout.validate(); err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := s.savePlateLayout(layout); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamConfig)
+	return WriteJSON(w, http.StatusOK, layout)
+}
+
+// apiLightBurn maps a missing project template to 404.
+func apiLightBurn(data []byte, err error) ([]byte, error) {
+	if err == ErrNoLightBurnTemplate {
+		return nil, apiErrorf(http.StatusNotFound, "no LightBurn template uploaded")
+	}
+	return data, err
+}
+
+func (s *APIServer) handleAPIAthleteLightBurn(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.apiAthlete(r)
+	if err != nil {
+		return err
+	}
+	data, err := apiLightBurn(s.renderLightBurn([]*Athlete{a}))
+	if err != nil {
+		return err
+	}
+	writeLightBurn(w, fmt.Sprintf("%s.lbrn2", a.ResultsBib), data)
+	return nil
+}
+
+// handleAPIBatchLightBurn lays out the plates of the bibs in ?bibs=1,2,3,
+// or of the queued jobs without it, on one project.
+func (s *APIServer) handleAPIBatchLightBurn(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.apiEvent(r)
+	if err != nil {
+		return err
+	}
+	var athletes []*Athlete
+	if bibs := splitBibs(r.URL.Query().Get("bibs")); len(bibs) > 0 {
+		var missing string
+		athletes, missing, err = s.athletesByBib(event.EventID, bibs)
+		if err == sql.ErrNoRows {
+			return apiErrorf(http.StatusNotFound, "bib %s not found in event %s", missing, event.EventID)
+		}
+	} else {
+		athletes, err = s.queuedAthletes(event.EventID)
+	}
+	if err != nil {
+		return err
+	}
+	if len(athletes) == 0 {
+		return apiErrorf(http.StatusNotFound, "no queued jobs in event %s", event.EventID)
+	}
+	data, err := apiLightBurn(s.renderLightBurn(athletes))
+	if err != nil {
+		return err
+	}
+	writeLightBurn(w, "batch.lbrn2", data)
+	return nil
+}
+
+func (s *APIServer) handleAPIGetLightBurnTemplate(w http.ResponseWriter, r *http.Request) error {
+	data, err := s.store.GetSetting(lightburnTemplateKey)
+	if err != nil {
+		return err
+	}
+	if data == "" {
+		return apiErrorf(http.StatusNotFound, "no LightBurn template uploaded")
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, err = io.WriteString(w, data)
+	return err
+}
+
+type lightburnTemplateJSON struct {
+	Placeholders []string `json:"placeholders"`
+}
+
+// handleAPISaveLightBurnTemplate takes the .lbrn2 file as the request body.
+func (s *APIServer) handleAPISaveLightBurnTemplate(w http.ResponseWriter, r *http.Request) error {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLightBurnSize))
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "invalid request body: %s", err)
+	}
+	p, err := parseLightBurnProject(data)
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := s.store.SetSetting(lightburnTemplateKey, string(data)); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamConfig)
+	return WriteJSON(w, http.StatusOK, lightburnTemplateJSON{Placeholders: p.placeholders()})
+}
+
+func (s *APIServer) handleAPIAthleteGCode(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.apiAthlete(r)
+	if err != nil {
+		return err
+	}
+	lines, err := s.engravingGCode(a, s.grblSettings())
+	if err != nil {
+		return err
+	}
+	writeGCode(w, a.ResultsBib, lines)
+	return nil
+}
+
+type laserStatusJSON struct {
+	Running   bool       `json:"running"`
+	JobID     int        `json:"job_id,omitempty"`
+	Bib       string     `json:"bib,omitempty"`
+	Lines     int        `json:"lines"`
+	Done      int        `json:"done"`
+	Grbl      string     `json:"grbl,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+func newLaserStatusJSON(status LaserStatus) laserStatusJSON {
+	resp := laserStatusJSON{
+		Running:   status.Running,
+		JobID:     status.JobID,
+		Bib:       status.Bib,
+		Lines:     status.Lines,
+		Done:      status.Done,
+		Grbl:      status.Grbl,
+		LastError: status.LastError,
+	}
+	if !status.Finished.IsZero() {
+		resp.Finished = &status.Finished
+	}
+	return resp
+}
+
+// handleAPILaserJob starts the laser on a queued job and answers at once,
+// the job turns engraved or failed when the laser stops.
+func (s *APIServer) handleAPILaserJob(w http.ResponseWriter, r *http.Request) error {
+	id, err := apiJobID(r)
+	if err != nil {
+		return err
+	}
+	job, err := s.startLaserJob(id, stamp(r))
+	switch {
+	case err == sql.ErrNoRows:
+		return apiErrorf(http.StatusNotFound, "job %d not found", id)
+	case errors.Is(err, ErrJobTransition), err == ErrLaserBusy:
+		return apiErrorf(http.StatusConflict, "%s", err)
+	case err == ErrLaserOff:
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	case err != nil:
+		return err
+	}
+	s.stream.publish("", StreamQueue)
+	return WriteJSON(w, http.StatusAccepted, newJobJSON(job))
+}
+
+func (s *APIServer) handleAPILaserStatus(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, newLaserStatusJSON(s.laser.Status()))
+}
+
+func (s *APIServer) handleAPILaserAbort(w http.ResponseWriter, r *http.Request) error {
+	if !s.laser.Abort() {
+		return apiErrorf(http.StatusConflict, "laser is not running")
+	}
+	return WriteJSON(w, http.StatusOK, newLaserStatusJSON(s.laser.Status()))
+}
+
+func (s *APIServer) handleAPIGetGrblSettings(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, s.grblSettings())
+}
+
+func (s *APIServer) handleAPISaveGrblSettings(w http.ResponseWriter, r *http.Request) error {
+	settings := defaultGrblSettings
+	if err := readJSON(r, &settings); err != nil {
+		return err
+	}
+	if err := settings.validate(); err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := s.saveGrblSettings(settings); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamQueue, StreamConfig, StreamLaser)
+	return WriteJSON(w, http.StatusOK, settings)
+}
+
+func (s *APIServer) handleAPISendToLightBurn(w http.ResponseWriter, r *http.Request) error {
+	a, err := s.apiAthlete(r)
+	if err != nil {
+		return err
+	}
+	path, err := s.sendToLightBurn(a)
+	switch {
+	case err == ErrLightBurnOff:
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	case errors.Is(err, ErrLightBurnTimeout):
+		return apiErrorf(http.StatusGatewayTimeout, "%s", err)
+	case errors.Is(err, ErrLightBurnRefused):
+		return apiErrorf(http.StatusBadGateway, "%s", err)
+	case err != nil:
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"file": path})
+}
+
+func (s *APIServer) handleAPIGetLightBurnBridge(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, s.lightburnBridge())
+}
+
+func (s *APIServer) handleAPISaveLightBurnBridge(w http.ResponseWriter, r *http.Request) error {
+	bridge := defaultLightBurnBridge
+	if err := readJSON(r, &bridge); err != nil {
+		return err
+	}
+	if err := bridge.validate(); err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := s.saveLightBurnBridge(bridge); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamConfig)
+	return WriteJSON(w, http.StatusOK, bridge)
+}
+
+func (s *APIServer) handleAPIGetTimePolicy(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, activeTimePolicy())
+}
+
+func (s *APIServer) handleAPISaveTimePolicy(w http.ResponseWriter, r *http.Request) error {
+	policy := defaultTimePolicy
+	if err := readJSON(r, &policy); err != nil {
+		return err
+	}
+	if err := policy.validate(); err != nil {
+		return apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := s.saveTimePolicy(policy); err != nil {
+		return err
+	}
+	s.stream.publish("", StreamQueue, StreamHistory, StreamConfig)
+	return WriteJSON(w, http.StatusOK, policy)
+}
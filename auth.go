@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrLogin         = errors.New("неверное имя или пароль")
+	ErrShortPassword = errors.New("пароль короче 8 символов")
+	ErrLastAdmin     = errors.New("должен остаться хотя бы один администратор")
+	ErrTooManyLogins = errors.New("слишком много неудачных попыток входа, попробуйте позже")
+)
+
+const (
+	sessionCookie = "session"
+	sessionTTL    = 24 * time.Hour
+	// csrfHeader carries the token of the session, the page sends it with
+	// every htmx request through hx-headers.
+	csrfHeader = "X-CSRF-Token"
+
+	minPasswordLen = 8
+
+	// maxLoginFailures failed logins within loginFailureWindow lock the
+	// user name out for the client until the oldest one is past the window.
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+)
+
+var roleTitles = map[Role]string{
+	RoleAdmin:    "администратор",
+	RoleOperator: "оператор",
+}
+
+func parseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleTitles[role]; !ok {
+		return "", fmt.Errorf("неизвестная роль %q", s)
+	}
+	return role, nil
+}
+
+func (r Role) Title() string {
+	return roleTitles[r]
+}
+
+// hashPassword hashes the password with bcrypt.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword compares the password with the stored bcrypt hash.
+func checkPassword(encoded string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+// loginLimiter counts the failed logins by client and user name, so a
+// password cannot be guessed through the login form or the API. Locked out
+// attempts are refused before bcrypt runs.
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{failures: map[string][]time.Time{}}
+}
+
+// recent drops the failures that are past the window.
+func (l *loginLimiter) recent(key string, now time.Time) []time.Time {
+	kept := l.failures[key][:0]
+	for _, t := range l.failures[key] {
+		if now.Sub(t) < loginFailureWindow {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = kept
+	return kept
+}
+
+func (l *loginLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.recent(key, now)) < maxLoginFailures
+}
+
+func (l *loginLimiter) fail(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for other := range l.failures {
+		l.recent(other, now)
+	}
+	l.failures[key] = append(l.failures[key], now)
+}
+
+func (l *loginLimiter) succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// clientHost is the address the request came from, without the port.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authenticate checks the password of the user logging in from the client.
+func (s *APIServer) authenticate(client string, username string, password string) (*User, error) {
+	key := client + "\x00" + username
+	if !s.logins.allow(key, time.Now()) {
+		return nil, ErrTooManyLogins
+	}
+	u, err := s.store.GetUser(username)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == sql.ErrNoRows || !checkPassword(u.PasswordHash, password) {
+		s.logins.fail(key, time.Now())
+		return nil, ErrLogin
+	}
+	s.logins.succeed(key)
+	return u, nil
+}
+
+func checkCredentials(username string, password string) error {
+	if username == "" {
+		return fmt.Errorf("укажите имя")
+	}
+	if len([]rune(password)) < minPasswordLen {
+		return ErrShortPassword
+	}
+	return nil
+}
+
+// saveUser checks the new user or password before storing it.
+func (s *APIServer) saveUser(username string, password string, role Role) error {
+	if err := checkCredentials(username, password); err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		if err := s.checkAdminLeft(username); err != nil {
+			return err
+		}
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.store.SaveUser(&User{Username: username, PasswordHash: hash, Role: role})
+}
+
+// checkAdminLeft refuses to take the last admin away.
+func (s *APIServer) checkAdminLeft(username string) error {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Role == RoleAdmin && u.Username != username {
+			return nil
+		}
+	}
+	for _, u := range users {
+		if u.Username == username {
+			return ErrLastAdmin
+		}
+	}
+	return nil
+}
+
+type contextKey string
+
+const (
+	userKey    contextKey = "user"
+	sessionKey contextKey = "session"
+)
+
+// currentUser is the user the middleware let the request through for.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey).(*User)
+	if u == nil {
+		return &User{}
+	}
+	return u
+}
+
+func currentSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionKey).(*Session)
+	if session == nil {
+		return &Session{}
+	}
+	return session
+}
+
+// stamp names the operator and the station of the request for the queue
+// and the history.
+func stamp(r *http.Request) Stamp {
+	return Stamp{Operator: currentUser(r).Username, Station: stationName(r)}
+}
+
+// publicPaths are served without a session.
+var publicPaths = map[string]bool{
+	"/login": true,
+	"/setup": true,
+}
+
+// requireSession lets requests of logged in browsers through. Changes must
+// carry the CSRF token of the session. The API has its own authentication,
+// see requireBasicAuth.
+func (s *APIServer) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var session *Session
+		var user *User
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			session, err = s.store.GetSession(c.Value)
+			if err == nil {
+				user, err = s.store.GetUser(session.Username)
+			}
+			if err != nil && err != sql.ErrNoRows {
+				fmt.Println("error", err)
+			}
+		}
+		if user == nil {
+			redirectToLogin(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			token := r.Header.Get(csrfHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRF)) != 1 {
+				http.Error(w, "invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), userKey, user)
+		ctx = context.WithValue(ctx, sessionKey, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("HX-Request") != "" {
+		w.Header().Set("HX-Redirect", "/login")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// admin lets only admins change the configuration. Operators search and
+// engrave.
+func (s *APIServer) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r).Role != RoleAdmin {
+			if r.Header.Get("HX-Request") != "" {
+				alertDangerResponse(w, "Нет доступа", "Это может сделать только администратор")
+				return
+			}
+			http.Error(w, "admin role required", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireBasicAuth checks the user and password of every /api/v1 request.
+// The description of the API stays public.
+func (s *APIServer) requireBasicAuth(next http.Handler) http.Handler {
+	return makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.Path == "/api/v1/openapi.json" {
+			next.ServeHTTP(w, r)
+			return nil
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="golaser"`)
+			return apiErrorf(http.StatusUnauthorized, "authentication required")
+		}
+		user, err := s.authenticate(clientHost(r), username, password)
+		if err == ErrLogin {
+			w.Header().Set("WWW-Authenticate", `Basic realm="golaser"`)
+			return apiErrorf(http.StatusUnauthorized, "invalid username or password")
+		}
+		if err == ErrTooManyLogins {
+			w.Header().Set("Retry-After", strconv.Itoa(int(loginFailureWindow.Seconds())))
+			return apiErrorf(http.StatusTooManyRequests, "too many failed logins, try again later")
+		}
+		if err != nil {
+			return err
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+		return nil
+	})
+}
+
+// apiAdmin is admin for the API handlers.
+func apiAdmin(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if currentUser(r).Role != RoleAdmin {
+			return apiErrorf(http.StatusForbidden, "admin role required")
+		}
+		return f(w, r)
+	}
+}
+
+func (s *APIServer) hasUsers() bool {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		fmt.Println("error", err)
+		return true
+	}
+	return len(users) > 0
+}
+
+// fromLocalhost tells whether the request comes from the server itself. The
+// first admin is only created there, anyone on the venue network could take
+// an empty server over otherwise.
+func fromLocalhost(r *http.Request) bool {
+	ip := net.ParseIP(clientHost(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *APIServer) renderLoginPage(w http.ResponseWriter, r *http.Request, errText string) {
+	templ := template.Must(template.ParseFS(res, "static/login.html"))
+	data := map[string]any{
+		"Setup":    !s.hasUsers(),
+		"Local":    fromLocalhost(r),
+		"Username": r.PostFormValue("username"),
+		"Station":  stationName(r),
+		"Error":    errText,
+	}
+	if err := templ.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleLoginPage(w http.ResponseWriter, r *http.Request) {
+	s.renderLoginPage(w, r, "")
+}
+
+// HandleLogin starts a session and remembers the station of the browser.
+func (s *APIServer) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	user, err := s.authenticate(clientHost(r), username, r.PostFormValue("password"))
+	if err != nil {
+		s.renderLoginPage(w, r, err.Error())
+		return
+	}
+	s.startSession(w, r, user)
+}
+
+// HandleSetup creates the first admin, there is nobody to log in as yet.
+// It is only done from the server itself, and only once: the check for
+// other users and the insert are one step in the store.
+func (s *APIServer) HandleSetup(w http.ResponseWriter, r *http.Request) {
+	if !fromLocalhost(r) {
+		w.WriteHeader(http.StatusForbidden)
+		s.renderLoginPage(w, r, "Администратора можно создать только на компьютере сервера")
+		return
+	}
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	password := r.PostFormValue("password")
+	if err := checkCredentials(username, password); err != nil {
+		s.renderLoginPage(w, r, err.Error())
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		s.renderLoginPage(w, r, err.Error())
+		return
+	}
+	created, err := s.store.CreateFirstUser(&User{Username: username, PasswordHash: hash, Role: RoleAdmin})
+	if err != nil {
+		s.renderLoginPage(w, r, fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	if !created {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	user, err := s.store.GetUser(username)
+	if err != nil {
+		s.renderLoginPage(w, r, fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.startSession(w, r, user)
+}
+
+func (s *APIServer) startSession(w http.ResponseWriter, r *http.Request, user *User) {
+	session := &Session{
+		Token:     newToken(),
+		Username:  user.Username,
+		CSRF:      newToken(),
+		ExpiresAt: time.Now().Add(sessionTTL),
+	}
+	if err := s.store.CreateSession(session); err != nil {
+		s.renderLoginPage(w, r, fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if station := strings.TrimSpace(r.PostFormValue("station")); station != "" {
+		setStationCookie(w, station)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *APIServer) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.DeleteSession(currentSession(r).Token); err != nil {
+		fmt.Println("error", err)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.Header().Set("HX-Redirect", "/login")
+}
+
+var usersTmpl = template.Must(template.New("users").Parse(`
+	<table class="table table-sm small">
+		<thead><tr><th>Имя</th><th>Роль</th><th></th></tr></thead>
+		<tbody>
+		{{ range .Users }}
+		<tr>
+			<td>{{ .Username }}</td>
+			<td>{{ .Role.Title }}</td>
+			<td class="text-end">
+				{{ if ne .Username $.Current }}
+				<button type="button" class="btn btn-sm btn-outline-danger" hx-delete="/users/{{ .Username }}"
+					hx-confirm="Удалить {{ .Username }}?" hx-target="#users" hx-swap="innerHTML">Удалить</button>
+				{{ end }}
+			</td>
+		</tr>
+		{{ end }}
+		</tbody>
+	</table>
+	<form hx-post="/users" hx-target="#users" hx-swap="innerHTML">
+		<div class="input-group mb-2">
+			<input type="text" class="form-control" name="username" placeholder="Имя" aria-label="Имя" required>
+			<input type="password" class="form-control" name="password" placeholder="Пароль" aria-label="Пароль" autocomplete="new-password" required>
+			<select class="form-select" name="role" aria-label="Роль">
+				<option value="operator">оператор</option>
+				<option value="admin">администратор</option>
+			</select>
+			<button type="submit" class="btn btn-primary">Сохранить</button>
+		</div>
+		<div class="form-text">Для существующего имени меняются пароль и роль.</div>
+		{{ if .Message }}<span class="text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+`))
+
+func (s *APIServer) renderUsers(w http.ResponseWriter, r *http.Request, message string, errText string) {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	data := map[string]any{
+		"Users":   users,
+		"Current": currentUser(r).Username,
+		"Message": message,
+		"Error":   errText,
+	}
+	if err := usersTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	s.renderUsers(w, r, "", "")
+}
+
+func (s *APIServer) HandleSaveUser(w http.ResponseWriter, r *http.Request) {
+	role, err := parseRole(r.PostFormValue("role"))
+	if err != nil {
+		s.renderUsers(w, r, "", err.Error())
+		return
+	}
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	if err := s.saveUser(username, r.PostFormValue("password"), role); err != nil {
+		s.renderUsers(w, r, "", err.Error())
+		return
+	}
+	// the new password logs the user out of the other browsers, an admin
+	// changing their own stays logged in here
+	keep := ""
+	if username == currentUser(r).Username {
+		keep = currentSession(r).Token
+	}
+	if err := s.store.DeleteUserSessions(username, keep); err != nil {
+		s.renderUsers(w, r, "", err.Error())
+		return
+	}
+	s.renderUsers(w, r, fmt.Sprintf("Пользователь %s сохранён", username), "")
+}
+
+func (s *APIServer) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["name"]
+	if username == currentUser(r).Username {
+		s.renderUsers(w, r, "", "Нельзя удалить себя")
+		return
+	}
+	if err := s.checkAdminLeft(username); err != nil {
+		s.renderUsers(w, r, "", err.Error())
+		return
+	}
+	if err := s.store.DeleteUser(username); err != nil {
+		s.renderUsers(w, r, "", err.Error())
+		return
+	}
+	s.renderUsers(w, r, fmt.Sprintf("Пользователь %s удалён", username), "")
+}
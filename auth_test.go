@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Now()
+	for i := 0; i < maxLoginFailures; i++ {
+		if !l.allow("a", now) {
+			t.Fatalf("refused after %d failures", i)
+		}
+		l.fail("a", now)
+	}
+	if l.allow("a", now) {
+		t.Error("allowed after the last failure")
+	}
+	if !l.allow("b", now) {
+		t.Error("another key is refused")
+	}
+	if !l.allow("a", now.Add(loginFailureWindow)) {
+		t.Error("refused once the window has passed")
+	}
+	if _, ok := l.failures["a"]; ok {
+		t.Error("expired failures are kept")
+	}
+
+	l.fail("c", now)
+	l.succeed("c")
+	if _, ok := l.failures["c"]; ok {
+		t.Error("failures are kept after a login")
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "admin", RoleAdmin)
+
+	for i := 0; i < maxLoginFailures; i++ {
+		if _, err := s.authenticate("192.0.2.1", "admin", "wrong"); err != ErrLogin {
+			t.Fatalf("attempt %d: %v, want %v", i+1, err, ErrLogin)
+		}
+	}
+	if _, err := s.authenticate("192.0.2.1", "admin", "password1"); err != ErrTooManyLogins {
+		t.Fatalf("right password while locked out: %v, want %v", err, ErrTooManyLogins)
+	}
+	if _, err := s.authenticate("192.0.2.2", "admin", "password1"); err != nil {
+		t.Fatalf("another client: %v", err)
+	}
+
+	// unknown names count as well
+	for i := 0; i < maxLoginFailures; i++ {
+		s.authenticate("192.0.2.3", "nobody", "wrong")
+	}
+	if _, err := s.authenticate("192.0.2.3", "nobody", "wrong"); err != ErrTooManyLogins {
+		t.Fatalf("unknown user: %v, want %v", err, ErrTooManyLogins)
+	}
+
+	// the API answers with 429
+	router := s.routes()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/events", nil)
+	r.SetBasicAuth("admin", "password1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("API while locked out: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "op", RoleOperator)
+	session := testSession(t, store, "op")
+	router := s.routes()
+	form := url.Values{"station": {"2"}}
+
+	tests := []struct {
+		name    string
+		method  string
+		session *Session
+		csrf    string
+		want    int
+	}{
+		{"change without token", http.MethodPost, session, "", http.StatusForbidden},
+		{"change with a wrong token", http.MethodPost, session, "x" + session.CSRF, http.StatusForbidden},
+		{"change with the token", http.MethodPost, session, session.CSRF, http.StatusOK},
+		{"read without token", http.MethodGet, session, "", http.StatusOK},
+		{"change without session", http.MethodPost, nil, session.CSRF, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/station"
+			if tt.method == http.MethodGet {
+				target = "/laser/status"
+			}
+			if w := serve(router, tt.method, target, form, tt.session, tt.csrf); w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, target, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleGating(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "admin", RoleAdmin)
+	addTestUser(t, store, "op", RoleOperator)
+	router := s.routes()
+
+	admin, op := testSession(t, store, "admin"), testSession(t, store, "op")
+	if w := serve(router, http.MethodGet, "/users", nil, admin, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "op") {
+		t.Errorf("admin: %d %s", w.Code, w.Body)
+	}
+	if w := serve(router, http.MethodGet, "/users", nil, op, ""); w.Code != http.StatusForbidden {
+		t.Errorf("operator: %d, want %d", w.Code, http.StatusForbidden)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: op.Token})
+	r.Header.Set("HX-Request", "true")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "Нет доступа") {
+		t.Errorf("operator from the page: %s", w.Body)
+	}
+	// the operator still engraves
+	if w := serve(router, http.MethodGet, "/queue", nil, op, ""); w.Code != http.StatusOK {
+		t.Errorf("operator queue: %d", w.Code)
+	}
+
+	tests := []struct {
+		username string
+		want     int
+	}{
+		{"admin", http.StatusOK},
+		{"op", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/settings/time", strings.NewReader(`{"rounding": "floor", "format": "h:mm:ss", "source": "chip"}`))
+		r.SetBasicAuth(tt.username, "password1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("API settings as %s: %d, want %d: %s", tt.username, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	s, store := newTestServer(t)
+	router := s.routes()
+	setup := func(remote string, username string, password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/setup", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	users := func() []*User {
+		users, err := store.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return users
+	}
+
+	if w := setup("192.0.2.1:5000", "admin", "password1"); w.Code != http.StatusForbidden || len(users()) != 0 {
+		t.Fatalf("from the network: %d, %d users", w.Code, len(users()))
+	}
+	if w := setup("127.0.0.1:5000", "admin", "short"); !strings.Contains(w.Body.String(), ErrShortPassword.Error()) || len(users()) != 0 {
+		t.Fatalf("short password: %d users: %s", len(users()), w.Body)
+	}
+
+	w := setup("127.0.0.1:5000", "admin", "password1")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("setup: %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 || cookies[0].Name != sessionCookie {
+		t.Fatalf("setup did not log in: %v", cookies)
+	}
+	if u := users(); len(u) != 1 || u[0].Username != "admin" || u[0].Role != RoleAdmin {
+		t.Fatalf("users after setup: %v", u)
+	}
+
+	w = setup("[::1]:5000", "intruder", "password2")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" || len(users()) != 1 {
+		t.Errorf("second setup: %d to %q, %d users", w.Code, w.Header().Get("Location"), len(users()))
+	}
+}
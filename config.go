@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is how the server is started. Every setting is read from, in this
+// order of precedence: a command line flag, a GOLASER_* environment variable,
+// the config file and the default.
+type Config struct {
+	// Backend is "sqlite" or "postgres".
+	Backend string
+	// DSN is the SQLite file, optionally with driver parameters, or the
+	// PostgreSQL connection string. An empty PostgreSQL DSN uses the PG*
+	// environment variables.
+	DSN    string
+	Listen string
+	// ScrapeInterval starts the auto update at startup when positive.
+	ScrapeInterval time.Duration
+	// PageSize is the number of results fetched per request from sources
+	// that page, such as ChronoTrack.
+	PageSize int
+	// TimePolicy is used until one is saved in the settings.
+	TimePolicy TimePolicy
+}
+
+// configSetting is one setting with its flag name. The environment variable
+// is GOLASER_ and the name in upper case with "-" as "_", the config file key
+// is the name with "-" as "_".
+type configSetting struct {
+	name  string
+	value string
+	usage string
+}
+
+var configSettings = []configSetting{
+	{"backend", "sqlite", "storage backend, sqlite or postgres"},
+	{"dsn", "", "SQLite file or PostgreSQL connection string (default laser.db for sqlite)"},
+	{"listen", ":3000", "address the web server listens on"},
+	{"scrape-interval", "0", "auto update interval, e.g. 5m, a plain number is minutes, 0 is off"},
+	{"page-size", "1000", "results per request to the result source"},
+	{"time-rounding", defaultTimePolicy.Rounding, "rounding of the fractions of a second"},
+	{"time-format", defaultTimePolicy.Format, "time format on the plaque"},
+	{"time-source", defaultTimePolicy.Source, "official time, chip or gun"},
+}
+
+const (
+	configEnvPrefix = "GOLASER_"
+	// configFileEnv names the config file, like the -config flag.
+	configFileEnv = configEnvPrefix + "CONFIG"
+)
+
+// defaultConfigFiles are read when no config file is given.
+var defaultConfigFiles = []string{"golaser.toml", "golaser.yaml", "golaser.yml"}
+
+func envName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func fileKey(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// loadConfig reads the configuration for the server started with args.
+func loadConfig(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("golaser", flag.ContinueOnError)
+	configFile := flags.String("config", "", "TOML or YAML config file, also "+configFileEnv)
+	flagValues := map[string]*string{}
+	for _, setting := range configSettings {
+		flagValues[setting.name] = flags.String(setting.name, setting.value,
+			fmt.Sprintf("%s (%s)", setting.usage, envName(setting.name)))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for _, setting := range configSettings {
+		values[setting.name] = setting.value
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(configFileEnv)
+	}
+	if path == "" {
+		for _, name := range defaultConfigFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+	}
+	if path != "" {
+		fileValues, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileValues {
+			values[key] = value
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(envName(setting.name)); ok {
+			values[setting.name] = value
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if v, ok := flagValues[f.Name]; ok {
+			values[f.Name] = *v
+		}
+	})
+	return parseConfig(values)
+}
+
+// readConfigFile reads flat "key = value" (TOML) or "key: value" (YAML)
+// lines. Values may be quoted, # starts a comment.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	known := map[string]string{}
+	for _, setting := range configSettings {
+		known[fileKey(setting.name)] = setting.name
+	}
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key := strings.TrimSpace(line[:sep])
+		name, ok := known[key]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, n, key)
+		}
+		value := strings.TrimSpace(line[sep+1:])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// stripComment cuts a # comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfig(values map[string]string) (*Config, error) {
+	c := &Config{
+		Backend: values["backend"],
+		DSN:     values["dsn"],
+		Listen:  values["listen"],
+		TimePolicy: TimePolicy{
+			Rounding: values["time-rounding"],
+			Format:   values["time-format"],
+			Source:   values["time-source"],
+		},
+	}
+	switch c.Backend {
+	case "sqlite":
+		if c.DSN == "" {
+			c.DSN = "laser.db"
+		}
+	case "postgres":
+	default:
+		return nil, fmt.Errorf("backend must be sqlite or postgres, not %q", c.Backend)
+	}
+	if c.Listen == "" {
+		return nil, fmt.Errorf("listen address is empty")
+	}
+
+	interval := values["scrape-interval"]
+	if minutes, err := strconv.Atoi(interval); err == nil {
+		c.ScrapeInterval = time.Duration(minutes) * time.Minute
+	} else if c.ScrapeInterval, err = time.ParseDuration(interval); err != nil {
+		return nil, fmt.Errorf("invalid scrape interval %q", interval)
+	}
+	if c.ScrapeInterval < 0 {
+		return nil, fmt.Errorf("scrape interval must not be negative")
+	}
+
+	pageSize, err := strconv.Atoi(values["page-size"])
+	if err != nil || pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be a positive number, not %q", values["page-size"])
+	}
+	c.PageSize = pageSize
+
+	if err := c.TimePolicy.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// openStore connects to the configured backend.
+func (c *Config) openStore() (Storage, error) {
+	if c.Backend == "postgres" {
+		return NewPostgresStore(c.DSN)
+	}
+	return NewSqliteStore(c.DSN)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "toml",
+			file: "golaser.toml",
+			content: `# golaser
+backend = "postgres"
+dsn = 'host=db user=laser'
+listen = ":8080"  # behind the proxy
+scrape_interval = 5m
+`,
+			want: map[string]string{"backend": "postgres", "dsn": "host=db user=laser", "listen": ":8080", "scrape-interval": "5m"},
+		},
+		{
+			name: "yaml",
+			file: "golaser.yaml",
+			content: `---
+page_size: 500
+time_rounding: "tenths"
+time_source: gun
+`,
+			want: map[string]string{"page-size": "500", "time-rounding": "tenths", "time-source": "gun"},
+		},
+		{
+			name:    "hash inside quotes",
+			file:    "golaser.toml",
+			content: `dsn = "file:laser#1.db" # comment`,
+			want:    map[string]string{"dsn": "file:laser#1.db"},
+		},
+		{
+			name:    "empty",
+			file:    "golaser.toml",
+			content: "\n# nothing yet\n",
+			want:    map[string]string{},
+		},
+		{
+			name:    "unknown setting",
+			file:    "golaser.toml",
+			content: "backend = sqlite\nport = 3000\n",
+			wantErr: `golaser.toml:2: unknown setting "port"`,
+		},
+		{
+			name:    "flag name instead of key",
+			file:    "golaser.toml",
+			content: "page-size = 10\n",
+			wantErr: `golaser.toml:1: unknown setting "page-size"`,
+		},
+		{
+			name:    "no separator",
+			file:    "golaser.yaml",
+			content: "listen\n",
+			wantErr: "golaser.yaml:1: expected key = value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readConfigFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+					t.Fatalf("readConfigFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readConfigFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readConfigFile(filepath.Join(t.TempDir(), "missing.toml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: error = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// The source configurations are stored with their credentials encrypted by
+// a key that never goes into the database. It is a base64 encoded 32 byte
+// AES key in GOLASER_SECRET_KEY, or in the file GOLASER_SECRET_KEY_FILE
+// points to. Without either the key is kept in defaultKeyFile, which is
+// created on the first start.
+const (
+	secretKeyEnv     = "GOLASER_SECRET_KEY"
+	secretKeyFileEnv = "GOLASER_SECRET_KEY_FILE"
+	defaultKeyFile   = "golaser.key"
+
+	sealedPrefix = "v1:"
+)
+
+var ErrSecretKey = errors.New("конфигурация зашифрована другим ключом или для другого соревнования")
+
+// secretBox encrypts with AES-256-GCM.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func loadSecretBox() (*secretBox, error) {
+	encoded := os.Getenv(secretKeyEnv)
+	if encoded == "" {
+		path := os.Getenv(secretKeyFileEnv)
+		if path == "" {
+			path = defaultKeyFile
+		}
+		b, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && os.Getenv(secretKeyFileEnv) == "":
+			if b, err = createKeyFile(path); err != nil {
+				return nil, err
+			}
+		case err != nil:
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secret key must be 32 bytes in base64")
+	}
+	return newSecretBox(key)
+}
+
+func createKeyFile(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	b := []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("created secret key file %s, keep it together with the database\n", path)
+	return b, nil
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+// seal returns "v1:" and the nonce with the ciphertext in base64. The
+// event ID is authenticated with it, the configuration of one event does
+// not open as another's.
+func (b *secretBox) seal(plain []byte, eventID string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, plain, []byte(eventID))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (b *secretBox) open(sealed string, eventID string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil || !strings.HasPrefix(sealed, sealedPrefix) || len(data) < b.aead.NonceSize() {
+		return nil, fmt.Errorf("повреждённая конфигурация")
+	}
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, ciphertext, []byte(eventID))
+	if err != nil {
+		return nil, ErrSecretKey
+	}
+	return plain, nil
+}
+
+// saveSourceConfig stores the configuration of the event source encrypted.
+func (s *APIServer) saveSourceConfig(config SourceConfig) error {
+	plain, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.secrets.seal(plain, config.EventID)
+	if err != nil {
+		return err
+	}
+	return s.store.SaveSourceConfig(config.EventID, sealed)
+}
+
+// sourceConfig returns the stored configuration of the event source, ok is
+// false when there is none.
+func (s *APIServer) sourceConfig(eventID string) (config SourceConfig, ok bool, err error) {
+	sealed, err := s.store.GetSourceConfig(eventID)
+	if err != nil || sealed == "" {
+		return config, false, err
+	}
+	plain, err := s.secrets.open(sealed, eventID)
+	if err != nil {
+		return config, false, err
+	}
+	if err := json.Unmarshal(plain, &config); err != nil {
+		return config, false, err
+	}
+	return config, true, nil
+}
+
+// keepPassword fills in the stored password when the form leaves it empty,
+// the browser is never sent the password to send it back.
+func (s *APIServer) keepPassword(config *SourceConfig) error {
+	if config.Password != "" || config.EventID == "" {
+		return nil
+	}
+	stored, ok, err := s.sourceConfig(config.EventID)
+	if err != nil || !ok {
+		return err
+	}
+	if stored.Type == config.Type || (config.Type == "" && stored.Type == sourceTypes[0].Name) {
+		config.Password = stored.Password
+	}
+	return nil
+}
+
+// restoreSources connects the stored sources of the events again after a
+// start. Nothing is fetched, the next update tells whether they still work.
+func (s *APIServer) restoreSources() {
+	events, err := s.store.GetEvents()
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	for _, e := range events {
+		config, ok, err := s.sourceConfig(e.EventID)
+		if err != nil {
+			log.Printf("source of event %s not restored: %s\n", e.EventID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		source, err := NewResultSource(config)
+		if err != nil {
+			log.Printf("source of event %s not restored: %s\n", e.EventID, err)
+			continue
+		}
+		s.scraper.SetSource(e.EventID, source)
+	}
+}
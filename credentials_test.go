@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := newSecretBox([]byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"login": "timer", "password": "secret"}`)
+	sealed, err := box.seal(plain, "ev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, sealedPrefix) || strings.Contains(sealed, "secret") {
+		t.Fatalf("sealed = %q", sealed)
+	}
+	again, _ := box.seal(plain, "ev1")
+	if again == sealed {
+		t.Error("two seals are equal, the nonce is reused")
+	}
+	got, err := box.open(sealed, "ev1")
+	if err != nil || string(got) != string(plain) {
+		t.Fatalf("open = %q, %v", got, err)
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	data[len(data)-1] ^= 1
+	tampered := sealedPrefix + base64.StdEncoding.EncodeToString(data)
+	otherBox, _ := newSecretBox([]byte(strings.Repeat("x", 32)))
+
+	tests := []struct {
+		name    string
+		box     *secretBox
+		sealed  string
+		eventID string
+		wantKey bool
+	}{
+		{"tampered", box, tampered, "ev1", true},
+		{"another event", box, sealed, "ev2", true},
+		{"another key", otherBox, sealed, "ev1", true},
+		{"no prefix", box, strings.TrimPrefix(sealed, sealedPrefix), "ev1", false},
+		{"not base64", box, sealedPrefix + "!!", "ev1", false},
+		{"too short", box, sealedPrefix + "AAAA", "ev1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.box.open(tt.sealed, tt.eventID)
+			if err == nil {
+				t.Fatalf("opened as %q", got)
+			}
+			if errors.Is(err, ErrSecretKey) != tt.wantKey {
+				t.Errorf("error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSourceConfigBoundToEvent(t *testing.T) {
+	s, store := newTestServer(t)
+	for _, id := range []string{"ev1", "ev2"} {
+		if err := store.SaveEvent(&Event{EventID: id, EventName: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := SourceConfig{Type: "chronotrack", EventID: "ev1", Login: "timer", Password: "secret", ClientID: "c"}
+	if err := s.saveSourceConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := s.sourceConfig("ev1")
+	if err != nil || !ok || got != config {
+		t.Fatalf("sourceConfig(ev1) = %+v, %v, %v", got, ok, err)
+	}
+
+	// the row copied into another event does not open
+	sealed, err := store.GetSourceConfig("ev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveSourceConfig("ev2", sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.sourceConfig("ev2"); !errors.Is(err, ErrSecretKey) {
+		t.Errorf("copied config: %v, want %v", err, ErrSecretKey)
+	}
+}
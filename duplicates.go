@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrReprintConfirm = errors.New("участник уже выгравирован, подтвердите повторную гравировку")
+
+// stationCookie keeps the name of the station a browser works at, it is
+// stamped on the plaques engraved from there. Clients of the API send
+// stationHeader instead.
+const (
+	stationCookie = "station"
+	stationHeader = "X-Golaser-Station"
+)
+
+func stationName(r *http.Request) string {
+	if c, err := r.Cookie(stationCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return strings.TrimSpace(r.Header.Get(stationHeader))
+}
+
+// setStationCookie remembers the station name of the browser for a year.
+func setStationCookie(w http.ResponseWriter, station string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stationCookie,
+		Value:    station,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *APIServer) HandleSetStation(w http.ResponseWriter, r *http.Request) {
+	setStationCookie(w, strings.TrimSpace(r.PostFormValue("station")))
+}
+
+// checkReprint refuses a new job for an athlete that has been engraved
+// already, unless the operator confirmed it is meant.
+func (s *APIServer) checkReprint(a *Athlete, confirmed bool) error {
+	if confirmed {
+		return nil
+	}
+	engravings, err := s.store.GetEngravings(a.EventID, a.ResultsBib)
+	if err != nil {
+		return err
+	}
+	if len(engravings) > 0 {
+		return ErrReprintConfirm
+	}
+	return nil
+}
+
+// engravedAt is the local time of an engraving, with the date when it was
+// not today.
+func engravedAt(t time.Time) string {
+	t = t.Local()
+	now := time.Now()
+	if t.YearDay() == now.YearDay() && t.Year() == now.Year() {
+		return t.Format("15:04")
+	}
+	return t.Format("02.01.2006 15:04")
+}
+
+// Place is when, where and by whom the plaque was engraved, for the history
+// table.
+func (e *HistoryEntry) Place() string {
+	parts := []string{engravedAt(e.CreatedAt)}
+	if e.Station != "" {
+		parts = append(parts, "станция "+e.Station)
+	}
+	if e.Operator != "" {
+		parts = append(parts, e.Operator)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// engravedNote warns under the search result that the plaque has been
+// engraved before, so it is not done twice by mistake.
+func (s *APIServer) engravedNote(a *Athlete) string {
+	engravings, err := s.store.GetEngravings(a.EventID, a.ResultsBib)
+	if err != nil {
+		fmt.Println("error", err)
+		return ""
+	}
+	if len(engravings) == 0 {
+		return ""
+	}
+	last := engravings[0]
+	text := fmt.Sprintf("Уже выгравирован в %s", engravedAt(last.CreatedAt))
+	if last.Station != "" {
+		text += fmt.Sprintf(" на станции %s", html.EscapeString(last.Station))
+	}
+	if last.Operator != "" {
+		text += fmt.Sprintf(" (%s)", html.EscapeString(last.Operator))
+	}
+	if len(engravings) > 1 {
+		text += fmt.Sprintf(", табличек: %d", len(engravings))
+	}
+	return fmt.Sprintf(`<div class='list-group-item list-group-item-warning fw-bold'>%s</div>`, text)
+}
+
+// HandleHistorySummary shows how many plaques of the active event were
+// engraved and how many of them again, for the material accounting.
+func (s *APIServer) HandleHistorySummary(w http.ResponseWriter, r *http.Request) {
+	eventID := s.activeEventID()
+	entries, err := s.store.GetHistoryRecords(eventID, "")
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	fmt.Fprintf(w, "Табличек: %d", len(entries))
+	if reprints := s.store.GetReprintCount(eventID); reprints > 0 {
+		fmt.Fprintf(w, `, из них повторно: <strong>%d</strong>`, reprints)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultEngravingTemplate gives the text the station always used.
+const DefaultEngravingTemplate = `{{ .FirstName }} {{ .LastName }} {{ .Time }}`
+
+// engravingData is what an engraving template sees.
+type engravingData struct {
+	Bib       string
+	FirstName string
+	LastName  string
+	// Time is the chip or the gun time, as the race is set up.
+	Time     string
+	ChipTime string
+	GunTime  string
+	Race     string
+	Sex      string
+	Category string
+	Event    string
+	Age      string
+	// Places overall, within the sex and within the category of the race.
+	Place         string
+	SexPlace      string
+	CategoryPlace string
+	// Status is DNF, DNS, DSQ or UNOFFICIAL, empty for an official finish.
+	Status string
+	// Distance in km parsed from the race name, 0 when it has none.
+	Distance float64
+	// Splits in course order, see Split for one by name.
+	Splits []Split
+}
+
+// Split returns the time at the interval, "" when the athlete has none.
+func (d engravingData) Split(name string) string {
+	for _, split := range d.Splits {
+		if strings.EqualFold(split.Name, name) {
+			return split.Time
+		}
+	}
+	return ""
+}
+
+func newEngravingData(a *Athlete) engravingData {
+	return engravingData{
+		Bib:           a.ResultsBib,
+		FirstName:     a.ResultsFirstName,
+		LastName:      a.ResultsLastName,
+		Time:          a.OfficialTime(),
+		ChipTime:      a.ResultsTime,
+		GunTime:       a.ResultsGunTime,
+		Race:          a.ResultsRaceName,
+		Sex:           a.ResultsSex,
+		Category:      a.ResultsCategory,
+		Event:         a.EventName,
+		Age:           a.ResultsAge,
+		Place:         a.ResultsRank,
+		SexPlace:      a.ResultsSexRank,
+		CategoryPlace: a.ResultsCategoryRank,
+		Status:        a.ResultsStatus,
+		Distance:      raceDistance(a.ResultsRaceName),
+		Splits:        a.Splits,
+	}
+}
+
+// sampleAthlete is used for the template preview when no bib is given.
+var sampleAthlete = &Athlete{
+	EventName:           "Осенний марафон",
+	ResultsBib:          "1024",
+	ResultsFirstName:    "Алёна",
+	ResultsLastName:     "Щербакова",
+	ResultsTime:         "03:41:07",
+	ResultsGunTime:      "03:42:15",
+	ResultsRaceName:     "42.2 км",
+	ResultsSex:          "F",
+	ResultsCategory:     "F35-39",
+	ResultsAge:          "37",
+	ResultsRank:         "112",
+	ResultsSexRank:      "14",
+	ResultsCategoryRank: "3",
+	Splits: []Split{
+		{Name: "Swim", Time: "00:31:12", Order: 1},
+		{Name: "Bike", Time: "01:52:40", Order: 2},
+		{Name: "Run", Time: "01:17:15", Order: 3},
+	},
+}
+
+var engravingFuncs = template.FuncMap{
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"title":    titleCase,
+	"translit": transliterate,
+	"truncate": truncate,
+	"pad":      padRight,
+	"padleft":  padLeft,
+	"center":   padCenter,
+	"pace":     pace,
+}
+
+// parseEngravingTemplate checks the template body. Unknown fields only show
+// up when the template runs, so it is tried on a sample athlete too.
+func parseEngravingTemplate(body string) (*template.Template, error) {
+	t, err := template.New("engraving").Funcs(engravingFuncs).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, newEngravingData(sampleAthlete)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func renderEngraving(body string, a *Athlete) (string, error) {
+	t, err := parseEngravingTemplate(body)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, newEngravingData(a)); err != nil {
+		return "", err
+	}
+	// spaces are kept, they may be padding
+	return strings.Trim(b.String(), "\r\n"), nil
+}
+
+// pickTemplate returns the body for the race: the race's own template, then
+// the template for all races of the event, then the default.
+func pickTemplate(templates []*EngravingTemplate, raceName string) string {
+	body := DefaultEngravingTemplate
+	for _, t := range templates {
+		if t.RaceName == raceName && raceName != "" {
+			return t.Body
+		}
+		if t.RaceName == "" {
+			body = t.Body
+		}
+	}
+	return body
+}
+
+// engravingText renders the text to engrave for the athlete. When the
+// template of the event is broken the default one is used and the error is
+// returned next to the text.
+func (s *APIServer) engravingText(a *Athlete) (string, error) {
+	s.loadSplits(a)
+	templates, err := s.store.GetTemplates(a.EventID)
+	if err != nil {
+		return "", err
+	}
+	text, err := renderEngraving(pickTemplate(templates, a.ResultsRaceName), a)
+	if err != nil {
+		fallback, _ := renderEngraving(DefaultEngravingTemplate, a)
+		return fallback, err
+	}
+	return text, nil
+}
+
+var cyrillicTranslit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "ie",
+	'ы': "y", 'ь': "", 'э': "e", 'ю': "iu", 'я': "ia",
+}
+
+// transliterate writes Russian letters in Latin the way foreign passports
+// do. A capital letter stays capital, in an all caps word the whole
+// replacement is capital.
+func transliterate(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		latin, ok := cyrillicTranslit[unicode.ToLower(r)]
+		if !ok {
+			b.WriteRune(r)
+			continue
+		}
+		if !unicode.IsUpper(r) || latin == "" {
+			b.WriteString(latin)
+			continue
+		}
+		nextUpper := i+1 < len(runes) && unicode.IsUpper(runes[i+1])
+		prevUpper := i > 0 && unicode.IsUpper(runes[i-1])
+		if nextUpper || prevUpper {
+			b.WriteString(strings.ToUpper(latin))
+		} else {
+			b.WriteString(strings.ToUpper(latin[:1]) + latin[1:])
+		}
+	}
+	return b.String()
+}
+
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		r, size := utf8.DecodeRuneInString(w)
+		words[i] = string(unicode.ToUpper(r)) + strings.ToLower(w[size:])
+	}
+	return strings.Join(words, " ")
+}
+
+// truncate cuts s to n letters.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+func padRight(n int, s string) string {
+	if fill := n - utf8.RuneCountInString(s); fill > 0 {
+		return s + strings.Repeat(" ", fill)
+	}
+	return s
+}
+
+func padLeft(n int, s string) string {
+	if fill := n - utf8.RuneCountInString(s); fill > 0 {
+		return strings.Repeat(" ", fill) + s
+	}
+	return s
+}
+
+func padCenter(n int, s string) string {
+	fill := n - utf8.RuneCountInString(s)
+	if fill <= 0 {
+		return s
+	}
+	return strings.Repeat(" ", fill/2) + s + strings.Repeat(" ", fill-fill/2)
+}
+
+// pace returns the time per km as M:SS, or "" when the distance or the time
+// is unknown.
+func pace(distanceKm float64, finishTime string) string {
+	d, err := parseDuration(finishTime)
+	if err != nil || distanceKm <= 0 {
+		return ""
+	}
+	perKm := time.Duration(float64(d) / distanceKm).Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(perKm.Minutes()), int(perKm.Seconds())%60)
+}
+
+var distancePattern = regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*(?:km|k|км|к)(?:[^a-zа-я]|$)`)
+
+// raceDistance guesses the distance in km from a race name like "10K",
+// "21.1 км" or "Half marathon".
+func raceDistance(raceName string) float64 {
+	lower := strings.ToLower(raceName)
+	if m := distancePattern.FindStringSubmatch(lower); m != nil {
+		if km, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64); err == nil {
+			return km
+		}
+	}
+	switch {
+	case strings.Contains(lower, "half") || strings.Contains(lower, "полумарафон"):
+		return 21.0975
+	case strings.Contains(lower, "marathon") || strings.Contains(lower, "марафон"):
+		return 42.195
+	}
+	return 0
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var configFormTmpl = template.Must(template.New("config").Parse(`
+	<form hx-post="/config" hx-target="#notification" hx-swap="innerHTML">
+		{{ if .Editing }}<p class="small">Настройки соревнования <strong>{{ .Config.EventID }}</strong></p>{{ end }}
+		<div class="input-group mb-3">
+			<span class="input-group-text">Источник</span>
+			<select class="form-select" name="source" aria-label="Источник результатов">
+				{{ range .SourceTypes }}
+				<option value="{{ .Name }}" {{ if eq .Name $.Config.Type }}selected{{ end }}>{{ .Title }}</option>
+				{{ end }}
+			</select>
+		</div>
+		<div class="input-group mb-3">
+			<input type="text" class="form-control" name="login" value="{{ .Config.Login }}" placeholder="Login" aria-label="Login" autocomplete="off">
+			<span class="input-group-text">:</span>
+			<input type="password" class="form-control" name="password" placeholder="{{ if .HasPassword }}Пароль сохранён{{ else }}Password{{ end }}" aria-label="Password" autocomplete="new-password">
+		</div>
+		<div class="input-group mb-3">
+			<input type="text" class="form-control" name="clientID" value="{{ .Config.ClientID }}" placeholder="ClientID" aria-label="ClientID">
+			<span class="input-group-text"></span>
+			<input type="text" class="form-control" name="eventID" value="{{ .Config.EventID }}" placeholder="EventID" aria-label="EventID" required>
+		</div>
+		<div class="input-group mb-3">
+			<input type="url" class="form-control" name="url" value="{{ .Config.URL }}" placeholder="Ссылка на файл результатов (для выгрузки)" aria-label="URL">
+		</div>
+		<div class="input-group mb-3">
+			<input type="text" class="form-control" name="eventName" value="{{ .Config.EventName }}" placeholder="Название (необязательно)" aria-label="Название">
+		</div>
+		<div class="form-check">
+			<input class="form-check-input" type="checkbox" name="activate" value="1" id="activate-event" {{ if not .Editing }}checked{{ end }}>
+			<label class="form-check-label" for="activate-event">Сделать активным</label>
+		</div>
+		<div class="form-text mb-2">Настройки хранятся в базе, логин и пароль — в зашифрованном виде. Пустой пароль оставляет сохранённый.</div>
+		<button class="btn btn-primary" type="submit">Подтвердить настройки</button>
+		{{ if .Editing }}
+		<button class="btn btn-outline-secondary" type="button" hx-get="/config" hx-target="#config-form" hx-swap="innerHTML">Новое соревнование</button>
+		{{ end }}
+		{{ if .Error }}<div class="mt-2 text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+`))
+
+// HandleConfigForm shows the configuration form, filled in from the stored
+// source of the event when one is asked for. The password is never sent.
+func (s *APIServer) HandleConfigForm(w http.ResponseWriter, r *http.Request) {
+	config := SourceConfig{}
+	hasPassword := false
+	var errText string
+	if eventID := r.FormValue("event"); eventID != "" {
+		stored, ok, err := s.sourceConfig(eventID)
+		if err != nil {
+			errText = err.Error()
+		}
+		if ok {
+			config = stored
+			hasPassword = config.Password != ""
+			config.Password = ""
+		}
+		config.EventID = eventID
+	}
+	data := map[string]any{
+		"Config":      config,
+		"Editing":     config.EventID != "",
+		"HasPassword": hasPassword,
+		"SourceTypes": sourceTypes,
+		"Error":       errText,
+	}
+	if err := configFormTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// HandleCreateConfig adds an event or updates its source. The event becomes
+// active when asked to or when there is no active event yet.
+func (s *APIServer) HandleCreateConfig(w http.ResponseWriter, r *http.Request) {
+	config := SourceConfig{
+		Type:      r.PostFormValue("source"),
+		EventName: r.PostFormValue("eventName"),
+		Login:     r.PostFormValue("login"),
+		Password:  r.PostFormValue("password"),
+		ClientID:  r.PostFormValue("clientID"),
+		EventID:   r.PostFormValue("eventID"),
+		URL:       r.PostFormValue("url"),
+	}
+	if err := s.keepPassword(&config); err != nil {
+		alertDangerResponse(w, "Источник результатов НЕ НАСТРОЕН!", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+
+	source, err := NewResultSource(config)
+	if err != nil {
+		alertDangerResponse(w, "Источник результатов НЕ НАСТРОЕН!", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	event, err := source.EventInfo(r.Context())
+	if err != nil {
+		alertDangerResponse(w, "Источник результатов НЕ НАСТРОЕН!", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	activated, err := s.addEvent(config, event, source, r.PostFormValue("activate") != "")
+	if err != nil {
+		alertDangerResponse(w, "Ошибка базы данных", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	if activated {
+		w.Header().Add("HX-Refresh", "true")
+	}
+
+	startTime := "-"
+	if timeParsed, err := strconv.Atoi(event.StartTime); err == nil {
+		startTime = time.Unix(int64(timeParsed), 0).Format(time.TimeOnly)
+	}
+	htmlStr := fmt.Sprintf(`
+		<div class="alert alert-info" role="alert">
+		<h4 class="alert-heading">Источник результатов настроен!</h4>
+		<p>Соревнование <strong>%s</strong></p>
+		<p>Начало в %s</p>
+		</div>
+	`, html.EscapeString(event.EventName), startTime)
+	s.notify(w, r, StreamEvents)
+	fmt.Fprint(w, htmlStr)
+}
+
+// addEvent stores the event described by the source together with the
+// source configuration and starts scraping it. The event is activated when
+// asked to or when there is no active event yet.
+func (s *APIServer) addEvent(config SourceConfig, event *Event, source ResultSource, activate bool) (bool, error) {
+	event.EventID = config.EventID
+	event.SourceType = config.Type
+	if event.SourceType == "" {
+		event.SourceType = sourceTypes[0].Name
+	}
+	if config.EventName != "" {
+		event.EventName = config.EventName
+	}
+	if err := s.store.SaveEvent(event); err != nil {
+		return false, err
+	}
+	config.EventID = event.EventID
+	if err := s.saveSourceConfig(config); err != nil {
+		return false, err
+	}
+	active, err := s.store.GetActiveEvent()
+	if err != nil {
+		return false, err
+	}
+	activated := active == nil || activate
+	if activated {
+		if err := s.store.SetActiveEvent(event.EventID); err != nil {
+			return false, err
+		}
+		event.Active = true
+	}
+	s.scraper.SetSource(event.EventID, source)
+	return activated, nil
+}
+
+var eventsListTmpl = template.Must(template.New("events").Parse(`
+	<table class="table table-sm small">
+	<thead>
+		<tr><th>Соревнование</th><th>ID</th><th>Источник</th><th>Результатов</th><th></th></tr>
+	</thead>
+	<tbody>
+	{{ range . }}
+		<tr {{ if .Active }}class="table-success"{{ end }}>
+		<td>{{ .EventName }}{{ if .Active }} <span class="badge bg-success">активно</span>{{ end }}</td>
+		<td>{{ .EventID }}</td>
+		<td>{{ .SourceType }}{{ if not .Connected }} <span class="badge bg-warning text-dark" title="Настройки источника не сохранены или не расшифрованы, введите их ещё раз">не подключён</span>{{ end }}</td>
+		<td>{{ .Count }}</td>
+		<td class="text-end">
+			<button type="button" class="btn btn-sm btn-outline-secondary" hx-get="/config?event={{ .EventID }}" hx-target="#config-form" hx-swap="innerHTML">Изменить</button>
+			{{ if not .Active }}
+			<button type="button" class="btn btn-sm btn-outline-primary" hx-post="/events/{{ .EventID }}/activate">Сделать активным</button>
+			{{ end }}
+			<button type="button" class="btn btn-sm btn-outline-warning" hx-post="/events/{{ .EventID }}/reset" hx-target="#notification" hx-swap="innerHTML" hx-confirm="Удалить все результаты и историю соревнования {{ .EventName }}?">Сбросить</button>
+			<button type="button" class="btn btn-sm btn-outline-danger" hx-delete="/events/{{ .EventID }}" hx-target="#notification" hx-swap="innerHTML" hx-confirm="Удалить соревнование {{ .EventName }} вместе с результатами?">Удалить</button>
+		</td>
+		</tr>
+	{{ else }}
+		<tr><td colspan="5">Соревнования не настроены</td></tr>
+	{{ end }}
+	</tbody>
+	</table>
+`))
+
+func (s *APIServer) HandleEventsList(w http.ResponseWriter, r *http.Request) {
+	events, err := s.store.GetEvents()
+	if err != nil {
+		alertDangerResponse(w, "Ошибка базы данных", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	type eventRow struct {
+		*Event
+		Count     int
+		Connected bool
+	}
+	rows := []eventRow{}
+	for _, e := range events {
+		rows = append(rows, eventRow{
+			Event:     e,
+			Count:     s.store.GetRecordsCount(e.EventID),
+			Connected: s.scraper.HasSource(e.EventID),
+		})
+	}
+	if err := eventsListTmpl.Execute(w, rows); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// HandleActivateEvent makes the event the one searched by default and
+// reloads the page so history and filters follow it.
+func (s *APIServer) HandleActivateEvent(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.SetActiveEvent(mux.Vars(r)["id"]); err != nil {
+		alertDangerResponse(w, "Ошибка базы данных", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	s.stream.publish(r.Header.Get(tabHeader), StreamActivate)
+	w.Header().Add("HX-Refresh", "true")
+}
+
+func (s *APIServer) HandleResetEvent(w http.ResponseWriter, r *http.Request) {
+	eventID := mux.Vars(r)["id"]
+	if err := s.store.ResetEvent(eventID); err != nil {
+		alertDangerResponse(w, "Не удалось сбросить соревнование", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	updTime := time.Now().Format(time.TimeOnly)
+	htmlStr := fmt.Sprintf(`
+		<div class="alert alert-warning" role="alert">
+		<h4 class="alert-heading">Соревнование %s сброшено</h4>
+		<p>Результаты и история удалены в %s.</p>
+		</div>
+	`, html.EscapeString(eventID), updTime)
+	if eventID == s.activeEventID() {
+		s.notify(w, r, StreamReset, StreamEvents, StreamQueue, StreamHistory)
+	} else {
+		s.notify(w, r, StreamEvents)
+	}
+	fmt.Fprint(w, htmlStr)
+}
+
+func (s *APIServer) HandleDeleteEvent(w http.ResponseWriter, r *http.Request) {
+	eventID := mux.Vars(r)["id"]
+	wasActive := eventID == s.activeEventID()
+	if err := s.store.DeleteEvent(eventID); err != nil {
+		alertDangerResponse(w, "Не удалось удалить соревнование", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	s.scraper.RemoveSource(eventID)
+	if wasActive {
+		w.Header().Add("HX-Refresh", "true")
+		return
+	}
+	htmlStr := fmt.Sprintf(`
+		<div class="alert alert-warning" role="alert">
+		<h4 class="alert-heading">Соревнование %s удалено</h4>
+		</div>
+	`, html.EscapeString(eventID))
+	s.notify(w, r, StreamEvents)
+	fmt.Fprint(w, htmlStr)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	lightburnTemplateKey = "lightburn_template"
+	// maxLightBurnSize limits the size of an uploaded project file.
+	maxLightBurnSize = 10 << 20
+)
+
+var ErrNoLightBurnTemplate = errors.New("шаблон LightBurn не загружен")
+
+// lightburnPlaceholders lists the fields a text object of the project may
+// refer to as {name}.
+var lightburnPlaceholders = []string{
+	"name", "first_name", "last_name", "time", "chip_time", "gun_time", "bib",
+	"race", "sex", "category", "event", "text",
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// lightburnProject is a .lbrn2 file split so that its shapes can be copied.
+// The file is XML but it is edited as text, everything LightBurn wrote
+// outside of the shapes stays byte for byte.
+type lightburnProject struct {
+	data []byte
+	// start and end enclose the shapes at the top level of the project.
+	start, end int
+	// xforms hold the transform matrices of the top level shapes.
+	xforms [][2]int
+	// backups hold the glyph outlines LightBurn keeps next to a text in
+	// case the font is missing. They show the old text, so they go.
+	backups [][2]int
+}
+
+func parseLightBurnProject(data []byte) (*lightburnProject, error) {
+	p := &lightburnProject{data: data, start: -1}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	stack := []string{}
+	xformStart, backupStart := 0, 0
+	for {
+		offset := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("файл не похож на проект LightBurn: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			switch {
+			case len(stack) == 1 && t.Name.Local != "LightBurnProject":
+				return nil, fmt.Errorf("файл не похож на проект LightBurn: корневой элемент %s", t.Name.Local)
+			case len(stack) == 2 && t.Name.Local == "Shape" && p.start < 0:
+				p.start = offset
+			case len(stack) == 3 && stack[1] == "Shape" && t.Name.Local == "XForm":
+				xformStart = int(d.InputOffset())
+			case len(stack) > 2 && t.Name.Local == "BackupPath":
+				backupStart = offset
+			}
+		case xml.EndElement:
+			switch {
+			case len(stack) == 2 && t.Name.Local == "Shape":
+				p.end = int(d.InputOffset())
+			case len(stack) == 3 && stack[1] == "Shape" && t.Name.Local == "XForm":
+				p.xforms = append(p.xforms, [2]int{xformStart, offset})
+			case len(stack) > 2 && t.Name.Local == "BackupPath":
+				p.backups = append(p.backups, [2]int{lineStart(data, backupStart), int(d.InputOffset())})
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if p.start < 0 {
+		return nil, fmt.Errorf("в проекте нет ни одного объекта")
+	}
+	return p, nil
+}
+
+// lineStart moves pos back over the indentation and the line break before
+// it, so that cutting an element out leaves no blank line.
+func lineStart(data []byte, pos int) int {
+	for pos > 0 && (data[pos-1] == ' ' || data[pos-1] == '\t') {
+		pos--
+	}
+	if pos > 0 && data[pos-1] == '\n' {
+		pos--
+	}
+	if pos > 0 && data[pos-1] == '\r' {
+		pos--
+	}
+	return pos
+}
+
+// placeholders returns the known placeholders used in the project.
+func (p *lightburnProject) placeholders() []string {
+	found := []string{}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(string(p.data[p.start:p.end]), -1) {
+		if lightburnValue(m[1]) && !contains(found, m[1]) {
+			found = append(found, m[1])
+		}
+	}
+	return found
+}
+
+func lightburnValue(name string) bool {
+	return contains(lightburnPlaceholders, name)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeShapes writes a copy of the shapes with the placeholders filled in
+// and moved by dx, dy millimetres.
+func (p *lightburnProject) writeShapes(b *bytes.Buffer, values map[string]string, dx, dy float64) {
+	type cut struct {
+		start, end int
+		xform      bool
+	}
+	cuts := []cut{}
+	for _, r := range p.xforms {
+		cuts = append(cuts, cut{r[0], r[1], true})
+	}
+	for _, r := range p.backups {
+		cuts = append(cuts, cut{r[0], r[1], false})
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].start < cuts[j].start })
+
+	fill := func(s []byte) {
+		b.WriteString(placeholderPattern.ReplaceAllStringFunc(string(s), func(m string) string {
+			value, ok := values[m[1:len(m)-1]]
+			if !ok {
+				return m
+			}
+			return strings.ReplaceAll(html.EscapeString(value), "\n", "&#10;")
+		}))
+	}
+	pos := p.start
+	for _, c := range cuts {
+		if c.start < pos {
+			// a backup path inside a shape that was already cut
+			continue
+		}
+		fill(p.data[pos:c.start])
+		if c.xform {
+			b.WriteString(moveXForm(string(p.data[c.start:c.end]), dx, dy))
+		}
+		pos = c.end
+	}
+	fill(p.data[pos:p.end])
+}
+
+// moveXForm shifts the affine matrix "a b c d e f" of a shape.
+func moveXForm(xform string, dx, dy float64) string {
+	fields := strings.Fields(xform)
+	if len(fields) != 6 {
+		return xform
+	}
+	for i, delta := range map[int]float64{4: dx, 5: dy} {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return xform
+		}
+		fields[i] = strconv.FormatFloat(v+delta, 'f', -1, 64)
+	}
+	return strings.Join(fields, " ")
+}
+
+// render fills the project for each athlete. Several athletes are laid out
+// on a grid the size of the plate, LightBurn's Y axis points up so rows go
+// down from the original position.
+func (p *lightburnProject) render(layout PlateLayout, values []map[string]string) []byte {
+	b := &bytes.Buffer{}
+	b.Write(p.data[:p.start])
+	indent := p.data[lineStart(p.data, p.start):p.start]
+	for i, v := range values {
+		if i > 0 {
+			b.Write(indent)
+		}
+		dx := float64(i%layout.Columns) * (layout.Width + layout.Gap)
+		dy := -float64(i/layout.Columns) * (layout.Height + layout.Gap)
+		p.writeShapes(b, v, dx, dy)
+	}
+	b.Write(p.data[p.end:])
+	return b.Bytes()
+}
+
+func (s *APIServer) lightburnValues(a *Athlete) map[string]string {
+	text, err := s.engravingText(a)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	return map[string]string{
+		"name":       strings.TrimSpace(a.ResultsFirstName + " " + a.ResultsLastName),
+		"first_name": a.ResultsFirstName,
+		"last_name":  a.ResultsLastName,
+		"time":       a.OfficialTime(),
+		"chip_time":  a.ResultsTime,
+		"gun_time":   a.ResultsGunTime,
+		"bib":        a.ResultsBib,
+		"race":       a.ResultsRaceName,
+		"sex":        a.ResultsSex,
+		"category":   a.ResultsCategory,
+		"event":      a.EventName,
+		"text":       text,
+	}
+}
+
+func (s *APIServer) lightburnProject() (*lightburnProject, error) {
+	data, err := s.store.GetSetting(lightburnTemplateKey)
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		return nil, ErrNoLightBurnTemplate
+	}
+	return parseLightBurnProject([]byte(data))
+}
+
+// saveLightBurnTemplate checks and stores the uploaded project.
+func (s *APIServer) saveLightBurnTemplate(data []byte) error {
+	if _, err := parseLightBurnProject(data); err != nil {
+		return err
+	}
+	return s.store.SetSetting(lightburnTemplateKey, string(data))
+}
+
+// renderLightBurn returns the project filled in for the athletes, one plate
+// per athlete.
+func (s *APIServer) renderLightBurn(athletes []*Athlete) ([]byte, error) {
+	p, err := s.lightburnProject()
+	if err != nil {
+		return nil, err
+	}
+	values := []map[string]string{}
+	for _, a := range athletes {
+		values = append(values, s.lightburnValues(a))
+	}
+	return p.render(s.plateLayout(), values), nil
+}
+
+// athletesByBib looks the bibs up in the event. The first unknown bib is
+// returned with the error.
+func (s *APIServer) athletesByBib(eventID string, bibs []string) ([]*Athlete, string, error) {
+	athletes := []*Athlete{}
+	for _, bib := range bibs {
+		a, err := s.store.GetRecordByBib(eventID, bib)
+		if err != nil {
+			return nil, bib, err
+		}
+		athletes = append(athletes, a)
+	}
+	return athletes, "", nil
+}
+
+// splitBibs reads a list like "12, 15 17".
+func splitBibs(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
+
+func writeLightBurn(w http.ResponseWriter, filename string, data []byte) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Write(data)
+}
+
+func lightburnError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == ErrNoLightBurnTemplate {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// HandleExportLightBurn downloads the project of one athlete.
+func (s *APIServer) HandleExportLightBurn(w http.ResponseWriter, r *http.Request) {
+	eventID := r.FormValue("event")
+	if eventID == "" {
+		eventID = s.activeEventID()
+	}
+	bib := r.FormValue("bib")
+	a, err := s.store.GetRecordByBib(eventID, bib)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Участник %s не найден", bib), http.StatusNotFound)
+		return
+	}
+	data, err := s.renderLightBurn([]*Athlete{a})
+	if err != nil {
+		lightburnError(w, err)
+		return
+	}
+	writeLightBurn(w, fmt.Sprintf("%s.lbrn2", a.ResultsBib), data)
+}
+
+// HandleExportLightBurnBatch downloads one project with the plates of the
+// listed bibs, or of the queued jobs when no bibs are given.
+func (s *APIServer) HandleExportLightBurnBatch(w http.ResponseWriter, r *http.Request) {
+	eventID := s.activeEventID()
+	bibs := splitBibs(r.FormValue("bibs"))
+	var athletes []*Athlete
+	var err error
+	if len(bibs) == 0 {
+		athletes, err = s.queuedAthletes(eventID)
+	} else {
+		var missing string
+		athletes, missing, err = s.athletesByBib(eventID, bibs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Участник %s не найден", missing), http.StatusNotFound)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(athletes) == 0 {
+		http.Error(w, "Очередь пуста", http.StatusNotFound)
+		return
+	}
+	data, err := s.renderLightBurn(athletes)
+	if err != nil {
+		lightburnError(w, err)
+		return
+	}
+	writeLightBurn(w, "batch.lbrn2", data)
+}
+
+var lightburnTmpl = template.Must(template.New("lightburn").Parse(`
+	{{ if .Placeholders }}
+	<p class="small">Шаблон загружен, поля: {{ range .Placeholders }}<code>{{ "{" }}{{ . }}{{ "}" }}</code> {{ end }}</p>
+	{{ else if .Loaded }}
+	<p class="small text-warning">Шаблон загружен, но в нём нет ни одного поля.</p>
+	{{ else }}
+	<p class="small text-muted">Шаблон не загружен.</p>
+	{{ end }}
+	<form hx-post="/export/lightburn/template" hx-encoding="multipart/form-data" hx-target="#lightburn-template" hx-swap="innerHTML">
+		<div class="input-group mb-2">
+			<input type="file" class="form-control" name="file" accept=".lbrn2" aria-label="Проект LightBurn" required>
+			<button class="btn btn-primary" type="submit">Загрузить</button>
+		</div>
+		<div class="form-text">
+			Текстовые объекты проекта могут содержать поля
+			{{ range .Fields }}<code>{{ "{" }}{{ . }}{{ "}" }}</code> {{ end }}.
+			<code>{text}</code> — текст по шаблону гравировки. Пакет раскладывается сеткой по размеру таблички из макета.
+		</div>
+		{{ if .Message }}<span class="text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+	<form class="row g-2 mt-2" action="/export/lightburn/batch" method="get">
+		<div class="col-sm-8">
+			<input type="text" class="form-control" name="bibs" placeholder="Номера через запятую, пусто — вся очередь" aria-label="Номера">
+		</div>
+		<div class="col-auto">
+			<button class="btn btn-outline-secondary" type="submit">Скачать пакет</button>
+		</div>
+	</form>
+`))
+
+func (s *APIServer) renderLightBurnTemplate(w http.ResponseWriter, message string, errText string) {
+	loaded := false
+	placeholders := []string{}
+	p, err := s.lightburnProject()
+	if err == nil {
+		loaded = true
+		placeholders = p.placeholders()
+	} else if err != ErrNoLightBurnTemplate && errText == "" {
+		errText = err.Error()
+	}
+	data := map[string]any{
+		"Loaded":       loaded,
+		"Placeholders": placeholders,
+		"Fields":       lightburnPlaceholders,
+		"Message":      message,
+		"Error":        errText,
+	}
+	if err := lightburnTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleGetLightBurnTemplate(w http.ResponseWriter, r *http.Request) {
+	s.renderLightBurnTemplate(w, "", "")
+}
+
+func (s *APIServer) HandleUploadLightBurnTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLightBurnSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		s.renderLightBurnTemplate(w, "", fmt.Sprintf("Файл не загружен: %s", err))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		s.renderLightBurnTemplate(w, "", fmt.Sprintf("Файл не загружен: %s", err))
+		return
+	}
+	if err := s.saveLightBurnTemplate(data); err != nil {
+		s.renderLightBurnTemplate(w, "", err.Error())
+		return
+	}
+	s.notify(w, r, StreamConfig)
+	s.renderLightBurnTemplate(w, "Шаблон сохранён", "")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLightBurnProject = `<?xml version="1.0" encoding="UTF-8"?>
+<LightBurnProject AppVersion="1.4.05" FormatVersion="1" MaterialHeight="0" MirrorX="False" MirrorY="False">
+    <Thumbnail Source="abc"/>
+    <CutSetting type="Scan">
+        <index Value="0"/>
+    </CutSetting>
+    <Shape Type="Text" CutIndex="0" Font="Arial" Str="{name}&#10;{time} {unknown}" H="6">
+        <XForm>1 0 0 1 40 15</XForm>
+        <BackupPath Type="Path" CutIndex="0">
+            <VertList>V1 2c0x1</VertList>
+        </BackupPath>
+    </Shape>
+    <Shape Type="Rect" CutIndex="0" W="80" H="30" Cr="0">
+        <XForm>1 0 0 1 40 15</XForm>
+    </Shape>
+    <Notes ShowOnLoad="0" Notes=""/>
+</LightBurnProject>
+`
+
+type lbrnDoc struct {
+	Shapes []struct {
+		Type   string     `xml:"Type,attr"`
+		Str    string     `xml:"Str,attr"`
+		XForm  string     `xml:"XForm"`
+		Backup []struct{} `xml:"BackupPath"`
+	} `xml:"Shape"`
+}
+
+func parseLBRN(t *testing.T, data []byte) lbrnDoc {
+	t.Helper()
+	doc := lbrnDoc{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("invalid project: %v\n%s", err, data)
+	}
+	return doc
+}
+
+func TestParseLightBurnProject(t *testing.T) {
+	p, err := parseLightBurnProject([]byte(testLightBurnProject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.placeholders(), []string{"name", "time"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("placeholders %v, want %v", got, want)
+	}
+	if len(p.xforms) != 2 || len(p.backups) != 1 {
+		t.Errorf("%d transforms, %d backups", len(p.xforms), len(p.backups))
+	}
+
+	for _, data := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+		`<LightBurnProject><Notes/></LightBurnProject>`,
+		`<LightBurnProject><Shape>`,
+	} {
+		if _, err := parseLightBurnProject([]byte(data)); err == nil {
+			t.Errorf("accepted %q", data)
+		}
+	}
+}
+
+func TestRenderLightBurn(t *testing.T) {
+	p, err := parseLightBurnProject([]byte(testLightBurnProject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := defaultPlateLayout
+	values := []map[string]string{
+		{"name": "Анна & <Мария>", "time": "00:40:05"},
+		{"name": "Б", "time": "1"},
+		{"name": "В", "time": "2"},
+	}
+
+	data := p.render(layout, values[:1])
+	text := string(data)
+	head := testLightBurnProject[:strings.Index(testLightBurnProject, "<Shape")]
+	tail := testLightBurnProject[strings.LastIndex(testLightBurnProject, "</Shape>")+len("</Shape>"):]
+	if !strings.HasPrefix(text, head) || !strings.HasSuffix(text, tail) {
+		t.Errorf("the project outside the shapes changed:\n%s", text)
+	}
+	if strings.Contains(text, "BackupPath") {
+		t.Error("the glyph backup of the old text is kept")
+	}
+	doc := parseLBRN(t, data)
+	if len(doc.Shapes) != 2 || doc.Shapes[0].Str != "Анна & <Мария>\n00:40:05 {unknown}" {
+		t.Fatalf("shapes %+v", doc.Shapes)
+	}
+
+	doc = parseLBRN(t, p.render(layout, values))
+	xforms := []string{}
+	for _, shape := range doc.Shapes {
+		xforms = append(xforms, shape.XForm)
+	}
+	want := []string{
+		"1 0 0 1 40 15", "1 0 0 1 40 15",
+		"1 0 0 1 125 15", "1 0 0 1 125 15",
+		"1 0 0 1 40 -20", "1 0 0 1 40 -20",
+	}
+	if !reflect.DeepEqual(xforms, want) {
+		t.Errorf("transforms %q, want %q", xforms, want)
+	}
+	if doc.Shapes[4].Str != "В\n2 {unknown}" {
+		t.Errorf("third plate %q", doc.Shapes[4].Str)
+	}
+}
+
+func TestMoveXForm(t *testing.T) {
+	tests := []struct {
+		xform, want string
+	}{
+		{"1 0 0 1 40 15", "1 0 0 1 50.5 10"},
+		{"\n  0.5 0 0 0.5 -2.25 0\n", "0.5 0 0 0.5 8.25 -5"},
+		{"1 0 0 1", "1 0 0 1"},
+		{"1 0 0 1 x 15", "1 0 0 1 x 15"},
+	}
+	for _, tt := range tests {
+		if got := moveXForm(tt.xform, 10.5, -5); got != tt.want {
+			t.Errorf("moveXForm(%q) = %q, want %q", tt.xform, got, tt.want)
+		}
+	}
+}
+
+func TestHandleExportLightBurn(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "op", RoleOperator)
+	session := testSession(t, store, "op")
+	if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetActiveEvent("ev1"); err != nil {
+		t.Fatal(err)
+	}
+	athletes := []Athlete{
+		{ResultsBib: "101", ResultsFirstName: "Анна", ResultsLastName: "Иванова", ResultsTime: "0:40:05"},
+		{ResultsBib: "102", ResultsFirstName: "Иван", ResultsLastName: "Петров", ResultsTime: "0:41:00"},
+	}
+	if _, err := store.CreateBulkRecords("ev1", &athletes); err != nil {
+		t.Fatal(err)
+	}
+	router := s.routes()
+
+	if w := serve(router, http.MethodGet, "/export/lightburn?event=ev1&bib=101", nil, session, ""); w.Code != http.StatusNotFound {
+		t.Errorf("without a template: %d", w.Code)
+	}
+	if err := s.saveLightBurnTemplate([]byte(testLightBurnProject)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(router, http.MethodGet, "/export/lightburn?event=ev1&bib=101", nil, session, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="101.lbrn2"` {
+		t.Fatalf("export: %d %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	if doc := parseLBRN(t, w.Body.Bytes()); !strings.HasPrefix(doc.Shapes[0].Str, "Анна Иванова\n") {
+		t.Errorf("plate text %q", doc.Shapes[0].Str)
+	}
+
+	w = serve(router, http.MethodGet, "/export/lightburn/batch?bibs=102,+101", nil, session, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+	doc := parseLBRN(t, w.Body.Bytes())
+	if len(doc.Shapes) != 4 || !strings.HasPrefix(doc.Shapes[0].Str, "Иван Петров") || !strings.HasPrefix(doc.Shapes[2].Str, "Анна Иванова") {
+		t.Errorf("batch shapes %+v", doc.Shapes)
+	}
+	if w := serve(router, http.MethodGet, "/export/lightburn/batch?bibs=101,999", nil, session, ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "999") {
+		t.Errorf("unknown bib in a batch: %d %s", w.Code, w.Body)
+	}
+	if err := s.saveLightBurnTemplate([]byte("<svg/>")); err == nil {
+		t.Error("a file that is not a project was saved")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const plateLayoutKey = "plate_layout"
+
+// PlateLayout describes the engraving area of a plate or medal. Sizes are in
+// millimetres.
+type PlateLayout struct {
+	Width       float64 `json:"width"`
+	Height      float64 `json:"height"`
+	Margin      float64 `json:"margin"`
+	Font        string  `json:"font"`
+	FontSize    float64 `json:"font_size"`
+	MinFontSize float64 `json:"min_font_size"`
+	LineSpacing float64 `json:"line_spacing"`
+	// Align is left, center or right.
+	Align string `json:"align"`
+	// Outline draws the plate border, handy to position the job.
+	Outline bool `json:"outline"`
+	// Columns and Gap lay out a batch of plates.
+	Columns int     `json:"columns"`
+	Gap     float64 `json:"gap"`
+}
+
+var defaultPlateLayout = PlateLayout{
+	Width:       80,
+	Height:      30,
+	Margin:      2,
+	Font:        "Arial",
+	FontSize:    7,
+	MinFontSize: 2.5,
+	LineSpacing: 1.2,
+	Align:       "center",
+	Columns:     2,
+	Gap:         5,
+}
+
+// validate fills in defaults for missing values and rejects sizes that do
+// not fit.
+func (l *PlateLayout) validate() error {
+	if l.Width <= 0 || l.Height <= 0 {
+		return fmt.Errorf("размер таблички должен быть больше нуля")
+	}
+	if l.Margin < 0 || 2*l.Margin >= l.Width || 2*l.Margin >= l.Height {
+		return fmt.Errorf("поля не помещаются на табличку")
+	}
+	if l.FontSize <= 0 {
+		return fmt.Errorf("размер шрифта должен быть больше нуля")
+	}
+	if l.MinFontSize <= 0 || l.MinFontSize > l.FontSize {
+		l.MinFontSize = l.FontSize
+	}
+	if l.LineSpacing <= 0 {
+		l.LineSpacing = defaultPlateLayout.LineSpacing
+	}
+	if l.Font == "" {
+		l.Font = defaultPlateLayout.Font
+	}
+	switch l.Align {
+	case "left", "center", "right":
+	case "":
+		l.Align = "center"
+	default:
+		return fmt.Errorf("неизвестное выравнивание %q", l.Align)
+	}
+	if l.Columns <= 0 {
+		l.Columns = 1
+	}
+	if l.Gap < 0 {
+		l.Gap = 0
+	}
+	return nil
+}
+
+func (s *APIServer) plateLayout() PlateLayout {
+	layout := defaultPlateLayout
+	if err := loadJSONSetting(s.store, plateLayoutKey, &layout); err != nil {
+		fmt.Println("error", err)
+		return defaultPlateLayout
+	}
+	if err := layout.validate(); err != nil {
+		fmt.Println("error", err)
+		return defaultPlateLayout
+	}
+	return layout
+}
+
+func (s *APIServer) savePlateLayout(layout PlateLayout) error {
+	return saveJSONSetting(s.store, plateLayoutKey, layout)
+}
+
+// textWidth estimates the width of the text at font size 1. There are no
+// font metrics here, the widths are those of a typical sans serif face and
+// err on the wide side.
+func textWidth(s string) float64 {
+	width := 0.0
+	for _, r := range s {
+		switch {
+		case r == ' ':
+			width += 0.3
+		case strings.ContainsRune("il.,:;'|!Iј", r):
+			width += 0.3
+		case unicode.IsUpper(r) || unicode.IsDigit(r) || strings.ContainsRune("mwшщжюмф", r):
+			width += 0.72
+		default:
+			width += 0.56
+		}
+	}
+	return width
+}
+
+// fitText shrinks the font until every line fits the area. Lines that are
+// too long even at the minimum size are squeezed with textLength.
+func (l PlateLayout) fitText(lines []string) (fontSize float64, squeeze bool) {
+	areaWidth := l.Width - 2*l.Margin
+	areaHeight := l.Height - 2*l.Margin
+
+	fontSize = l.FontSize
+	widest := 0.0
+	for _, line := range lines {
+		widest = max(widest, textWidth(line))
+	}
+	if widest > 0 {
+		fontSize = min(fontSize, areaWidth/widest)
+	}
+	blockHeight := 1 + float64(len(lines)-1)*l.LineSpacing
+	fontSize = min(fontSize, areaHeight/blockHeight)
+	if fontSize < l.MinFontSize {
+		return l.MinFontSize, widest*l.MinFontSize > areaWidth
+	}
+	return fontSize, false
+}
+
+// writePlate writes the text elements of one plate with its top left corner
+// at x, y.
+func (l PlateLayout) writePlate(b *strings.Builder, x, y float64, text string) {
+	lines := strings.Split(text, "\n")
+	fontSize, squeeze := l.fitText(lines)
+	areaWidth := l.Width - 2*l.Margin
+
+	anchor, textX := "middle", x+l.Width/2
+	switch l.Align {
+	case "left":
+		anchor, textX = "start", x+l.Margin
+	case "right":
+		anchor, textX = "end", x+l.Width-l.Margin
+	}
+	lineHeight := fontSize * l.LineSpacing
+	blockHeight := fontSize + float64(len(lines)-1)*lineHeight
+	// the baseline sits at about 0.8 of the font size below the top
+	baseline := y + (l.Height-blockHeight)/2 + fontSize*0.8
+
+	if l.Outline {
+		fmt.Fprintf(b, `  <rect x="%s" y="%s" width="%s" height="%s" fill="none" stroke="#ff0000" stroke-width="0.1"/>`+"\n",
+			mm(x), mm(y), mm(l.Width), mm(l.Height))
+	}
+	for i, line := range lines {
+		fit := ""
+		if squeeze && textWidth(line)*fontSize > areaWidth {
+			fit = fmt.Sprintf(` textLength="%s" lengthAdjust="spacingAndGlyphs"`, mm(areaWidth))
+		}
+		fmt.Fprintf(b, `  <text x="%s" y="%s" font-family="%s" font-size="%s" text-anchor="%s" xml:space="preserve"%s>%s</text>`+"\n",
+			mm(textX), mm(baseline+float64(i)*lineHeight), html.EscapeString(l.Font), mm(fontSize), anchor, fit, html.EscapeString(line))
+	}
+}
+
+// mm formats a length to a hundredth of a millimetre, finer than any laser
+// can follow.
+func mm(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// renderSVG lays the texts out as a grid of plates, a single text gives a
+// single plate. The SVG user unit is one millimetre.
+func (l PlateLayout) renderSVG(texts []string) []byte {
+	columns := min(l.Columns, max(len(texts), 1))
+	rows := (len(texts) + columns - 1) / columns
+	rows = max(rows, 1)
+	width := float64(columns)*l.Width + float64(columns-1)*l.Gap
+	height := float64(rows)*l.Height + float64(rows-1)*l.Gap
+
+	b := &strings.Builder{}
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%smm" height="%smm" viewBox="0 0 %s %s">`+"\n",
+		mm(width), mm(height), mm(width), mm(height))
+	for i, text := range texts {
+		x := float64(i%columns) * (l.Width + l.Gap)
+		y := float64(i/columns) * (l.Height + l.Gap)
+		l.writePlate(b, x, y, text)
+	}
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+func writeSVG(w http.ResponseWriter, filename string, svg []byte) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Write(svg)
+}
+
+// queuedAthletes returns the athletes of the jobs waiting in the queue of
+// the event, in queue order.
+func (s *APIServer) queuedAthletes(eventID string) ([]*Athlete, error) {
+	jobs, err := s.store.GetQueue(eventID)
+	if err != nil {
+		return nil, err
+	}
+	athletes := []*Athlete{}
+	for _, j := range jobs {
+		if j.Status == JobQueued {
+			athletes = append(athletes, j.Athlete)
+		}
+	}
+	return athletes, nil
+}
+
+func (s *APIServer) queuedTexts(eventID string) ([]string, error) {
+	athletes, err := s.queuedAthletes(eventID)
+	if err != nil {
+		return nil, err
+	}
+	texts := []string{}
+	for _, a := range athletes {
+		text, err := s.engravingText(a)
+		if err != nil {
+			fmt.Println("error", err)
+		}
+		texts = append(texts, text)
+	}
+	return texts, nil
+}
+
+// HandleExportSVG downloads the plate of one athlete.
+func (s *APIServer) HandleExportSVG(w http.ResponseWriter, r *http.Request) {
+	eventID := r.FormValue("event")
+	if eventID == "" {
+		eventID = s.activeEventID()
+	}
+	bib := r.FormValue("bib")
+	a, err := s.store.GetRecordByBib(eventID, bib)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Участник %s не найден", bib), http.StatusNotFound)
+		return
+	}
+	text, err := s.engravingText(a)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	writeSVG(w, fmt.Sprintf("%s.svg", a.ResultsBib), s.plateLayout().renderSVG([]string{text}))
+}
+
+// HandleExportQueueSVG downloads the plates of every queued job as one grid.
+func (s *APIServer) HandleExportQueueSVG(w http.ResponseWriter, r *http.Request) {
+	texts, err := s.queuedTexts(s.activeEventID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(texts) == 0 {
+		http.Error(w, "Очередь пуста", http.StatusNotFound)
+		return
+	}
+	writeSVG(w, "queue.svg", s.plateLayout().renderSVG(texts))
+}
+
+var plateLayoutTmpl = template.Must(template.New("layout").Parse(`
+	<form hx-post="/export/layout" hx-target="#plate-layout" hx-swap="innerHTML">
+		<div class="row g-2">
+			<div class="col-sm-3">
+				<label class="form-label small">Ширина, мм</label>
+				<input type="number" class="form-control" name="width" step="0.1" min="1" value="{{ .Layout.Width }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Высота, мм</label>
+				<input type="number" class="form-control" name="height" step="0.1" min="1" value="{{ .Layout.Height }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Поля, мм</label>
+				<input type="number" class="form-control" name="margin" step="0.1" min="0" value="{{ .Layout.Margin }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Выравнивание</label>
+				<select class="form-select" name="align">
+					<option value="left" {{ if eq .Layout.Align "left" }}selected{{ end }}>Слева</option>
+					<option value="center" {{ if eq .Layout.Align "center" }}selected{{ end }}>По центру</option>
+					<option value="right" {{ if eq .Layout.Align "right" }}selected{{ end }}>Справа</option>
+				</select>
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Шрифт</label>
+				<input type="text" class="form-control" name="font" value="{{ .Layout.Font }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Размер шрифта, мм</label>
+				<input type="number" class="form-control" name="font_size" step="0.1" min="0.5" value="{{ .Layout.FontSize }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Не меньше, мм</label>
+				<input type="number" class="form-control" name="min_font_size" step="0.1" min="0.5" value="{{ .Layout.MinFontSize }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Межстрочный</label>
+				<input type="number" class="form-control" name="line_spacing" step="0.05" min="0.5" value="{{ .Layout.LineSpacing }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Колонок в пакете</label>
+				<input type="number" class="form-control" name="columns" min="1" value="{{ .Layout.Columns }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Зазор, мм</label>
+				<input type="number" class="form-control" name="gap" step="0.1" min="0" value="{{ .Layout.Gap }}">
+			</div>
+			<div class="col-sm-6 d-flex align-items-end">
+				<div class="form-check">
+					<input class="form-check-input" type="checkbox" name="outline" value="1" id="plate-outline" {{ if .Layout.Outline }}checked{{ end }}>
+					<label class="form-check-label" for="plate-outline">Рисовать контур таблички</label>
+				</div>
+			</div>
+		</div>
+		<button type="submit" class="btn btn-primary mt-2">Сохранить макет</button>
+		{{ if .Message }}<span class="ms-2 text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="mt-2 text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+`))
+
+func (s *APIServer) renderPlateLayout(w http.ResponseWriter, layout PlateLayout, message string, errText string) {
+	data := map[string]any{
+		"Layout":  layout,
+		"Message": message,
+		"Error":   errText,
+	}
+	if err := plateLayoutTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleGetPlateLayout(w http.ResponseWriter, r *http.Request) {
+	s.renderPlateLayout(w, s.plateLayout(), "", "")
+}
+
+func (s *APIServer) HandleSavePlateLayout(w http.ResponseWriter, r *http.Request) {
+	number := func(name string) float64 {
+		v, _ := strconv.ParseFloat(strings.Replace(r.PostFormValue(name), ",", ".", 1), 64)
+		return v
+	}
+	columns, _ := strconv.Atoi(r.PostFormValue("columns"))
+	layout := PlateLayout{
+		Width:       number("width"),
+		Height:      number("height"),
+		Margin:      number("margin"),
+		Font:        strings.TrimSpace(r.PostFormValue("font")),
+		FontSize:    number("font_size"),
+		MinFontSize: number("min_font_size"),
+		LineSpacing: number("line_spacing"),
+		Align:       r.PostFormValue("align"),
+		Outline:     r.PostFormValue("outline") != "",
+		Columns:     columns,
+		Gap:         number("gap"),
+	}
+	if err := layout.validate(); err != nil {
+		s.renderPlateLayout(w, layout, "", err.Error())
+		return
+	}
+	if err := s.savePlateLayout(layout); err != nil {
+		s.renderPlateLayout(w, layout, "", fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.notify(w, r, StreamConfig)
+	s.renderPlateLayout(w, layout, "Макет сохранён", "")
+}
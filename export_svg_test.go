@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type svgDoc struct {
+	Width   string    `xml:"width,attr"`
+	Height  string    `xml:"height,attr"`
+	ViewBox string    `xml:"viewBox,attr"`
+	Rects   []svgRect `xml:"rect"`
+	Texts   []svgText `xml:"text"`
+}
+
+type svgRect struct {
+	X string `xml:"x,attr"`
+	Y string `xml:"y,attr"`
+}
+
+type svgText struct {
+	X          string `xml:"x,attr"`
+	Y          string `xml:"y,attr"`
+	FontSize   string `xml:"font-size,attr"`
+	Anchor     string `xml:"text-anchor,attr"`
+	TextLength string `xml:"textLength,attr"`
+	Text       string `xml:",chardata"`
+}
+
+func parseSVG(t *testing.T, data []byte) svgDoc {
+	t.Helper()
+	doc := svgDoc{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("invalid SVG: %v\n%s", err, data)
+	}
+	return doc
+}
+
+func TestRenderSVG(t *testing.T) {
+	l := defaultPlateLayout
+	l.Outline = true
+	doc := parseSVG(t, l.renderSVG([]string{"Анна <Иванова>\n00:40:05", "Б & В", "Г"}))
+
+	// two columns, two rows with a 5 mm gap
+	if doc.Width != "165mm" || doc.Height != "65mm" || doc.ViewBox != "0 0 165 65" {
+		t.Errorf("size %s x %s, viewBox %q", doc.Width, doc.Height, doc.ViewBox)
+	}
+	if len(doc.Rects) != 3 || doc.Rects[1].X != "85" || doc.Rects[2].Y != "35" {
+		t.Errorf("plates at %v", doc.Rects)
+	}
+	if len(doc.Texts) != 4 {
+		t.Fatalf("%d text lines, want 4", len(doc.Texts))
+	}
+	if doc.Texts[0].Text != "Анна <Иванова>" || doc.Texts[2].Text != "Б & В" {
+		t.Errorf("texts %q, %q", doc.Texts[0].Text, doc.Texts[2].Text)
+	}
+	if doc.Texts[0].X != "40" || doc.Texts[0].Anchor != "middle" {
+		t.Errorf("centred line at %s, anchor %s", doc.Texts[0].X, doc.Texts[0].Anchor)
+	}
+
+	single := parseSVG(t, defaultPlateLayout.renderSVG([]string{"Г"}))
+	if single.Width != "80mm" || single.Height != "30mm" || len(single.Rects) != 0 {
+		t.Errorf("single plate %s x %s with %d outlines", single.Width, single.Height, len(single.Rects))
+	}
+}
+
+func TestFitText(t *testing.T) {
+	l := defaultPlateLayout
+	if size, squeeze := l.fitText([]string{"Г"}); size != l.FontSize || squeeze {
+		t.Errorf("short text: %v, %v", size, squeeze)
+	}
+	size, squeeze := l.fitText([]string{"Константинопольская Александра-Мария"})
+	if size >= l.FontSize || size < l.MinFontSize || squeeze {
+		t.Errorf("long text: %v, %v", size, squeeze)
+	}
+	long := strings.Repeat("Ж", 60)
+	if size, squeeze := l.fitText([]string{long}); size != l.MinFontSize || !squeeze {
+		t.Errorf("too long text: %v, %v", size, squeeze)
+	}
+	doc := parseSVG(t, l.renderSVG([]string{long + "\nГ"}))
+	if doc.Texts[0].TextLength != "76" || doc.Texts[1].TextLength != "" {
+		t.Errorf("textLength %q, %q", doc.Texts[0].TextLength, doc.Texts[1].TextLength)
+	}
+	lines := []string{"1", "2", "3", "4", "5", "6", "7"}
+	if size, _ := l.fitText(lines); size*(1+6*l.LineSpacing) > l.Height-2*l.Margin+1e-9 {
+		t.Errorf("seven lines at %v mm do not fit the height", size)
+	}
+}
+
+func TestPlateLayoutValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*PlateLayout)
+		ok     bool
+	}{
+		{"default", func(l *PlateLayout) {}, true},
+		{"no width", func(l *PlateLayout) { l.Width = 0 }, false},
+		{"margins too wide", func(l *PlateLayout) { l.Margin = 15 }, false},
+		{"no font size", func(l *PlateLayout) { l.FontSize = 0 }, false},
+		{"unknown align", func(l *PlateLayout) { l.Align = "justify" }, false},
+		{"defaults filled in", func(l *PlateLayout) { l.Align, l.Font, l.Columns, l.MinFontSize = "", "", 0, 100 }, true},
+	}
+	for _, tt := range tests {
+		l := defaultPlateLayout
+		tt.change(&l)
+		err := l.validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+	l := PlateLayout{Width: 50, Height: 20, FontSize: 5, MinFontSize: 100}
+	l.validate()
+	if l.Align != "center" || l.Font != defaultPlateLayout.Font || l.Columns != 1 || l.MinFontSize != 5 {
+		t.Errorf("defaults: %+v", l)
+	}
+}
+
+func TestHandleExportSVG(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "op", RoleOperator)
+	session := testSession(t, store, "op")
+	if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+		t.Fatal(err)
+	}
+	athletes := []Athlete{{ResultsBib: "101", ResultsFirstName: "Анна", ResultsLastName: "Иванова", ResultsTime: "0:40:05"}}
+	if _, err := store.CreateBulkRecords("ev1", &athletes); err != nil {
+		t.Fatal(err)
+	}
+	router := s.routes()
+
+	w := serve(router, http.MethodGet, "/export/svg?event=ev1&bib=101", nil, session, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("export: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="101.svg"` {
+		t.Errorf("Content-Disposition %q", got)
+	}
+	doc := parseSVG(t, w.Body.Bytes())
+	text := []string{}
+	for _, line := range doc.Texts {
+		text = append(text, line.Text)
+	}
+	if !strings.Contains(strings.Join(text, "\n"), "Анна") {
+		t.Errorf("plate text %q", text)
+	}
+
+	if w := serve(router, http.MethodGet, "/export/svg?event=ev1&bib=999", nil, session, ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown bib: %d", w.Code)
+	}
+	if w := serve(router, http.MethodGet, "/export/svg/queue", nil, session, ""); w.Code != http.StatusNotFound {
+		t.Errorf("empty queue: %d", w.Code)
+	}
+	if err := store.SetActiveEvent("ev1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.EnqueueJob("ev1", "101", "", Stamp{}); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(router, http.MethodGet, "/export/svg/queue", nil, session, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("queue export: %d %s", w.Code, w.Body)
+	}
+	if doc := parseSVG(t, w.Body.Bytes()); doc.Width != "80mm" || len(doc.Texts) == 0 {
+		t.Errorf("queue of one: %s wide, %d lines", doc.Width, len(doc.Texts))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const grblSettingsKey = "grbl_settings"
+
+// GrblSettings tell how to drive a laser with a GRBL controller. The
+// controller has to be in laser mode ($32=1) so that it switches the beam
+// off for travel moves.
+type GrblSettings struct {
+	// Device is the serial port, e.g. /dev/ttyUSB0. Empty turns the laser
+	// output off.
+	Device string `json:"device"`
+	Baud   int    `json:"baud"`
+	// Power is the S value while burning, out of MaxPower ($30).
+	Power    int `json:"power"`
+	MaxPower int `json:"max_power"`
+	// Speed is the feed rate while burning, mm/min.
+	Speed  int `json:"speed"`
+	Passes int `json:"passes"`
+	// OriginX and OriginY put the bottom left corner of the plate on the
+	// machine, mm.
+	OriginX float64 `json:"origin_x"`
+	OriginY float64 `json:"origin_y"`
+	// Font is the path of a Hershey .jhf font, empty for the built in one.
+	Font string `json:"font"`
+}
+
+var defaultGrblSettings = GrblSettings{
+	Baud:     115200,
+	Power:    300,
+	MaxPower: 1000,
+	Speed:    1000,
+	Passes:   1,
+}
+
+func (g *GrblSettings) validate() error {
+	if g.Baud <= 0 {
+		g.Baud = defaultGrblSettings.Baud
+	}
+	if g.MaxPower <= 0 {
+		g.MaxPower = defaultGrblSettings.MaxPower
+	}
+	if g.Power <= 0 || g.Power > g.MaxPower {
+		return fmt.Errorf("мощность должна быть от 1 до %d", g.MaxPower)
+	}
+	if g.Speed <= 0 {
+		return fmt.Errorf("скорость должна быть больше нуля")
+	}
+	if g.Passes <= 0 || g.Passes > 20 {
+		return fmt.Errorf("число проходов должно быть от 1 до 20")
+	}
+	if _, err := loadStrokeFont(g.Font); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *APIServer) grblSettings() GrblSettings {
+	settings := defaultGrblSettings
+	if err := loadJSONSetting(s.store, grblSettingsKey, &settings); err != nil {
+		fmt.Println("error", err)
+		return defaultGrblSettings
+	}
+	return settings
+}
+
+func (s *APIServer) saveGrblSettings(settings GrblSettings) error {
+	return saveJSONSetting(s.store, grblSettingsKey, settings)
+}
+
+// capHeight is the capital height of a stroke font at the font size of the
+// layout, about that of a typical sans serif face.
+const capHeight = 0.7
+
+// strokeText lays the text out on the plate the way the SVG export does and
+// returns the strokes in millimetres from the bottom left corner of the
+// plate. Lines that do not fit even at the smallest size are narrowed.
+func strokeText(font *strokeFont, layout PlateLayout, text string) [][]point {
+	lines := strings.Split(text, "\n")
+	areaWidth := layout.Width - 2*layout.Margin
+	areaHeight := layout.Height - 2*layout.Margin
+
+	widest := 0.0
+	for _, line := range lines {
+		widest = max(widest, font.lineWidth(line))
+	}
+	blockHeight := 1 + float64(len(lines)-1)*layout.LineSpacing
+	size := min(layout.FontSize*capHeight, areaHeight/blockHeight)
+	if widest > 0 {
+		size = min(size, areaWidth/widest)
+	}
+	size = max(size, layout.MinFontSize*capHeight)
+
+	top := layout.Height - (layout.Height-blockHeight*size)/2
+	paths := [][]point{}
+	for i, line := range lines {
+		width := font.lineWidth(line) * size
+		scaleX := 1.0
+		if width > areaWidth {
+			scaleX = areaWidth / width
+			width = areaWidth
+		}
+		x := (layout.Width - width) / 2
+		switch layout.Align {
+		case "left":
+			x = layout.Margin
+		case "right":
+			x = layout.Width - layout.Margin - width
+		}
+		baseline := top - size - float64(i)*layout.LineSpacing*size
+		for _, r := range line {
+			g := font.glyph(r)
+			for _, stroke := range g.strokes {
+				path := make([]point, 0, len(stroke))
+				for _, p := range stroke {
+					path = append(path, point{x + p.X*size*scaleX, baseline + p.Y*size})
+				}
+				paths = append(paths, path)
+			}
+			x += g.advance * size * scaleX
+		}
+	}
+	return paths
+}
+
+// gcode turns the strokes into a GRBL program. Every stroke is a rapid move
+// to its start and feed moves along it, the whole text is burnt once per
+// pass.
+func (g GrblSettings) gcode(paths [][]point) []string {
+	coord := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+	lines := []string{
+		"G21",
+		"G90",
+		"G17",
+		"M4 S0",
+	}
+	for pass := 0; pass < g.Passes; pass++ {
+		for _, path := range paths {
+			if len(path) < 2 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("G0 X%s Y%s", coord(g.OriginX+path[0].X), coord(g.OriginY+path[0].Y)))
+			for i, p := range path[1:] {
+				line := fmt.Sprintf("G1 X%s Y%s", coord(g.OriginX+p.X), coord(g.OriginY+p.Y))
+				if i == 0 {
+					line += fmt.Sprintf(" S%d F%d", g.Power, g.Speed)
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = append(lines,
+		"M5",
+		fmt.Sprintf("G0 X%s Y%s", coord(g.OriginX), coord(g.OriginY)),
+	)
+	return lines
+}
+
+// engravingGCode renders the engraving text of the athlete as a GRBL
+// program.
+func (s *APIServer) engravingGCode(a *Athlete, settings GrblSettings) ([]string, error) {
+	font, err := loadStrokeFont(settings.Font)
+	if err != nil {
+		return nil, err
+	}
+	text, err := s.engravingText(a)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	return settings.gcode(strokeText(font, s.plateLayout(), text)), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGrblSettingsGcode(t *testing.T) {
+	square := []point{{0, 0}, {10, 0}, {10, 5}}
+	tests := []struct {
+		name     string
+		settings GrblSettings
+		paths    [][]point
+		want     []string
+	}{
+		{
+			name:     "one stroke",
+			settings: GrblSettings{Power: 300, Speed: 1000, Passes: 1},
+			paths:    [][]point{square},
+			want: []string{
+				"G21", "G90", "G17", "M4 S0",
+				"G0 X0.000 Y0.000",
+				"G1 X10.000 Y0.000 S300 F1000",
+				"G1 X10.000 Y5.000",
+				"M5", "G0 X0.000 Y0.000",
+			},
+		},
+		{
+			name:     "origin and passes",
+			settings: GrblSettings{Power: 500, Speed: 800, Passes: 2, OriginX: 1.5, OriginY: 20},
+			paths:    [][]point{{{0, 0}, {1, 1}}},
+			want: []string{
+				"G21", "G90", "G17", "M4 S0",
+				"G0 X1.500 Y20.000",
+				"G1 X2.500 Y21.000 S500 F800",
+				"G0 X1.500 Y20.000",
+				"G1 X2.500 Y21.000 S500 F800",
+				"M5", "G0 X1.500 Y20.000",
+			},
+		},
+		{
+			name:     "single points are skipped",
+			settings: GrblSettings{Power: 300, Speed: 1000, Passes: 1},
+			paths:    [][]point{{{3, 3}}},
+			want:     []string{"G21", "G90", "G17", "M4 S0", "M5", "G0 X0.000 Y0.000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.settings.gcode(tt.paths)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStrokeText(t *testing.T) {
+	font, err := loadStrokeFont("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := func(align string) PlateLayout {
+		l := defaultPlateLayout
+		l.Align = align
+		return l
+	}
+	const eps = 1e-9
+	tests := []struct {
+		name   string
+		layout PlateLayout
+		text   string
+		// left and right are the expected edges of the ink, NaN when any
+		// place inside the margins will do
+		left, right float64
+	}{
+		{"left", layout("left"), "ABA", 2, math.NaN()},
+		{"right", layout("right"), "ABA", math.NaN(), 78},
+		{"narrowed to fit", layout("center"), strings.Repeat("W", 60), 2, 78},
+		{"two lines", layout("center"), "AAA\nBB", math.NaN(), math.NaN()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := strokeText(font, tt.layout, tt.text)
+			if len(paths) == 0 {
+				t.Fatal("no strokes")
+			}
+			minX, maxX := math.Inf(1), math.Inf(-1)
+			for _, path := range paths {
+				for _, p := range path {
+					minX, maxX = min(minX, p.X), max(maxX, p.X)
+					if p.Y < tt.layout.Margin-eps || p.Y > tt.layout.Height-tt.layout.Margin+eps {
+						t.Fatalf("%v is outside the plate height", p)
+					}
+				}
+			}
+			if minX < tt.layout.Margin-eps || maxX > tt.layout.Width-tt.layout.Margin+eps {
+				t.Errorf("ink from %.3f to %.3f is outside the margins", minX, maxX)
+			}
+			if !math.IsNaN(tt.left) && math.Abs(minX-tt.left) > 1e-6 {
+				t.Errorf("left edge %.3f, want %.3f", minX, tt.left)
+			}
+			if !math.IsNaN(tt.right) && math.Abs(maxX-tt.right) > 1e-6 {
+				t.Errorf("right edge %.3f, want %.3f", maxX, tt.right)
+			}
+		})
+	}
+
+	if paths := strokeText(font, layout("center"), ""); len(paths) != 0 {
+		t.Errorf("empty text gave %d strokes", len(paths))
+	}
+}
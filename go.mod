@@ -8,3 +8,5 @@ require (
 )
 
 require github.com/mattn/go-sqlite3 v1.14.17
+
+require golang.org/x/crypto v0.33.0
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// grblRxBuffer is the serial receive buffer of GRBL, 128 bytes of which
+	// one is kept free for real time commands.
+	grblRxBuffer = 127
+	// grblPollInterval is how often the status is asked for while a job
+	// runs.
+	grblPollInterval = 250 * time.Millisecond
+	// laserChangeInterval is how often the pages are told about the
+	// progress of a job.
+	laserChangeInterval = time.Second
+	// grblResponseTimeout fails a job when the controller falls silent.
+	grblResponseTimeout = 30 * time.Second
+	// grblBannerTimeout is how long to wait for the controller to start up
+	// after a reset.
+	grblBannerTimeout = 3 * time.Second
+
+	grblStatusQuery = '?'
+	grblSoftReset   = 0x18
+)
+
+var (
+	ErrLaserBusy    = errors.New("лазер занят другим заданием")
+	ErrLaserAborted = errors.New("гравировка прервана")
+	ErrLaserOff     = errors.New("порт лазера не настроен")
+)
+
+// grblConn talks to a GRBL controller. Lines are streamed with character
+// counting: as many lines are sent as fit in the receive buffer of the
+// controller, each "ok" or "error" frees the space of the oldest line.
+type grblConn struct {
+	port io.ReadWriteCloser
+
+	writeMu sync.Mutex
+	// responses get every line from the controller except status reports
+	responses chan string
+	readErr   error
+
+	mu     sync.Mutex
+	status string
+	// statusSeen is signalled on every status report
+	statusSeen chan struct{}
+}
+
+func newGrblConn(port io.ReadWriteCloser) *grblConn {
+	c := &grblConn{
+		port:       port,
+		responses:  make(chan string, 64),
+		statusSeen: make(chan struct{}, 1),
+	}
+	go c.read()
+	return c
+}
+
+func (c *grblConn) read() {
+	reader := bufio.NewReader(c.port)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.readErr = err
+			close(c.responses)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "<"):
+			c.mu.Lock()
+			c.status = strings.Trim(line, "<>")
+			c.mu.Unlock()
+			select {
+			case c.statusSeen <- struct{}{}:
+			default:
+			}
+		default:
+			c.responses <- line
+		}
+	}
+}
+
+func (c *grblConn) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.port.Write(data)
+	return err
+}
+
+// Status returns the last status report, e.g. "Run|MPos:1.000,2.000,0.000".
+func (c *grblConn) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// state is the machine state part of the status report: Idle, Run, Alarm...
+func (c *grblConn) state() string {
+	state, _, _ := strings.Cut(c.Status(), "|")
+	state, _, _ = strings.Cut(state, ":")
+	return state
+}
+
+func (c *grblConn) Close() error {
+	return c.port.Close()
+}
+
+// next waits for a response line. A cancelled context resets the
+// controller, which stops the beam at once.
+func (c *grblConn) next(ctx context.Context) (string, error) {
+	timeout := time.NewTimer(grblResponseTimeout)
+	defer timeout.Stop()
+	select {
+	case <-ctx.Done():
+		c.write([]byte{grblSoftReset})
+		return "", ErrLaserAborted
+	case line, ok := <-c.responses:
+		if !ok {
+			return "", fmt.Errorf("связь с контроллером потеряна: %w", c.readErr)
+		}
+		return line, nil
+	case <-timeout.C:
+		return "", fmt.Errorf("контроллер не отвечает %s", grblResponseTimeout)
+	}
+}
+
+// poll asks for the status now and then until stop is called.
+func (c *grblConn) poll() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(grblPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := c.write([]byte{grblStatusQuery}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// start resets the controller and waits for its greeting. A controller on
+// USB usually restarts when the port opens and the first reset may get lost
+// while it boots, so it is sent twice if needed.
+func (c *grblConn) start(ctx context.Context) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := c.write([]byte{grblSoftReset}); err != nil {
+			return err
+		}
+		deadline := time.NewTimer(grblBannerTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				deadline.Stop()
+				return ErrLaserAborted
+			case line, ok := <-c.responses:
+				if !ok {
+					deadline.Stop()
+					return fmt.Errorf("связь с контроллером потеряна: %w", c.readErr)
+				}
+				if strings.HasPrefix(line, "Grbl ") {
+					deadline.Stop()
+					return c.checkIdle(ctx)
+				}
+			case <-deadline.C:
+				break wait
+			}
+		}
+	}
+	return fmt.Errorf("контроллер GRBL не отвечает")
+}
+
+// checkIdle refuses to start when the controller is locked by an alarm.
+func (c *grblConn) checkIdle(ctx context.Context) error {
+	if err := c.waitStatus(ctx); err != nil {
+		return err
+	}
+	if c.state() == "Alarm" {
+		return fmt.Errorf("контроллер в режиме тревоги, разблокируйте его ($X)")
+	}
+	return nil
+}
+
+// waitStatus asks for a status report and waits for it.
+func (c *grblConn) waitStatus(ctx context.Context) error {
+	select {
+	case <-c.statusSeen:
+	default:
+	}
+	if err := c.write([]byte{grblStatusQuery}); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		c.write([]byte{grblSoftReset})
+		return ErrLaserAborted
+	case <-c.statusSeen:
+		return nil
+	case <-time.After(grblResponseTimeout):
+		return fmt.Errorf("контроллер не отвечает %s", grblResponseTimeout)
+	}
+}
+
+// Stream sends the program and waits until the machine has finished moving.
+// progress is called with the number of lines the controller accepted. When
+// the job fails the controller is halted before Stream returns, GRBL would
+// otherwise go on with the lines it has buffered.
+func (c *grblConn) Stream(ctx context.Context, lines []string, progress func(done int)) error {
+	err := c.stream(ctx, lines, progress)
+	if err != nil {
+		c.halt()
+	}
+	return err
+}
+
+// halt stops the machine after a failed job: the soft reset throws away what
+// is buffered and stops the motion, M5 makes sure the beam stays off. It
+// waits for the controller to come back so the port is not closed while it
+// still burns.
+func (c *grblConn) halt() {
+	if err := c.write([]byte{grblSoftReset}); err != nil {
+		return
+	}
+	deadline := time.NewTimer(grblBannerTimeout)
+	defer deadline.Stop()
+	sentM5 := false
+	for {
+		select {
+		case line, ok := <-c.responses:
+			if !ok {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "Grbl "):
+				if err := c.write([]byte("M5\n")); err != nil {
+					return
+				}
+				sentM5 = true
+			case sentM5 && (line == "ok" || strings.HasPrefix(line, "error:")):
+				// in an alarm M5 is refused, the beam is off then anyway
+				return
+			}
+		case <-deadline.C:
+			fmt.Println("laser error", "контроллер не ответил после сброса")
+			return
+		}
+	}
+}
+
+func (c *grblConn) stream(ctx context.Context, lines []string, progress func(done int)) error {
+	// lengths of the lines sent but not answered yet, oldest first
+	pending := []int{}
+	used := 0
+	done := 0
+	ack := func() error {
+		response, err := c.next(ctx)
+		if err != nil {
+			return err
+		}
+		switch {
+		case response == "ok":
+		case strings.HasPrefix(response, "error:"):
+			return fmt.Errorf("GRBL %s в строке %d: %s", response, done+1, lines[done])
+		case strings.HasPrefix(response, "ALARM:"):
+			return fmt.Errorf("GRBL %s", response)
+		case strings.HasPrefix(response, "Grbl "):
+			return fmt.Errorf("контроллер перезагрузился")
+		default:
+			// messages like [MSG:...] do not answer a line
+			return nil
+		}
+		used -= pending[0]
+		pending = pending[1:]
+		done++
+		progress(done)
+		return nil
+	}
+
+	stop := c.poll()
+	defer stop()
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		size := len(line) + 1
+		if size > grblRxBuffer {
+			return fmt.Errorf("строка длиннее буфера контроллера: %s", line)
+		}
+		for used+size > grblRxBuffer {
+			if err := ack(); err != nil {
+				return err
+			}
+		}
+		if err := c.write([]byte(line + "\n")); err != nil {
+			return err
+		}
+		pending = append(pending, size)
+		used += size
+	}
+	for len(pending) > 0 {
+		if err := ack(); err != nil {
+			return err
+		}
+	}
+
+	// every line is in the planner now, the machine may still be moving
+	for {
+		if err := c.waitStatus(ctx); err != nil {
+			return err
+		}
+		switch c.state() {
+		case "Idle":
+			return nil
+		case "Alarm":
+			return fmt.Errorf("GRBL в режиме тревоги")
+		}
+		select {
+		case <-ctx.Done():
+			c.write([]byte{grblSoftReset})
+			return ErrLaserAborted
+		case <-time.After(grblPollInterval):
+		}
+	}
+}
+
+// LaserStatus describes the job on the laser, or the last one.
+type LaserStatus struct {
+	Running bool
+	JobID   int
+	Bib     string
+	Lines   int
+	Done    int
+	// Grbl is the last status report of the controller.
+	Grbl      string
+	LastError string
+	Finished  time.Time
+}
+
+// Laser runs one engraving job at a time on the GRBL controller.
+type Laser struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	status LaserStatus
+	conn   *grblConn
+
+	open func(device string, baud int) (io.ReadWriteCloser, error)
+	// onChange is called when a job starts, moves on or stops, see
+	// OnChange.
+	onChange func()
+}
+
+func NewLaser() *Laser {
+	return &Laser{open: openSerial}
+}
+
+// OnChange sets what to do when the status changes, such as telling the
+// browsers to refresh it.
+func (l *Laser) OnChange(f func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onChange = f
+}
+
+func (l *Laser) changed() {
+	l.mu.Lock()
+	f := l.onChange
+	l.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+func (l *Laser) Status() LaserStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := l.status
+	if l.conn != nil {
+		status.Grbl = l.conn.Status()
+	}
+	return status
+}
+
+// Start streams the program in the background. done is called with the
+// outcome once the laser has stopped.
+func (l *Laser) Start(settings GrblSettings, jobID int, bib string, lines []string, done func(err error)) error {
+	if settings.Device == "" {
+		return ErrLaserOff
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.status.Running {
+		return ErrLaserBusy
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.status = LaserStatus{Running: true, JobID: jobID, Bib: bib, Lines: len(lines)}
+
+	go func() {
+		defer cancel()
+		go l.reportProgress(ctx)
+		err := l.run(ctx, settings, lines)
+		if err != nil {
+			fmt.Println("laser error", err)
+		}
+		l.mu.Lock()
+		l.status.Running = false
+		l.status.Finished = time.Now()
+		if l.conn != nil {
+			l.status.Grbl = l.conn.Status()
+			l.conn = nil
+		}
+		if err != nil {
+			l.status.LastError = err.Error()
+		}
+		l.mu.Unlock()
+		done(err)
+		l.changed()
+	}()
+	return nil
+}
+
+// reportProgress tells about the running job until it stops.
+func (l *Laser) reportProgress(ctx context.Context) {
+	ticker := time.NewTicker(laserChangeInterval)
+	defer ticker.Stop()
+	for {
+		l.changed()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *Laser) run(ctx context.Context, settings GrblSettings, lines []string) error {
+	port, err := l.open(settings.Device, settings.Baud)
+	if err != nil {
+		return err
+	}
+	conn := newGrblConn(port)
+	defer conn.Close()
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+
+	if err := conn.start(ctx); err != nil {
+		return err
+	}
+	return conn.Stream(ctx, lines, func(done int) {
+		l.mu.Lock()
+		l.status.Done = done
+		l.mu.Unlock()
+	})
+}
+
+// Abort stops the running job, the controller gets a soft reset.
+func (l *Laser) Abort() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.status.Running {
+		return false
+	}
+	l.cancel()
+	return true
+}
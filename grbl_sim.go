@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	grblBanner = "Grbl 1.1h ['$' for help]"
+	// simPlannerBlocks is the size of the motion planner of GRBL on an
+	// Arduino Uno.
+	simPlannerBlocks = 15
+	simRapidRate     = 3000.0 // mm/min
+)
+
+// grblSim answers on a serial line the way a GRBL 1.1 controller does,
+// moves take their real time divided by speedup. It is meant for trying
+// the laser output without a machine: a stream that overflows the receive
+// buffer is logged.
+type grblSim struct {
+	port    io.ReadWriter
+	speedup float64
+	verbose bool
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	rx        int // bytes in the receive buffer
+	planner   []simMove
+	pos       point
+	feed      float64
+	absolute  bool
+	overflows int
+	resets    int
+	// peak is the fullest the receive buffer got.
+	peak int
+	// alarm locks out G-code until $X, as after power up with homing
+	// enabled. A reset does not clear it.
+	alarm bool
+}
+
+// simLine is a received line and the number of resets before it.
+type simLine struct {
+	text   string
+	resets int
+}
+
+type simMove struct {
+	to       point
+	duration time.Duration
+}
+
+func newGrblSim(port io.ReadWriter, speedup float64, verbose bool) *grblSim {
+	sim := &grblSim{port: port, speedup: speedup, verbose: verbose, absolute: true, feed: 100}
+	sim.cond = sync.NewCond(&sim.mu)
+	return sim
+}
+
+func (sim *grblSim) send(line string) {
+	sim.writeMu.Lock()
+	defer sim.writeMu.Unlock()
+	fmt.Fprintf(sim.port, "%s\r\n", line)
+}
+
+// Run reads from the port until it fails. Real time commands are handled
+// at once, lines wait in the receive buffer until the planner has room.
+func (sim *grblSim) Run() error {
+	lines := make(chan simLine, 256)
+	go sim.parse(lines)
+	go sim.move()
+
+	reader := bufio.NewReader(sim.port)
+	line := []byte{}
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '?':
+			sim.send(sim.statusReport())
+			continue
+		case grblSoftReset:
+			sim.reset()
+			line = line[:0]
+			continue
+		case '!', '~':
+			continue
+		case '\r':
+			continue
+		}
+		sim.mu.Lock()
+		sim.rx++
+		sim.peak = max(sim.peak, sim.rx)
+		if sim.rx > grblRxBuffer+1 {
+			sim.overflows++
+			log.Printf("grbl-sim: receive buffer overflow, %d bytes", sim.rx)
+		}
+		resets := sim.resets
+		sim.mu.Unlock()
+		if c != '\n' {
+			line = append(line, c)
+			continue
+		}
+		lines <- simLine{string(line), resets}
+		line = line[:0]
+	}
+}
+
+func (sim *grblSim) reset() {
+	sim.mu.Lock()
+	sim.rx = 0
+	sim.planner = nil
+	sim.resets++
+	sim.cond.Broadcast()
+	sim.mu.Unlock()
+	if sim.verbose {
+		log.Print("grbl-sim: reset")
+	}
+	sim.send("")
+	sim.send(grblBanner)
+}
+
+// parse takes the lines out of the receive buffer as the planner frees up
+// and answers each of them.
+func (sim *grblSim) parse(lines chan simLine) {
+	for line := range lines {
+		sim.mu.Lock()
+		for len(sim.planner) >= simPlannerBlocks && line.resets == sim.resets {
+			sim.cond.Wait()
+		}
+		// a reset throws away the receive buffer
+		if line.resets != sim.resets {
+			sim.mu.Unlock()
+			continue
+		}
+		response := sim.execute(line.text)
+		sim.rx = max(sim.rx-len(line.text)-1, 0)
+		sim.mu.Unlock()
+		if sim.verbose {
+			log.Printf("grbl-sim: %s -> %s", line.text, response)
+		}
+		sim.send(response)
+	}
+}
+
+// execute runs a line of G-code, sim.mu is held.
+func (sim *grblSim) execute(line string) string {
+	line = strings.ToUpper(strings.TrimSpace(line))
+	if line == "$X" {
+		sim.alarm = false
+		return "ok"
+	}
+	if line == "" || strings.HasPrefix(line, "$") {
+		return "ok"
+	}
+	if sim.alarm {
+		return "error:9"
+	}
+	words, err := gcodeWords(line)
+	if err != nil {
+		return "error:1"
+	}
+	motion := -1
+	target := sim.pos
+	if !sim.absolute {
+		target = point{}
+	}
+	hasTarget := false
+	for _, w := range words {
+		switch w.letter {
+		case 'G':
+			switch w.value {
+			case 0, 1:
+				motion = int(w.value)
+			case 90:
+				sim.absolute = true
+			case 91:
+				sim.absolute = false
+			case 17, 20, 21, 54:
+			default:
+				return "error:20"
+			}
+		case 'X':
+			target.X, hasTarget = w.value, true
+		case 'Y':
+			target.Y, hasTarget = w.value, true
+		case 'F':
+			sim.feed = w.value
+		case 'M', 'S', 'Z':
+		default:
+			return "error:20"
+		}
+	}
+	if !sim.absolute {
+		target = point{sim.pos.X + target.X, sim.pos.Y + target.Y}
+	}
+	if hasTarget && motion >= 0 {
+		rate := simRapidRate
+		if motion == 1 {
+			rate = sim.feed
+		}
+		from := sim.pos
+		if n := len(sim.planner); n > 0 {
+			from = sim.planner[n-1].to
+		}
+		distance := math.Hypot(target.X-from.X, target.Y-from.Y)
+		seconds := distance / rate * 60 / sim.speedup
+		sim.planner = append(sim.planner, simMove{to: target, duration: time.Duration(seconds * float64(time.Second))})
+		sim.cond.Broadcast()
+	}
+	return "ok"
+}
+
+type gcodeWord struct {
+	letter byte
+	value  float64
+}
+
+func gcodeWords(line string) ([]gcodeWord, error) {
+	words := []gcodeWord{}
+	line = strings.ReplaceAll(line, " ", "")
+	for i := 0; i < len(line); {
+		letter := line[i]
+		if !unicode.IsLetter(rune(letter)) {
+			return nil, fmt.Errorf("ожидалась буква в %q", line)
+		}
+		j := i + 1
+		for j < len(line) && !unicode.IsLetter(rune(line[j])) {
+			j++
+		}
+		value, err := strconv.ParseFloat(line[i+1:j], 64)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, gcodeWord{letter, value})
+		i = j
+	}
+	return words, nil
+}
+
+// move carries out the planned moves one after another.
+func (sim *grblSim) move() {
+	for {
+		sim.mu.Lock()
+		for len(sim.planner) == 0 {
+			sim.cond.Wait()
+		}
+		m := sim.planner[0]
+		resets := sim.resets
+		sim.mu.Unlock()
+
+		time.Sleep(m.duration)
+
+		sim.mu.Lock()
+		if resets == sim.resets {
+			sim.pos = m.to
+			sim.planner = sim.planner[1:]
+			sim.cond.Broadcast()
+		}
+		sim.mu.Unlock()
+	}
+}
+
+func (sim *grblSim) statusReport() string {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	state := "Idle"
+	switch {
+	case sim.alarm:
+		state = "Alarm"
+	case len(sim.planner) > 0:
+		state = "Run"
+	}
+	return fmt.Sprintf("<%s|MPos:%.3f,%.3f,0.000|Bf:%d,%d|FS:%.0f,0>",
+		state, sim.pos.X, sim.pos.Y, simPlannerBlocks-len(sim.planner), grblRxBuffer+1-sim.rx, sim.feed)
+}
+
+// runGrblSim is the grbl-sim command: it creates a pseudo terminal, prints
+// its name and plays a GRBL controller on it. Set the port of the laser to
+// that name, or to the -link path.
+func runGrblSim(args []string) {
+	flags := flag.NewFlagSet("grbl-sim", flag.ExitOnError)
+	speedup := flags.Float64("speedup", 1, "run moves this many times faster than the machine would")
+	verbose := flags.Bool("v", false, "log every line")
+	link := flags.String("link", "", "also make this symlink to the terminal, e.g. /tmp/grbl")
+	alarm := flags.Bool("alarm", false, "start locked in an alarm until $X")
+	flags.Parse(args)
+	if *speedup <= 0 {
+		log.Fatal("speedup must be positive")
+	}
+
+	master, slave, err := openPty()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer master.Close()
+	defer slave.Close()
+	if *link != "" {
+		os.Remove(*link)
+		if err := os.Symlink(slave.Name(), *link); err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(*link)
+	}
+	fmt.Printf("GRBL simulator on %s\n", slave.Name())
+
+	sim := newGrblSim(master, *speedup, *verbose)
+	sim.alarm = *alarm
+	if err := sim.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startGrblSim plays a GRBL controller on a pseudo terminal and returns the
+// simulator and the device to open.
+func startGrblSim(t *testing.T, speedup float64, alarm bool) (*grblSim, string) {
+	t.Helper()
+	master, slave, err := openPty()
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+	sim := newGrblSim(master, speedup, false)
+	sim.alarm = alarm
+	go sim.Run()
+	return sim, slave.Name()
+}
+
+// runLaser streams the lines to the device and returns the outcome of the
+// job. abortAfter aborts it once that many lines were accepted.
+func runLaser(t *testing.T, device string, lines []string, abortAfter int) (LaserStatus, error) {
+	t.Helper()
+	laser := NewLaser()
+	settings := defaultGrblSettings
+	settings.Device = device
+	result := make(chan error, 1)
+	if err := laser.Start(settings, 1, "101", lines, func(err error) { result <- err }); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case err := <-result:
+			return laser.Status(), err
+		case <-timeout:
+			t.Fatal("job did not finish")
+		case <-time.After(10 * time.Millisecond):
+			if abortAfter > 0 && laser.Status().Done >= abortAfter {
+				laser.Abort()
+				abortAfter = 0
+			}
+		}
+	}
+}
+
+// simStopped tells whether the simulator threw away every move, as a
+// reset does.
+func simStopped(sim *grblSim) bool {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return len(sim.planner) == 0 && sim.resets >= 2
+}
+
+func TestLaserStreamsWithCharacterCounting(t *testing.T) {
+	sim, device := startGrblSim(t, 200, false)
+	lines := []string{"G21", "G90"}
+	for i := 0; i < 300; i++ {
+		lines = append(lines, fmt.Sprintf("G1 X%d.000 Y%d.000 S300 F1000", i%50, i%7))
+	}
+
+	status, err := runLaser(t, device, lines, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Done != len(lines) {
+		t.Errorf("done %d lines, want %d", status.Done, len(lines))
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if sim.overflows > 0 {
+		t.Errorf("receive buffer overflowed %d times", sim.overflows)
+	}
+	// the planner is full most of the time, so the receive buffer should
+	// have held several lines waiting
+	if sim.peak < grblRxBuffer/2 {
+		t.Errorf("at most %d bytes in the receive buffer, flow control did not fill it", sim.peak)
+	}
+	if sim.pos != (point{X: 49, Y: 5}) {
+		t.Errorf("machine at %v, want the end of the program", sim.pos)
+	}
+}
+
+func TestLaserStopsOnErrorReply(t *testing.T) {
+	sim, device := startGrblSim(t, 1, false)
+	lines := []string{"G21", "G90"}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("G1 X%d Y0 S300 F600", 10*(i+1)))
+	}
+	lines[5] = "G99"
+
+	status, err := runLaser(t, device, lines, 0)
+	if err == nil || !strings.Contains(err.Error(), "error:20") {
+		t.Fatalf("got %v, want error:20", err)
+	}
+	if !strings.Contains(status.LastError, "G99") {
+		t.Errorf("last error %q does not name the line", status.LastError)
+	}
+	if !simStopped(sim) {
+		t.Error("the controller was not reset, it keeps running the buffered lines")
+	}
+}
+
+func TestLaserAbortMidJob(t *testing.T) {
+	sim, device := startGrblSim(t, 1, false)
+	lines := []string{"G21", "G90"}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("G1 X%d Y0 S300 F600", 10*(i+1)))
+	}
+
+	status, err := runLaser(t, device, lines, 3)
+	if !errors.Is(err, ErrLaserAborted) {
+		t.Fatalf("got %v, want %v", err, ErrLaserAborted)
+	}
+	if status.Running {
+		t.Error("still running after abort")
+	}
+	if !simStopped(sim) {
+		t.Error("the controller was not reset on abort")
+	}
+}
+
+func TestLaserRefusesToStartInAlarm(t *testing.T) {
+	sim, device := startGrblSim(t, 1, true)
+
+	status, err := runLaser(t, device, []string{"G21", "G1 X10 Y0 F600"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "$X") {
+		t.Fatalf("got %v, want the alarm refused", err)
+	}
+	if status.Done != 0 {
+		t.Errorf("%d lines sent to a locked controller", status.Done)
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if sim.pos != (point{}) {
+		t.Errorf("machine moved to %v", sim.pos)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// point is a position in a glyph or on the plate. Glyphs use units of the
+// capital height, with y pointing up from the baseline.
+type point struct {
+	X, Y float64
+}
+
+type glyph struct {
+	strokes [][]point
+	// width is the inked part, advance adds the spacing to the next glyph.
+	width   float64
+	advance float64
+}
+
+// strokeFont is a single stroke font: the laser follows the lines once
+// instead of filling outlines, which keeps the job short.
+type strokeFont struct {
+	glyphs map[rune]glyph
+}
+
+// builtinGlyphs is a simple font on a 4 by 6 grid. A glyph is made of
+// strokes separated by spaces, a stroke is a run of points written as two
+// characters x and y, '-' stands for -1 below the baseline. Small letters
+// are drawn as capitals.
+var builtinGlyphs = map[rune]string{
+	'A': "0004264440 0343",
+	'B': "00063645443303 3342413000",
+	'C': "4536160501103041",
+	'D': "00062644422000",
+	'E': "46060040 0333",
+	'F': "460600 0333",
+	'G': "45361605011030414323",
+	'H': "0006 4046 0343",
+	'I': "1636 2620 1030",
+	'J': "4641301001",
+	'K': "0006 460340",
+	'L': "060040",
+	'M': "0006234640",
+	'N': "00064046",
+	'O': "100105163645413010",
+	'P': "00063645443303",
+	'Q': "100105163645413010 2240",
+	'R': "00063645443303 2340",
+	'S': "453616050413334241301001",
+	'T': "0646 2620",
+	'U': "060110304146",
+	'V': "062046",
+	'W': "0610233046",
+	'X': "0046 0640",
+	'Y': "062346 2320",
+	'Z': "06460040",
+
+	'0': "100105163645413010",
+	'1': "142620 1030",
+	'2': "05163645440040",
+	'3': "05163645443313 334241301001",
+	'4': "30360242",
+	'5': "460604344341301001",
+	'6': "453616050110304142331302",
+	'7': "064610",
+	'8': "13040516364544331302011030414233",
+	'9': "011030414536160504133344",
+
+	'.':  "2021",
+	',':  "211-",
+	':':  "2021 2425",
+	';':  "211- 2425",
+	'-':  "1333",
+	'+':  "1333 2224",
+	'/':  "0046",
+	'\'': "2624",
+	'"':  "1614 3634",
+	'(':  "36242230",
+	')':  "16242210",
+	'!':  "2622 2021",
+	'?':  "05163645442322 2021",
+	'_':  "0040",
+	'№':  "00064046 5565 5242",
+
+	'А': "0004264440 0343",
+	'Б': "4606003041423303",
+	'В': "00063645443303 3342413000",
+	'Г': "460600",
+	'Д': "000- 404- 0040 10264640",
+	'Е': "46060040 0333",
+	'Ё': "46060040 0333 1718 3738",
+	'Ж': "2620 062300 462340",
+	'З': "05163645443313 334241301001",
+	'И': "06004640",
+	'Й': "06004640 1737",
+	'К': "0006 460340",
+	'Л': "00264640",
+	'М': "0006234640",
+	'Н': "0006 4046 0343",
+	'О': "100105163645413010",
+	'П': "00064640",
+	'Р': "00063645443303",
+	'С': "4536160501103041",
+	'Т': "0646 2620",
+	'У': "0623 462310",
+	'Ф': "150403123243443515 2620",
+	'Х': "0046 0640",
+	'Ц': "06004046 404-",
+	'Ч': "06041343 4640",
+	'Ш': "06004046 2620",
+	'Щ': "06004046 2620 404-",
+	'Ъ': "0616103041423313",
+	'Ы': "06002031322303 4640",
+	'Ь': "06003041423303",
+	'Э': "0516364541301001 1343",
+	'Ю': "0600 0323 36252130414536",
+	'Я': "40461605041343 2300",
+}
+
+const builtinGridHeight = 6.0
+
+func newBuiltinFont() *strokeFont {
+	f := &strokeFont{glyphs: map[rune]glyph{}}
+	for r, def := range builtinGlyphs {
+		g := glyph{}
+		minX, maxX := 4.0, 0.0
+		for _, stroke := range strings.Fields(def) {
+			points := []point{}
+			for i := 0; i+1 < len(stroke); i += 2 {
+				p := point{gridValue(stroke[i]), gridValue(stroke[i+1])}
+				minX, maxX = min(minX, p.X), max(maxX, p.X)
+				points = append(points, p)
+			}
+			g.strokes = append(g.strokes, points)
+		}
+		// glyphs are shifted to the left edge, narrow ones take less room
+		for _, stroke := range g.strokes {
+			for i := range stroke {
+				stroke[i].X = (stroke[i].X - minX) / builtinGridHeight
+				stroke[i].Y /= builtinGridHeight
+			}
+		}
+		g.width = (maxX - minX) / builtinGridHeight
+		g.advance = g.width + 2/builtinGridHeight
+		f.glyphs[r] = g
+	}
+	f.glyphs[' '] = glyph{advance: 4 / builtinGridHeight}
+	return f
+}
+
+func gridValue(c byte) float64 {
+	if c == '-' {
+		return -1
+	}
+	return float64(c - '0')
+}
+
+var (
+	builtinFontOnce sync.Once
+	builtinFont     *strokeFont
+
+	jhfFontsMu sync.Mutex
+	jhfFonts   = map[string]*strokeFont{}
+)
+
+// loadStrokeFont returns the built in font, or the Hershey font from the
+// .jhf file with the built in glyphs filling the gaps, e.g. Cyrillic.
+func loadStrokeFont(path string) (*strokeFont, error) {
+	builtinFontOnce.Do(func() { builtinFont = newBuiltinFont() })
+	if path == "" {
+		return builtinFont, nil
+	}
+	jhfFontsMu.Lock()
+	defer jhfFontsMu.Unlock()
+	if f, ok := jhfFonts[path]; ok {
+		return f, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f, err := parseJHF(file)
+	if err != nil {
+		return nil, fmt.Errorf("шрифт %s: %w", path, err)
+	}
+	for r, g := range builtinFont.glyphs {
+		if _, ok := f.glyphs[r]; !ok {
+			f.glyphs[r] = g
+		}
+	}
+	jhfFonts[path] = f
+	return f, nil
+}
+
+// Hershey glyphs of the simplex fonts have the baseline at 9 and capitals
+// 21 units high, y points down.
+const (
+	jhfBaseline = 9.0
+	jhfCapitals = 21.0
+)
+
+// parseJHF reads a font in the Hershey .jhf format: per glyph a five digit
+// number, a three digit count of coordinate pairs, the left and right
+// bounds and then the coordinates, each a letter counted from 'R'. " R"
+// lifts the pen. Long glyphs continue on the next line. The glyphs of a
+// font file are the printable ASCII characters in order.
+func parseJHF(r io.Reader) (*strokeFont, error) {
+	f := &strokeFont{glyphs: map[rune]glyph{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	code := rune(' ')
+	pending := ""
+	for scanner.Scan() {
+		pending += strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(pending) == "" {
+			pending = ""
+			continue
+		}
+		if len(pending) < 8 {
+			return nil, fmt.Errorf("неверная строка %q", pending)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(pending[5:8]))
+		if err != nil {
+			return nil, fmt.Errorf("неверная строка %q", pending)
+		}
+		if len(pending) < 8+2*count {
+			continue
+		}
+		g, err := parseJHFGlyph(pending[8 : 8+2*count])
+		if err != nil {
+			return nil, err
+		}
+		f.glyphs[code] = g
+		code++
+		pending = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("файл обрывается на середине знака")
+	}
+	if len(f.glyphs) == 0 {
+		return nil, fmt.Errorf("в файле нет знаков")
+	}
+	return f, nil
+}
+
+func parseJHFGlyph(pairs string) (glyph, error) {
+	g := glyph{}
+	if len(pairs) < 2 {
+		return g, fmt.Errorf("знак без границ")
+	}
+	left := float64(int(pairs[0]) - 'R')
+	right := float64(int(pairs[1]) - 'R')
+	g.advance = (right - left) / jhfCapitals
+	g.width = g.advance
+	stroke := []point{}
+	for i := 2; i+1 < len(pairs); i += 2 {
+		if pairs[i:i+2] == " R" {
+			if len(stroke) > 0 {
+				g.strokes = append(g.strokes, stroke)
+			}
+			stroke = []point{}
+			continue
+		}
+		x := float64(int(pairs[i]) - 'R')
+		y := float64(int(pairs[i+1]) - 'R')
+		stroke = append(stroke, point{(x - left) / jhfCapitals, (jhfBaseline - y) / jhfCapitals})
+	}
+	if len(stroke) > 0 {
+		g.strokes = append(g.strokes, stroke)
+	}
+	return g, nil
+}
+
+// glyph returns the glyph of the rune, small letters fall back to capitals
+// and unknown characters to a question mark.
+func (f *strokeFont) glyph(r rune) glyph {
+	if g, ok := f.glyphs[r]; ok {
+		return g
+	}
+	if g, ok := f.glyphs[unicode.ToUpper(r)]; ok {
+		return g
+	}
+	return f.glyphs['?']
+}
+
+// lineWidth is the width of the text in capital heights.
+func (f *strokeFont) lineWidth(s string) float64 {
+	width := 0.0
+	runes := []rune(s)
+	for i, r := range runes {
+		if i == len(runes)-1 {
+			// the last glyph needs no spacing after it
+			width += f.glyph(r).width
+		} else {
+			width += f.glyph(r).advance
+		}
+	}
+	return width
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize limits the size of an uploaded results file.
+const maxImportSize = 20 << 20
+
+type importField struct {
+	Key      string
+	Title    string
+	Required bool
+	Aliases  []string
+}
+
+// importFields lists the Athlete fields a column of an imported file can be
+// mapped to. Aliases are used to guess the mapping from the header row.
+var importFields = []importField{
+	{Key: "bib", Title: "Номер", Required: true, Aliases: []string{"bib", "results_bib", "номер", "стартовый номер", "no", "№"}},
+	{Key: "first_name", Title: "Имя", Aliases: []string{"first name", "firstname", "results_first_name", "имя"}},
+	{Key: "last_name", Title: "Фамилия", Aliases: []string{"last name", "lastname", "surname", "results_last_name", "фамилия"}},
+	{Key: "time", Title: "Чистое время", Required: true, Aliases: []string{"chip time", "net time", "chiptime", "results_time", "чистое время", "time", "время", "результат"}},
+	{Key: "gun_time", Title: "Грязное время", Aliases: []string{"gun time", "guntime", "results_gun_time", "грязное время", "абсолютное время"}},
+	{Key: "race_name", Title: "Дистанция", Aliases: []string{"race", "race name", "distance", "results_race_name", "дистанция", "забег"}},
+	{Key: "sex", Title: "Пол", Aliases: []string{"sex", "gender", "results_sex", "пол"}},
+	{Key: "category", Title: "Категория", Aliases: []string{"category", "division", "age group", "results_primary_bracket_name", "категория", "группа", "возрастная группа"}},
+	{Key: "age", Title: "Возраст", Aliases: []string{"age", "results_age", "возраст"}},
+	{Key: "rank", Title: "Место", Aliases: []string{"place", "rank", "overall", "results_rank", "место", "абс. место"}},
+	{Key: "sex_rank", Title: "Место в поле", Aliases: []string{"gender place", "sex place", "results_sex_rank", "место в поле", "место пол"}},
+	{Key: "category_rank", Title: "Место в категории", Aliases: []string{"category place", "division place", "results_primary_bracket_rank", "место в категории", "место в группе"}},
+	{Key: "status", Title: "Статус", Aliases: []string{"status", "results_status", "статус"}},
+}
+
+// importMapping maps an import field key to a 0-based column, unmapped fields
+// are absent.
+type importMapping map[string]int
+
+// pendingImport is an uploaded table waiting for the operator to confirm the
+// column mapping.
+type pendingImport struct {
+	Token    string
+	Filename string
+	Header   []string
+	Rows     [][]string
+	Excel    bool
+	Created  time.Time
+}
+
+type importIssue struct {
+	Row     int
+	Message string
+}
+
+func guessMapping(header []string) importMapping {
+	m := importMapping{}
+	used := map[int]bool{}
+	for _, f := range importFields {
+		for _, alias := range f.Aliases {
+			for col, name := range header {
+				if !used[col] && strings.EqualFold(strings.TrimSpace(name), alias) {
+					m[f.Key] = col
+					used[col] = true
+					break
+				}
+			}
+			if _, ok := m[f.Key]; ok {
+				break
+			}
+		}
+	}
+	return m
+}
+
+func mappingFromForm(r *http.Request, columns int) importMapping {
+	m := importMapping{}
+	for _, f := range importFields {
+		col, err := strconv.Atoi(r.PostFormValue("map_" + f.Key))
+		if err == nil && col >= 0 && col < columns {
+			m[f.Key] = col
+		}
+	}
+	return m
+}
+
+func (p *pendingImport) cell(row []string, m importMapping, key string) string {
+	col, ok := m[key]
+	if !ok || col >= len(row) {
+		return ""
+	}
+	value := strings.TrimSpace(row[col])
+	if p.Excel && (key == "time" || key == "gun_time") {
+		value = excelTime(value)
+	}
+	return value
+}
+
+// athletes converts the data rows with mapping m. Rows that cannot be stored
+// or would fail time formatting later are skipped and reported as issues,
+// row numbers are as shown in a spreadsheet.
+func (p *pendingImport) athletes(m importMapping) ([]Athlete, []importIssue) {
+	athletes := []Athlete{}
+	issues := []importIssue{}
+	for _, f := range importFields {
+		if _, ok := m[f.Key]; f.Required && !ok {
+			issues = append(issues, importIssue{Message: fmt.Sprintf("не выбрана колонка для поля «%s»", f.Title)})
+		}
+	}
+	if len(issues) > 0 {
+		return athletes, issues
+	}
+
+	seen := map[string]int{}
+	for i, row := range p.Rows {
+		rowNum := i + 2
+		a := Athlete{
+			ResultsBib:          p.cell(row, m, "bib"),
+			ResultsFirstName:    p.cell(row, m, "first_name"),
+			ResultsLastName:     p.cell(row, m, "last_name"),
+			ResultsTime:         p.cell(row, m, "time"),
+			ResultsGunTime:      p.cell(row, m, "gun_time"),
+			ResultsRaceName:     p.cell(row, m, "race_name"),
+			ResultsSex:          p.cell(row, m, "sex"),
+			ResultsCategory:     p.cell(row, m, "category"),
+			ResultsStatus:       p.cell(row, m, "status"),
+			ResultsAge:          p.cell(row, m, "age"),
+			ResultsRank:         p.cell(row, m, "rank"),
+			ResultsSexRank:      p.cell(row, m, "sex_rank"),
+			ResultsCategoryRank: p.cell(row, m, "category_rank"),
+		}
+		a.normalizeStatus()
+		if a.ResultsBib == "" {
+			if strings.TrimSpace(strings.Join(row, "")) != "" {
+				issues = append(issues, importIssue{Row: rowNum, Message: "нет стартового номера"})
+			}
+			continue
+		}
+		if prev, ok := seen[a.ResultsBib]; ok {
+			issues = append(issues, importIssue{Row: rowNum, Message: fmt.Sprintf("номер %s уже был в строке %d", a.ResultsBib, prev)})
+			continue
+		}
+		if a.ResultsFirstName == "" && a.ResultsLastName == "" {
+			issues = append(issues, importIssue{Row: rowNum, Message: fmt.Sprintf("номер %s: нет имени и фамилии", a.ResultsBib)})
+			continue
+		}
+		// DNF, DNS and DSQ rows are kept without a time, they are shown
+		// and refused at the queue
+		if a.Blocked() && a.ResultsStatus != StatusNone {
+			seen[a.ResultsBib] = rowNum
+			athletes = append(athletes, a)
+			continue
+		}
+		if _, err := processTimeStr(a.ResultsTime); err != nil {
+			issues = append(issues, importIssue{Row: rowNum, Message: fmt.Sprintf("номер %s: неверное время %q", a.ResultsBib, a.ResultsTime)})
+			continue
+		}
+		if a.ResultsGunTime == "" {
+			a.ResultsGunTime = a.ResultsTime
+		} else if _, err := processTimeStr(a.ResultsGunTime); err != nil {
+			issues = append(issues, importIssue{Row: rowNum, Message: fmt.Sprintf("номер %s: неверное грязное время %q", a.ResultsBib, a.ResultsGunTime)})
+			continue
+		}
+		seen[a.ResultsBib] = rowNum
+		athletes = append(athletes, a)
+	}
+	return athletes, issues
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *APIServer) addPendingImport(p *pendingImport) {
+	s.importsMu.Lock()
+	defer s.importsMu.Unlock()
+	for token, old := range s.imports {
+		if time.Since(old.Created) > time.Hour {
+			delete(s.imports, token)
+		}
+	}
+	s.imports[p.Token] = p
+}
+
+func (s *APIServer) pendingImport(token string) *pendingImport {
+	s.importsMu.Lock()
+	defer s.importsMu.Unlock()
+	return s.imports[token]
+}
+
+func (s *APIServer) HandleImportUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		alertDangerResponse(w, "Файл не загружен", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		alertDangerResponse(w, "Файл не загружен", fmt.Sprintf("Ошибка %s", err))
+		return
+	}
+
+	rows, excel, err := readTable(header.Filename, data)
+	if err != nil {
+		alertDangerResponse(w, "Не удалось прочитать файл", html.EscapeString(err.Error()))
+		return
+	}
+	if len(rows) < 2 {
+		alertDangerResponse(w, "Не удалось прочитать файл", "В файле нет строк с результатами")
+		return
+	}
+
+	p := &pendingImport{
+		Token:    newToken(),
+		Filename: header.Filename,
+		Header:   rows[0],
+		Rows:     rows[1:],
+		Excel:    excel,
+		Created:  time.Now(),
+	}
+	s.addPendingImport(p)
+	renderImportPreview(w, p, guessMapping(p.Header))
+}
+
+func (s *APIServer) HandleImportPreview(w http.ResponseWriter, r *http.Request) {
+	p := s.pendingImport(r.PostFormValue("token"))
+	if p == nil {
+		alertDangerResponse(w, "Импорт не найден", "Загрузите файл ещё раз")
+		return
+	}
+	renderImportPreview(w, p, mappingFromForm(r, len(p.Header)))
+}
+
+func (s *APIServer) HandleImportApply(w http.ResponseWriter, r *http.Request) {
+	p := s.pendingImport(r.PostFormValue("token"))
+	if p == nil {
+		alertDangerResponse(w, "Импорт не найден", "Загрузите файл ещё раз")
+		return
+	}
+	eventID := s.activeEventID()
+	if eventID == "" {
+		alertDangerResponse(w, "Соревнование не выбрано", "Добавьте соревнование в разделе 'Настройка соревнования'")
+		return
+	}
+	athletes, issues := p.athletes(mappingFromForm(r, len(p.Header)))
+	if len(athletes) == 0 {
+		alertDangerResponse(w, "Нечего импортировать", "Проверьте соответствие колонок")
+		return
+	}
+	stats, err := s.store.CreateBulkRecords(eventID, &athletes)
+	if err != nil {
+		alertDangerResponse(w, "Ошибка импорта", html.EscapeString(err.Error()))
+		return
+	}
+	s.store.Checkpoint()
+	s.notify(w, r, StreamQueue, StreamHistory)
+
+	s.importsMu.Lock()
+	delete(s.imports, p.Token)
+	s.importsMu.Unlock()
+
+	htmlStr := fmt.Sprintf(`
+		<div class="alert alert-info" role="alert">
+		<h4 class="alert-heading">Импорт из %s завершён</h4>
+		<p>%d новых, %d изменено, пропущено строк: %d.</p>
+		%s
+		</div>
+	`, html.EscapeString(p.Filename), stats.New, stats.Changed, len(issues), engravedChangedNote(stats.EngravedChanged))
+	fmt.Fprint(w, htmlStr)
+}
+
+// importPreviewRows is how many mapped rows are shown before importing.
+const importPreviewRows = 10
+
+var importPreviewTmpl = template.Must(template.New("import-preview").Parse(`
+	<form hx-post="/import/preview" hx-trigger="change" hx-target="#import-area" hx-swap="innerHTML">
+	<input type="hidden" name="token" value="{{ .Token }}">
+	<p><strong>{{ .Filename }}</strong>: строк с данными {{ .RowCount }}</p>
+	<div class="row g-2 mb-3">
+	{{ range .Fields }}
+		<div class="col-md-3">
+		<label class="form-label small">{{ .Title }}{{ if .Required }} *{{ end }}</label>
+		<select class="form-select form-select-sm" name="map_{{ .Key }}">
+			<option value="-1">—</option>
+			{{ $selected := .Column }}
+			{{ range $i, $name := $.Header }}
+			<option value="{{ $i }}" {{ if eq $i $selected }}selected{{ end }}>{{ $name }}</option>
+			{{ end }}
+		</select>
+		</div>
+	{{ end }}
+	</div>
+
+	<table class="table table-sm small">
+		<thead><tr>{{ range .Fields }}<th>{{ .Title }}</th>{{ end }}</tr></thead>
+		<tbody>
+		{{ range .Preview }}
+		<tr>
+			<td>{{ .ResultsBib }}</td><td>{{ .ResultsFirstName }}</td><td>{{ .ResultsLastName }}</td>
+			<td>{{ .ResultsTime }}</td><td>{{ .ResultsGunTime }}</td><td>{{ .ResultsRaceName }}</td>
+			<td>{{ .ResultsSex }}</td><td>{{ .ResultsCategory }}</td>
+			<td>{{ .ResultsAge }}</td><td>{{ .ResultsRank }}</td><td>{{ .ResultsSexRank }}</td><td>{{ .ResultsCategoryRank }}</td><td>{{ .ResultsStatus }}</td>
+		</tr>
+		{{ end }}
+		</tbody>
+	</table>
+
+	{{ if .Issues }}
+	<div class="alert alert-warning small" role="alert">
+		<p><strong>Будет пропущено строк: {{ len .Issues }}</strong></p>
+		<ul class="mb-0">
+		{{ range .ShownIssues }}
+		<li>{{ if .Row }}Строка {{ .Row }}: {{ end }}{{ .Message }}</li>
+		{{ end }}
+		</ul>
+	</div>
+	{{ end }}
+
+	<button type="button" class="btn btn-primary" hx-post="/import/apply" hx-include="closest form" hx-target="#import-area" hx-swap="innerHTML" {{ if not .Valid }}disabled{{ end }}>
+		Импортировать {{ .Valid }} записей
+	</button>
+	<div class="form-text">Повторный импорт обновит уже загруженные номера.</div>
+	</form>
+`))
+
+func renderImportPreview(w http.ResponseWriter, p *pendingImport, m importMapping) {
+	type field struct {
+		importField
+		Column int
+	}
+	fields := []field{}
+	for _, f := range importFields {
+		col, ok := m[f.Key]
+		if !ok {
+			col = -1
+		}
+		fields = append(fields, field{importField: f, Column: col})
+	}
+
+	athletes, issues := p.athletes(m)
+	preview := athletes[:min(len(athletes), importPreviewRows)]
+	shownIssues := issues[:min(len(issues), 50)]
+
+	data := map[string]any{
+		"Token":       p.Token,
+		"Filename":    p.Filename,
+		"RowCount":    len(p.Rows),
+		"Header":      p.Header,
+		"Fields":      fields,
+		"Preview":     preview,
+		"Issues":      issues,
+		"ShownIssues": shownIssues,
+		"Valid":       len(athletes),
+	}
+	if err := importPreviewTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
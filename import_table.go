@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// readTable reads an uploaded CSV or XLSX file into rows of cells. The first
+// row is expected to hold the column headers.
+func readTable(filename string, data []byte) (rows [][]string, excel bool, err error) {
+	if strings.EqualFold(path.Ext(filename), ".xlsx") || bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		rows, err = readXLSX(data)
+		return rows, true, err
+	}
+	rows, err = readCSV(data)
+	return rows, false, err
+}
+
+// readCSV reads a CSV file exported by timing software or Excel. The
+// delimiter is guessed from the header line and files that are not valid
+// UTF-8 are decoded as Windows-1251, the default of Russian Excel.
+func readCSV(data []byte) ([][]string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		data = decodeCP1251(data)
+	}
+
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	delimiter := ','
+	best := bytes.Count(header, []byte(","))
+	for _, d := range []rune{';', '\t'} {
+		if n := bytes.Count(header, []byte(string(d))); n > best {
+			delimiter, best = d, n
+		}
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = delimiter
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	return r.ReadAll()
+}
+
+// cp1251High maps the bytes 0x80-0xBF of Windows-1251, 0xC0-0xFF are А-я.
+var cp1251High = [64]rune{
+	'Ђ', 'Ѓ', '‚', 'ѓ', '„', '…', '†', '‡', '€', '‰', 'Љ', '‹', 'Њ', 'Ќ', 'Ћ', 'Џ',
+	'ђ', '‘', '’', '“', '”', '•', '–', '—', '\ufffd', '™', 'љ', '›', 'њ', 'ќ', 'ћ', 'џ',
+	'\u00a0', 'Ў', 'ў', 'Ј', '¤', 'Ґ', '¦', '§', 'Ё', '©', 'Є', '«', '¬', '\u00ad', '®', 'Ї',
+	'°', '±', 'І', 'і', 'ґ', 'µ', '¶', '·', 'ё', '№', 'є', '»', 'ј', 'Ѕ', 'ѕ', 'ї',
+}
+
+func decodeCP1251(data []byte) []byte {
+	var b strings.Builder
+	b.Grow(len(data) * 2)
+	for _, c := range data {
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xC0:
+			b.WriteRune(cp1251High[c-0x80])
+		default:
+			b.WriteRune(rune('А') + rune(c-0xC0))
+		}
+	}
+	return []byte(b.String())
+}
+
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"is"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []xlsxCell `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// xlsxWorkbook lists the sheets in the order of their tabs. Each names its
+// part through a relationship, the part names need not follow the order.
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name  string `xml:"name,attr"`
+		RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Items []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSharedStrings struct {
+	Items []struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+// readXLSX reads the first worksheet of an Excel workbook. Only cell values
+// are read, numbers are returned as stored, e.g. times as fractions of a day.
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("файл не является книгой Excel: %w", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var shared []string
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		sst := xlsxSharedStrings{}
+		if err := decodeZipXML(f, &sst); err != nil {
+			return nil, err
+		}
+		for _, item := range sst.Items {
+			text := item.Text
+			for _, run := range item.Runs {
+				text += run.Text
+			}
+			shared = append(shared, text)
+		}
+	}
+
+	sheetFile, err := xlsxFirstSheet(files)
+	if err != nil {
+		return nil, err
+	}
+	sheet := xlsxSheet{}
+	if err := decodeZipXML(sheetFile, &sheet); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, row := range sheet.Rows {
+		cells := []string{}
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col = xlsxColumn(c.Ref)
+			}
+			if col < 0 || col >= xlsxMaxColumns {
+				return nil, fmt.Errorf("неверная ссылка на ячейку %q", c.Ref)
+			}
+			for len(cells) <= col {
+				cells = append(cells, "")
+			}
+			switch c.Type {
+			case "s":
+				idx, err := strconv.Atoi(c.Value)
+				if err == nil && idx >= 0 && idx < len(shared) {
+					cells[col] = shared[idx]
+				}
+			case "inlineStr":
+				text := c.Inline.Text
+				for _, run := range c.Inline.Runs {
+					text += run.Text
+				}
+				cells[col] = text
+			default:
+				cells[col] = c.Value
+			}
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
+}
+
+// xlsxFirstSheet finds the part of the first tab of the workbook. Without
+// the workbook part sheet1.xml is taken.
+func xlsxFirstSheet(files map[string]*zip.File) (*zip.File, error) {
+	workbookFile, ok := files["xl/workbook.xml"]
+	relsFile, relsOK := files["xl/_rels/workbook.xml.rels"]
+	if !ok || !relsOK {
+		if f, ok := files["xl/worksheets/sheet1.xml"]; ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("в книге Excel нет листов")
+	}
+	workbook := xlsxWorkbook{}
+	if err := decodeZipXML(workbookFile, &workbook); err != nil {
+		return nil, err
+	}
+	rels := xlsxRelationships{}
+	if err := decodeZipXML(relsFile, &rels); err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return nil, fmt.Errorf("в книге Excel нет листов")
+	}
+	first := workbook.Sheets[0]
+	for _, rel := range rels.Items {
+		if rel.ID != first.RelID {
+			continue
+		}
+		// targets are relative to xl/ unless they start at the root
+		name := path.Join("xl", rel.Target)
+		if strings.HasPrefix(rel.Target, "/") {
+			name = strings.TrimPrefix(rel.Target, "/")
+		}
+		if f, ok := files[name]; ok {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("в книге Excel не найден лист «%s»", first.Name)
+}
+
+// xlsxMaxEntrySize limits a part of the workbook once unpacked, a small
+// upload could unpack to gigabytes otherwise.
+const xlsxMaxEntrySize = 64 << 20
+
+func decodeZipXML(f *zip.File, v any) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, xlsxMaxEntrySize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > xlsxMaxEntrySize {
+		return fmt.Errorf("книга Excel слишком большая: %s больше %d МБ", f.Name, xlsxMaxEntrySize>>20)
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// xlsxMaxColumns is the width of an Excel sheet, the last column is XFD.
+const xlsxMaxColumns = 16384
+
+// xlsxColumn converts a cell reference such as "AB12" to a 0-based column,
+// -1 when the reference has no column or one past the edge of the sheet.
+func xlsxColumn(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+		if col > xlsxMaxColumns {
+			return -1
+		}
+	}
+	return col - 1
+}
+
+// excelTime converts an Excel time stored as a fraction of a day into the
+// HH:MM:SS.fff form used by the result sources. A day or more, as in ultra
+// races, goes past 24 hours. Other values are returned unchanged.
+func excelTime(value string) string {
+	if strings.Contains(value, ":") {
+		return value
+	}
+	days, err := strconv.ParseFloat(value, 64)
+	if err != nil || days < 0 {
+		return value
+	}
+	ms := int64(days*86400000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildXLSX packs the parts into a workbook.
+func buildXLSX(t *testing.T, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const (
+	testWorkbook = `<?xml version="1.0" encoding="UTF-8"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Итоги" sheetId="10" r:id="rId10"/><sheet name="Черновик" sheetId="2" r:id="rId2"/></sheets>
+</workbook>`
+	testWorkbookRels = `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/sheet10.xml"/>
+<Relationship Id="rId10" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet2.xml"/>
+</Relationships>`
+	testSharedStrings = `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>bib</t></si><si><t>name</t></si><si><r><t>Ан</t></r><r><t>на</t></r></si>
+</sst>`
+	testSheet = `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="AB1" t="inlineStr"><is><t>time</t></is></c></row>
+<row r="2"><c r="A2"><v>101</v></c><c r="B2" t="s"><v>2</v></c><c r="AB2"><v>0.5</v></c></row>
+</sheetData></worksheet>`
+	testOtherSheet = `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="inlineStr"><is><t>draft</t></is></c></row>
+</sheetData></worksheet>`
+)
+
+func TestReadXLSX(t *testing.T) {
+	wide := func(last string) []string {
+		row := make([]string, 28)
+		row[27] = last
+		return row
+	}
+	header := wide("time")
+	header[0], header[1] = "bib", "name"
+	result := wide("0.5")
+	result[0], result[1] = "101", "Анна"
+
+	tests := []struct {
+		name    string
+		parts   map[string]string
+		want    [][]string
+		wantErr string
+	}{
+		{
+			name: "first tab, not the first file name",
+			parts: map[string]string{
+				"xl/workbook.xml":            testWorkbook,
+				"xl/_rels/workbook.xml.rels": testWorkbookRels,
+				"xl/sharedStrings.xml":       testSharedStrings,
+				"xl/worksheets/sheet2.xml":   testSheet,
+				"xl/worksheets/sheet10.xml":  testOtherSheet,
+			},
+			want: [][]string{header, result},
+		},
+		{
+			name: "no workbook part",
+			parts: map[string]string{
+				"xl/worksheets/sheet1.xml": testOtherSheet,
+			},
+			want: [][]string{{"draft"}},
+		},
+		{
+			name: "missing sheet part",
+			parts: map[string]string{
+				"xl/workbook.xml":            testWorkbook,
+				"xl/_rels/workbook.xml.rels": testWorkbookRels,
+				"xl/worksheets/sheet10.xml":  testOtherSheet,
+			},
+			wantErr: "не найден лист «Итоги»",
+		},
+		{
+			name: "reference past XFD",
+			parts: map[string]string{
+				"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row><c r="XFE1"><v>1</v></c></row></sheetData></worksheet>`,
+			},
+			wantErr: `"XFE1"`,
+		},
+		{
+			name: "unpacked part too large",
+			parts: map[string]string{
+				"xl/sharedStrings.xml":     "<sst>" + strings.Repeat(" ", xlsxMaxEntrySize) + "</sst>",
+				"xl/worksheets/sheet1.xml": testOtherSheet,
+			},
+			wantErr: "слишком большая",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, excel, err := readTable("results.xlsx", buildXLSX(t, tt.parts))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readTable() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !excel {
+				t.Error("readTable() did not report an Excel file")
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("readTable() = %q, want %q", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want int
+	}{
+		{"A1", 0},
+		{"Z9", 25},
+		{"AA1", 26},
+		{"AZ1", 51},
+		{"BA1", 52},
+		{"ZZ1", 701},
+		{"AAA1", 702},
+		{"XFD1048576", 16383},
+		{"XFE1", -1},
+		{"AAAA1", -1},
+		{"12", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := xlsxColumn(tt.ref); got != tt.want {
+			t.Errorf("xlsxColumn(%q) = %d, want %d", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestExcelTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"0", "00:00:00.000"},
+		{"0.5", "12:00:00.000"},
+		{"0.0278356481481481", "00:40:05.000"},
+		{"0.02783680555", "00:40:05.100"},
+		{"1.25", "30:00:00.000"},
+		{"2.0006944444444444", "48:01:00.000"},
+		{"0:40:05", "0:40:05"},
+		{"DNF", "DNF"},
+		{"-0.5", "-0.5"},
+	}
+	for _, tt := range tests {
+		if got := excelTime(tt.value); got != tt.want {
+			t.Errorf("excelTime(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]string
+	}{
+		{
+			name: "comma",
+			data: []byte("bib,name\n101,Anna\n"),
+			want: [][]string{{"bib", "name"}, {"101", "Anna"}},
+		},
+		{
+			name: "utf-8 with BOM and semicolons",
+			data: []byte("\xef\xbb\xbfномер;имя\n101;Анна, Мария\n"),
+			want: [][]string{{"номер", "имя"}, {"101", "Анна, Мария"}},
+		},
+		{
+			name: "windows-1251",
+			// "номер;имя\n101;Ёлкина №1\n"
+			data: []byte("\xed\xee\xec\xe5\xf0;\xe8\xec\xff\n101;\xa8\xeb\xea\xe8\xed\xe0 \xb91\n"),
+			want: [][]string{{"номер", "имя"}, {"101", "Ёлкина №1"}},
+		},
+		{
+			name: "tabs",
+			data: []byte("bib\tname\ttime\n101\t\"Anna\"\t0:40:05\n"),
+			want: [][]string{{"bib", "name", "time"}, {"101", "Anna", "0:40:05"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, excel, err := readTable("results.csv", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if excel {
+				t.Error("readTable() reported an Excel file")
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("readTable() = %q, want %q", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingImportAthletes(t *testing.T) {
+	p := &pendingImport{
+		Header: []string{"bib", "name", "surname", "time", "status"},
+		Rows: [][]string{
+			{"101", "Анна", "Иванова", "0.0278356481481481", ""},
+			{"102", "Иван", "Петров", "", "DNF"},
+			{"101", "Анна", "Повтор", "0.03", ""},
+			{"", "", "", "", ""},
+			{"", "Без", "Номера", "0.03", ""},
+			{"103", "", "", "0.03", ""},
+			{"104", "Олег", "Сидоров", "abc", ""},
+		},
+		Excel: true,
+	}
+	m := importMapping{"bib": 0, "first_name": 1, "last_name": 2, "time": 3, "status": 4}
+	athletes, issues := p.athletes(m)
+
+	bibs := []string{}
+	for _, a := range athletes {
+		bibs = append(bibs, a.ResultsBib)
+	}
+	if want := []string{"101", "102"}; !reflect.DeepEqual(bibs, want) {
+		t.Fatalf("imported %v, want %v", bibs, want)
+	}
+	if a := athletes[0]; a.ResultsTime != "00:40:05.000" || a.ResultsGunTime != a.ResultsTime {
+		t.Errorf("times of 101 = %q, %q, want the converted chip time for both", a.ResultsTime, a.ResultsGunTime)
+	}
+	if a := athletes[1]; a.ResultsStatus != StatusDNF {
+		t.Errorf("status of 102 = %q, want %q", a.ResultsStatus, StatusDNF)
+	}
+	rows := []int{}
+	for _, issue := range issues {
+		rows = append(rows, issue.Row)
+	}
+	if want := []int{4, 6, 7, 8}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("issues in rows %v, want %v: %v", rows, want, issues)
+	}
+
+	if _, issues := p.athletes(importMapping{"bib": 0}); len(issues) != 1 || issues[0].Row != 0 {
+		t.Errorf("without a time column: issues %v, want one for the mapping", issues)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// startLaserJob sends the plaque of a queued job to the laser. The job
+// moves to engraving now and to engraved or failed when the laser stops,
+// the plaque is recorded as engraved by the operator at the station.
+func (s *APIServer) startLaserJob(id int, by Stamp) (*QueueJob, error) {
+	job, err := s.store.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != JobQueued && job.Status != JobEngraving {
+		return nil, fmt.Errorf("%w: задание «%s»", ErrJobTransition, job.Status.Title())
+	}
+	settings := s.grblSettings()
+	if settings.Device == "" {
+		return nil, ErrLaserOff
+	}
+	if s.laser.Status().Running {
+		return nil, ErrLaserBusy
+	}
+	lines, err := s.engravingGCode(job.Athlete, settings)
+	if err != nil {
+		return nil, err
+	}
+	wasQueued := job.Status == JobQueued
+	if wasQueued {
+		if job, err = s.store.UpdateJobStatus(id, JobEngraving, "", by); err != nil {
+			return nil, err
+		}
+	}
+	err = s.laser.Start(settings, id, job.Athlete.ResultsBib, lines, func(err error) {
+		status, reason := JobEngraved, ""
+		if err != nil {
+			status, reason = JobFailed, err.Error()
+		}
+		if _, err := s.store.UpdateJobStatus(id, status, reason, by); err != nil {
+			fmt.Println("error", err)
+		}
+		s.stream.publish("", StreamQueue, StreamHistory)
+	})
+	if err != nil {
+		if wasQueued {
+			s.store.UpdateJobStatus(id, JobQueued, "", by)
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *APIServer) HandleLaserJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		alertDangerResponse(w, "Лазер не запущен", "Неверный номер задания")
+		return
+	}
+	if _, err := s.startLaserJob(id, stamp(r)); err != nil {
+		alertDangerResponse(w, "Лазер не запущен", html.EscapeString(err.Error()))
+		return
+	}
+	s.notify(w, r, StreamQueue)
+}
+
+func (s *APIServer) HandleLaserAbort(w http.ResponseWriter, r *http.Request) {
+	if !s.laser.Abort() {
+		alertDangerResponse(w, "Нечего прерывать", "Лазер не работает")
+	}
+}
+
+var laserStatusTmpl = template.Must(template.New("laser").Parse(`
+	<div id="laser-status" class="small mb-2" hx-get="/laser/status" hx-trigger="laser from:body, stream:laser from:body" hx-swap="outerHTML">
+		{{ if not .Device }}
+		<span class="text-muted">Лазер GRBL не подключён</span>
+		{{ else if .Status.Running }}
+		Лазер: №{{ .Status.Bib }}, {{ .Status.Done }} из {{ .Status.Lines }} строк
+		{{ if .Status.Grbl }}<code>{{ .Status.Grbl }}</code>{{ end }}
+		<button type="button" class="btn btn-sm btn-danger" hx-post="/laser/abort" hx-target="#notification" hx-swap="innerHTML">Прервать</button>
+		{{ else }}
+		Лазер свободен ({{ .Device }})
+		{{ if .Status.LastError }}<span class="text-danger">Последняя ошибка: {{ .Status.LastError }}</span>{{ end }}
+		{{ end }}
+	</div>
+`))
+
+// HandleLaserStatus is reloaded by the page whenever the laser reports,
+// see StreamLaser.
+func (s *APIServer) HandleLaserStatus(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"Device": s.grblSettings().Device,
+		"Status": s.laser.Status(),
+	}
+	if err := laserStatusTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// HandleExportGCode downloads the program the laser would get for the
+// athlete.
+func (s *APIServer) HandleExportGCode(w http.ResponseWriter, r *http.Request) {
+	eventID := r.FormValue("event")
+	if eventID == "" {
+		eventID = s.activeEventID()
+	}
+	bib := r.FormValue("bib")
+	a, err := s.store.GetRecordByBib(eventID, bib)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Участник %s не найден", bib), http.StatusNotFound)
+		return
+	}
+	lines, err := s.engravingGCode(a, s.grblSettings())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeGCode(w, a.ResultsBib, lines)
+}
+
+func writeGCode(w http.ResponseWriter, bib string, lines []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.nc"`, bib))
+	fmt.Fprint(w, strings.Join(lines, "\n")+"\n")
+}
+
+var grblSettingsTmpl = template.Must(template.New("grbl").Parse(`
+	<form hx-post="/laser/settings" hx-target="#laser-settings" hx-swap="innerHTML">
+		<div class="row g-2">
+			<div class="col-sm-6">
+				<label class="form-label small">Порт</label>
+				<input type="text" class="form-control" name="device" placeholder="/dev/ttyUSB0, пусто — выключено" value="{{ .Settings.Device }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Скорость порта</label>
+				<input type="number" class="form-control" name="baud" value="{{ .Settings.Baud }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Проходов</label>
+				<input type="number" class="form-control" name="passes" min="1" max="20" value="{{ .Settings.Passes }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Мощность S</label>
+				<input type="number" class="form-control" name="power" min="1" value="{{ .Settings.Power }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Максимум S ($30)</label>
+				<input type="number" class="form-control" name="max_power" min="1" value="{{ .Settings.MaxPower }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Скорость, мм/мин</label>
+				<input type="number" class="form-control" name="speed" min="1" value="{{ .Settings.Speed }}">
+			</div>
+			<div class="col-sm-3"></div>
+			<div class="col-sm-3">
+				<label class="form-label small">Начало X, мм</label>
+				<input type="number" class="form-control" name="origin_x" step="0.1" value="{{ .Settings.OriginX }}">
+			</div>
+			<div class="col-sm-3">
+				<label class="form-label small">Начало Y, мм</label>
+				<input type="number" class="form-control" name="origin_y" step="0.1" value="{{ .Settings.OriginY }}">
+			</div>
+			<div class="col-sm-6">
+				<label class="form-label small">Шрифт Hershey (.jhf)</label>
+				<input type="text" class="form-control" name="font" placeholder="пусто — встроенный" value="{{ .Settings.Font }}">
+			</div>
+		</div>
+		<div class="form-text">
+			Размер и выравнивание текста берутся из макета таблички. Начало — левый нижний угол таблички на столе.
+			Контроллер должен быть в режиме лазера ($32=1). Для проверки без станка: <code>golaser grbl-sim -link /tmp/grbl</code>.
+		</div>
+		<button type="submit" class="btn btn-primary mt-2">Сохранить</button>
+		{{ if .Message }}<span class="ms-2 text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="mt-2 text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+`))
+
+func (s *APIServer) renderGrblSettings(w http.ResponseWriter, settings GrblSettings, message string, errText string) {
+	data := map[string]any{
+		"Settings": settings,
+		"Message":  message,
+		"Error":    errText,
+	}
+	if err := grblSettingsTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleGetGrblSettings(w http.ResponseWriter, r *http.Request) {
+	s.renderGrblSettings(w, s.grblSettings(), "", "")
+}
+
+func (s *APIServer) HandleSaveGrblSettings(w http.ResponseWriter, r *http.Request) {
+	number := func(name string) float64 {
+		v, _ := strconv.ParseFloat(strings.Replace(r.PostFormValue(name), ",", ".", 1), 64)
+		return v
+	}
+	integer := func(name string) int {
+		v, _ := strconv.Atoi(r.PostFormValue(name))
+		return v
+	}
+	settings := GrblSettings{
+		Device:   strings.TrimSpace(r.PostFormValue("device")),
+		Baud:     integer("baud"),
+		Power:    integer("power"),
+		MaxPower: integer("max_power"),
+		Speed:    integer("speed"),
+		Passes:   integer("passes"),
+		OriginX:  number("origin_x"),
+		OriginY:  number("origin_y"),
+		Font:     strings.TrimSpace(r.PostFormValue("font")),
+	}
+	if err := settings.validate(); err != nil {
+		s.renderGrblSettings(w, settings, "", err.Error())
+		return
+	}
+	if err := s.saveGrblSettings(settings); err != nil {
+		s.renderGrblSettings(w, settings, "", fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.notify(w, r, StreamQueue, StreamConfig, StreamLaser)
+	s.renderGrblSettings(w, settings, "Настройки сохранены", "")
+}
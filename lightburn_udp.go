@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lightburnBridgeKey = "lightburn_bridge"
+
+var (
+	ErrLightBurnOff     = errors.New("связь с LightBurn выключена")
+	ErrLightBurnTimeout = errors.New("LightBurn не ответил")
+	ErrLightBurnRefused = errors.New("LightBurn отказал")
+)
+
+// LightBurnBridge drives a running LightBurn through its UDP command port:
+// commands go to CommandPort, LightBurn answers to ReplyPort on this host.
+type LightBurnBridge struct {
+	Enabled     bool   `json:"enabled"`
+	Host        string `json:"host"`
+	CommandPort int    `json:"command_port"`
+	ReplyPort   int    `json:"reply_port"`
+	// TimeoutMs is how long to wait for LightBurn to answer a command.
+	TimeoutMs int `json:"timeout_ms"`
+	// Dir is where the files are written, LightBurn has to see it.
+	Dir string `json:"dir"`
+	// Force loads the file even when the open project has unsaved changes.
+	Force bool `json:"force"`
+	// Start runs the job right after loading.
+	Start bool `json:"start"`
+}
+
+var defaultLightBurnBridge = LightBurnBridge{
+	Host:        "127.0.0.1",
+	CommandPort: 19840,
+	ReplyPort:   19841,
+	TimeoutMs:   3000,
+	Dir:         filepath.Join(os.TempDir(), "golaser"),
+}
+
+func (b *LightBurnBridge) validate() error {
+	if b.Host == "" {
+		b.Host = defaultLightBurnBridge.Host
+	}
+	if b.CommandPort <= 0 || b.CommandPort > 65535 || b.ReplyPort <= 0 || b.ReplyPort > 65535 {
+		return fmt.Errorf("неверный номер порта")
+	}
+	if b.TimeoutMs <= 0 {
+		b.TimeoutMs = defaultLightBurnBridge.TimeoutMs
+	}
+	if b.Dir == "" {
+		b.Dir = defaultLightBurnBridge.Dir
+	}
+	return nil
+}
+
+func (s *APIServer) lightburnBridge() LightBurnBridge {
+	bridge := defaultLightBurnBridge
+	if err := loadJSONSetting(s.store, lightburnBridgeKey, &bridge); err != nil {
+		fmt.Println("error", err)
+		return defaultLightBurnBridge
+	}
+	return bridge
+}
+
+func (s *APIServer) saveLightBurnBridge(bridge LightBurnBridge) error {
+	return saveJSONSetting(s.store, lightburnBridgeKey, bridge)
+}
+
+// lightburnMu keeps commands from different requests apart, they share the
+// reply port.
+var lightburnMu sync.Mutex
+
+// command sends one command and waits for the answer. LightBurn answers
+// "OK" when it did what was asked. The answer is only listened for on the
+// address that reaches LightBurn, loopback for a LightBurn on this host,
+// and datagrams from anyone else are dropped.
+func (b LightBurnBridge) command(cmd string) error {
+	lightburnMu.Lock()
+	defer lightburnMu.Unlock()
+
+	conn, err := net.Dial("udp", net.JoinHostPort(b.Host, strconv.Itoa(b.CommandPort)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	lightburn := conn.RemoteAddr().(*net.UDPAddr).IP
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	replies, err := net.ListenUDP("udp", &net.UDPAddr{IP: local, Port: b.ReplyPort})
+	if err != nil {
+		return fmt.Errorf("порт ответов %d занят: %w", b.ReplyPort, err)
+	}
+	defer replies.Close()
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return err
+	}
+
+	replies.SetReadDeadline(time.Now().Add(time.Duration(b.TimeoutMs) * time.Millisecond))
+	buf := make([]byte, 1024)
+	var n int
+	for {
+		var from *net.UDPAddr
+		n, from, err = replies.ReadFromUDP(buf)
+		if err != nil || from.IP.Equal(lightburn) {
+			break
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w на %s за %d мс, он запущен?", ErrLightBurnTimeout, commandName(cmd), b.TimeoutMs)
+	}
+	if err != nil {
+		return err
+	}
+	reply := strings.TrimSpace(string(buf[:n]))
+	if !strings.EqualFold(reply, "OK") {
+		return fmt.Errorf("%w в %s: %q", ErrLightBurnRefused, commandName(cmd), reply)
+	}
+	return nil
+}
+
+func commandName(cmd string) string {
+	name, _, _ := strings.Cut(cmd, ":")
+	return name
+}
+
+// Open asks LightBurn to load the file and, if configured, to start the
+// job.
+func (b LightBurnBridge) Open(path string) error {
+	load := "LOADFILE:"
+	if b.Force {
+		load = "FORCELOAD:"
+	}
+	if err := b.command(load + path); err != nil {
+		return err
+	}
+	if b.Start {
+		return b.command("START")
+	}
+	return nil
+}
+
+// sendToLightBurn writes the plaque of the athlete to the bridge folder and
+// opens it in LightBurn. The project template is used when one is
+// uploaded, otherwise the SVG plate.
+func (s *APIServer) sendToLightBurn(a *Athlete) (string, error) {
+	bridge := s.lightburnBridge()
+	if !bridge.Enabled {
+		return "", ErrLightBurnOff
+	}
+	name := fmt.Sprintf("%s-%s", a.EventID, a.ResultsBib)
+	data, err := s.renderLightBurn([]*Athlete{a})
+	switch {
+	case err == ErrNoLightBurnTemplate:
+		text, err := s.engravingText(a)
+		if err != nil {
+			fmt.Println("error", err)
+		}
+		data = s.plateLayout().renderSVG([]string{text})
+		name += ".svg"
+	case err != nil:
+		return "", err
+	default:
+		name += ".lbrn2"
+	}
+	if err := os.MkdirAll(bridge.Dir, 0o755); err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(filepath.Join(bridge.Dir, filepath.Base(name)))
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, bridge.Open(path)
+}
+
+// lightburnButton is shown next to the text to copy when the bridge is on.
+func (s *APIServer) lightburnButton(a *Athlete) string {
+	if !s.lightburnBridge().Enabled {
+		return ""
+	}
+	return fmt.Sprintf(`
+		<div class='list-group-item' id='lightburn-send'>
+			<button type='button' class='btn btn-sm btn-outline-primary' hx-post='/lightburn/send'
+				hx-vals='{"event": "%s", "bib": "%s"}' hx-target='#lightburn-send' hx-swap='innerHTML'>Открыть в LightBurn</button>
+		</div>`, html.EscapeString(a.EventID), html.EscapeString(a.ResultsBib))
+}
+
+func (s *APIServer) HandleSendToLightBurn(w http.ResponseWriter, r *http.Request) {
+	a, err := s.store.GetRecordByBib(r.PostFormValue("event"), r.PostFormValue("bib"))
+	if err != nil {
+		fmt.Fprintf(w, `<span class="text-danger">Участник %s не найден</span>`, html.EscapeString(r.PostFormValue("bib")))
+		return
+	}
+	path, err := s.sendToLightBurn(a)
+	if err != nil {
+		fmt.Fprintf(w, `<span class="text-danger">%s</span>
+			<button type='button' class='btn btn-sm btn-outline-primary' hx-post='/lightburn/send'
+				hx-vals='{"event": "%s", "bib": "%s"}' hx-target='#lightburn-send' hx-swap='innerHTML'>Повторить</button>`,
+			html.EscapeString(err.Error()), html.EscapeString(a.EventID), html.EscapeString(a.ResultsBib))
+		return
+	}
+	fmt.Fprintf(w, `<span class="text-success">Открыто в LightBurn: %s</span>`, html.EscapeString(path))
+}
+
+var lightburnBridgeTmpl = template.Must(template.New("bridge").Parse(`
+	<form hx-post="/lightburn/bridge" hx-target="#lightburn-bridge" hx-swap="innerHTML">
+		<div class="form-check">
+			<input class="form-check-input" type="checkbox" name="enabled" value="1" id="bridge-enabled" {{ if .Bridge.Enabled }}checked{{ end }}>
+			<label class="form-check-label" for="bridge-enabled">Кнопка «Открыть в LightBurn» в результате поиска</label>
+		</div>
+		<div class="row g-2">
+			<div class="col-sm-4">
+				<label class="form-label small">Адрес LightBurn</label>
+				<input type="text" class="form-control" name="host" value="{{ .Bridge.Host }}">
+			</div>
+			<div class="col-sm-2">
+				<label class="form-label small">Порт команд</label>
+				<input type="number" class="form-control" name="command_port" value="{{ .Bridge.CommandPort }}">
+			</div>
+			<div class="col-sm-2">
+				<label class="form-label small">Порт ответов</label>
+				<input type="number" class="form-control" name="reply_port" value="{{ .Bridge.ReplyPort }}">
+			</div>
+			<div class="col-sm-4">
+				<label class="form-label small">Ожидание ответа, мс</label>
+				<input type="number" class="form-control" name="timeout_ms" min="1" value="{{ .Bridge.TimeoutMs }}">
+			</div>
+			<div class="col-sm-12">
+				<label class="form-label small">Папка для файлов</label>
+				<input type="text" class="form-control" name="dir" value="{{ .Bridge.Dir }}">
+			</div>
+		</div>
+		<div class="form-check">
+			<input class="form-check-input" type="checkbox" name="force" value="1" id="bridge-force" {{ if .Bridge.Force }}checked{{ end }}>
+			<label class="form-check-label" for="bridge-force">Открывать без вопроса о несохранённом проекте</label>
+		</div>
+		<div class="form-check">
+			<input class="form-check-input" type="checkbox" name="start" value="1" id="bridge-start" {{ if .Bridge.Start }}checked{{ end }}>
+			<label class="form-check-label" for="bridge-start">Сразу запускать гравировку</label>
+		</div>
+		<div class="form-text">
+			Открывается проект по шаблону LightBurn, а если он не загружен — SVG по макету таблички.
+			Для проверки без LightBurn: <code>golaser lightburn-sim</code>.
+		</div>
+		<button type="submit" class="btn btn-primary mt-2">Сохранить</button>
+		<button type="button" class="btn btn-outline-secondary mt-2" hx-post="/lightburn/ping" hx-target="#lightburn-ping" hx-swap="innerHTML">Проверить связь</button>
+		<span id="lightburn-ping" class="ms-2"></span>
+		{{ if .Message }}<span class="ms-2 text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="mt-2 text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+`))
+
+func (s *APIServer) renderLightBurnBridge(w http.ResponseWriter, bridge LightBurnBridge, message string, errText string) {
+	data := map[string]any{
+		"Bridge":  bridge,
+		"Message": message,
+		"Error":   errText,
+	}
+	if err := lightburnBridgeTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleGetLightBurnBridge(w http.ResponseWriter, r *http.Request) {
+	s.renderLightBurnBridge(w, s.lightburnBridge(), "", "")
+}
+
+func (s *APIServer) HandleSaveLightBurnBridge(w http.ResponseWriter, r *http.Request) {
+	integer := func(name string) int {
+		v, _ := strconv.Atoi(r.PostFormValue(name))
+		return v
+	}
+	bridge := LightBurnBridge{
+		Enabled:     r.PostFormValue("enabled") != "",
+		Host:        strings.TrimSpace(r.PostFormValue("host")),
+		CommandPort: integer("command_port"),
+		ReplyPort:   integer("reply_port"),
+		TimeoutMs:   integer("timeout_ms"),
+		Dir:         strings.TrimSpace(r.PostFormValue("dir")),
+		Force:       r.PostFormValue("force") != "",
+		Start:       r.PostFormValue("start") != "",
+	}
+	if err := bridge.validate(); err != nil {
+		s.renderLightBurnBridge(w, bridge, "", err.Error())
+		return
+	}
+	if err := s.saveLightBurnBridge(bridge); err != nil {
+		s.renderLightBurnBridge(w, bridge, "", fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.notify(w, r, StreamConfig)
+	s.renderLightBurnBridge(w, bridge, "Настройки сохранены", "")
+}
+
+// HandlePingLightBurn checks that LightBurn listens, PING does nothing
+// else.
+func (s *APIServer) HandlePingLightBurn(w http.ResponseWriter, r *http.Request) {
+	if err := s.lightburnBridge().command("PING"); err != nil {
+		fmt.Fprintf(w, `<span class="text-danger">%s</span>`, html.EscapeString(err.Error()))
+		return
+	}
+	fmt.Fprint(w, `<span class="text-success">LightBurn отвечает</span>`)
+}
+
+// runLightBurnSim is the lightburn-sim command: it stands in for LightBurn
+// on the UDP ports and answers OK to every command, or to none with
+// -silent. Loaded files are checked to exist.
+func runLightBurnSim(args []string) {
+	flags := flag.NewFlagSet("lightburn-sim", flag.ExitOnError)
+	commandPort := flags.Int("port", defaultLightBurnBridge.CommandPort, "command port to listen on")
+	replyPort := flags.Int("reply", defaultLightBurnBridge.ReplyPort, "port to answer to")
+	silent := flags.Bool("silent", false, "never answer, to try the timeout")
+	flags.Parse(args)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: *commandPort})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Printf("LightBurn stand-in on udp %s\n", conn.LocalAddr())
+	log.Fatal(serveLightBurnSim(conn, *replyPort, *silent))
+}
+
+// serveLightBurnSim answers the commands that come to conn until it is
+// closed.
+func serveLightBurnSim(conn *net.UDPConn, replyPort int, silent bool) error {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		cmd := string(buf[:n])
+		reply := "OK"
+		if name, path, ok := strings.Cut(cmd, ":"); ok && (name == "LOADFILE" || name == "FORCELOAD") {
+			if _, err := os.Stat(path); err != nil {
+				reply = "!"
+			}
+		}
+		log.Printf("lightburn-sim: %s from %s -> %s", cmd, from, reply)
+		if silent {
+			continue
+		}
+		to := &net.UDPAddr{IP: from.IP, Port: replyPort}
+		if _, err := conn.WriteToUDP([]byte(reply), to); err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startLightBurnSim runs the stand-in on ephemeral ports and returns a
+// bridge that talks to it.
+func startLightBurnSim(t *testing.T, silent bool) LightBurnBridge {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyPort := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+	go serveLightBurnSim(conn, replyPort, silent)
+
+	return LightBurnBridge{
+		Enabled:     true,
+		Host:        "127.0.0.1",
+		CommandPort: conn.LocalAddr().(*net.UDPAddr).Port,
+		ReplyPort:   replyPort,
+		TimeoutMs:   300,
+	}
+}
+
+func TestLightBurnCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "plate.svg")
+	if err := os.WriteFile(file, []byte("<svg/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		silent bool
+		cmd    string
+		want   error
+	}{
+		{"ok", false, "PING", nil},
+		{"load", false, "LOADFILE:" + file, nil},
+		{"force load", false, "FORCELOAD:" + file, nil},
+		{"missing file", false, "LOADFILE:" + file + ".missing", ErrLightBurnRefused},
+		{"silent", true, "PING", ErrLightBurnTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := startLightBurnSim(t, tt.silent)
+			err := b.command(tt.cmd)
+			if tt.want == nil && err != nil {
+				t.Fatalf("command(%q) = %v, want nil", tt.cmd, err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("command(%q) = %v, want %v", tt.cmd, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLightBurnCommandIgnoresOtherSenders(t *testing.T) {
+	b := startLightBurnSim(t, true)
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip("no second loopback address:", err)
+	}
+	defer other.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.ReplyPort}
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				other.WriteToUDP([]byte("OK"), to)
+			}
+		}
+	}()
+
+	if err := b.command("PING"); !errors.Is(err, ErrLightBurnTimeout) {
+		t.Fatalf("command = %v, want %v", err, ErrLightBurnTimeout)
+	}
+}
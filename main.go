@@ -1,18 +1,42 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
+	"os"
 	// "github.com/joho/godotenv"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "grbl-sim" {
+		runGrblSim(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lightburn-sim" {
+		runLightBurnSim(os.Args[2:])
+		return
+	}
+
 	// err := godotenv.Load()
 	// if err != nil {
 	// 	log.Fatal("Error loading .env file", err)
 	// }
 
-	// store, err := NewPostgresStore()
-	store, err := NewSqliteStore()
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaultTimePolicy = cfg.TimePolicy
+	chronoTrackPageSize = cfg.PageSize
+	if cfg.ScrapeInterval > 0 {
+		DefaultUpdateInterval = cfg.ScrapeInterval
+	}
+
+	store, err := cfg.openStore()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -24,10 +48,18 @@ func main() {
 	// startScraping(store)
 	// startPartialScraping(store)
 
+	secrets, err := loadSecretBox()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	newScraper := NewScraper(store)
 	// newScraper := new(Scraper)
 	// newScraper := NewScraperPsql(store)
 
-	server := NewAPIServer(":3000", store, *newScraper)
+	server := NewAPIServer(cfg.Listen, store, newScraper, secrets)
+	if cfg.ScrapeInterval > 0 && newScraper.Configured() {
+		newScraper.StartAutoUpdate(cfg.ScrapeInterval)
+	}
 	server.Run()
 }
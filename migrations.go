@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is a list of statements that move the schema one version
+// forward. Released migrations must never be edited, append a new one instead.
+type migration []string
+
+// migrate brings the schema up to date by applying every migration that is
+// newer than the version recorded in schema_version. Each migration runs in
+// its own transaction together with the version bump.
+func migrate(db *sql.DB, migrations []migration) error {
+	query := `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL
+	);`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	var current int
+	row := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`)
+	if err := row.Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, len(migrations))
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var version int
+	if err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := []migration{
+		{`CREATE TABLE a (id INTEGER);`},
+		{`INSERT INTO a (id) VALUES (1);`},
+	}
+	for run := 1; run <= 2; run++ {
+		if err := migrate(db, migrations); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if v := schemaVersion(t, db); v != 2 {
+			t.Fatalf("run %d: version %d, want 2", run, v)
+		}
+	}
+	var rows int
+	db.QueryRow(`SELECT COUNT(*) FROM a`).Scan(&rows)
+	if rows != 1 {
+		t.Errorf("the data migration ran %d times", rows)
+	}
+
+	// a failing migration leaves neither its changes nor a version bump
+	broken := append(migrations, migration{`CREATE TABLE b (id INTEGER);`, `INSERT INTO missing VALUES (1);`})
+	if err := migrate(db, broken); err == nil || !strings.Contains(err.Error(), "migration 3") {
+		t.Fatalf("broken migration: %v", err)
+	}
+	if v := schemaVersion(t, db); v != 2 {
+		t.Errorf("version after a failure %d, want 2", v)
+	}
+	if _, err := db.Exec(`SELECT * FROM b`); err == nil {
+		t.Error("table of the failed migration was kept")
+	}
+
+	if err := migrate(db, migrations[:1]); err == nil {
+		t.Error("a newer schema was accepted")
+	}
+}
+
+// TestSqliteUpgrade opens a database written before the schema had versions
+// and events.
+func TestSqliteUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "laser.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE laser (
+			id INTEGER PRIMARY KEY,
+			results_bib TEXT NOT NULL UNIQUE,
+			results_first_name TEXT NOT NULL,
+			results_last_name TEXT NOT NULL,
+			results_time TEXT,
+			results_gun_time TEXT
+		);`,
+		`CREATE TABLE history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			bib TEXT NOT NULL UNIQUE REFERENCES laser(results_bib),
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);`,
+		`INSERT INTO meta VALUES ('event_id', 'old');`,
+		`INSERT INTO laser VALUES (1, '101', 'Анна', 'Иванова', '00:40:05', '00:40:10');`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO history (bib, created_at) VALUES ('101', ?)`, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for run := 1; run <= 2; run++ {
+		store, err := NewSqliteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Init(); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if v := schemaVersion(t, store.db); v != len(sqliteMigrations) {
+			t.Errorf("run %d: version %d, want %d", run, v, len(sqliteMigrations))
+		}
+		event, err := store.GetActiveEvent()
+		if err != nil || event == nil || event.EventID != "old" {
+			t.Fatalf("run %d: active event %v, %v", run, event, err)
+		}
+		a, err := store.GetRecordByBib("old", "101")
+		if err != nil || a.ResultsLastName != "Иванова" {
+			t.Fatalf("run %d: result %v, %v", run, a, err)
+		}
+		found, err := store.FindRecordsByName("old", "иванова")
+		if err != nil || len(found) != 1 {
+			t.Errorf("run %d: search by name found %d, %v", run, len(found), err)
+		}
+		engravings, err := store.GetEngravings("old", "101")
+		if err != nil || len(engravings) != 1 {
+			t.Errorf("run %d: engravings %d, %v", run, len(engravings), err)
+		}
+		store.db.Close()
+	}
+}
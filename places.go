@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// athletePlaces are the places worked out from the times when the source
+// sends none. 0 means not placed.
+type athletePlaces struct {
+	Overall  int
+	Sex      int
+	Category int
+}
+
+// computePlaces ranks the athletes of an event within their race, their sex
+// and their category by the official time. Equal times share the place,
+// athletes without a result are not placed.
+func computePlaces(athletes []*Athlete) map[string]athletePlaces {
+	policy := activeTimePolicy()
+	type finisher struct {
+		a *Athlete
+		d time.Duration
+	}
+	groups := map[string][]finisher{}
+	for _, a := range athletes {
+		if a.Blocked() {
+			continue
+		}
+		d, err := parseDuration(a.OfficialTime())
+		if err != nil {
+			continue
+		}
+		// a place should not differ between two equal times on the plaque
+		d, _ = roundDuration(d, policy.Rounding)
+		f := finisher{a: a, d: d}
+		groups["race\x00"+a.ResultsRaceName] = append(groups["race\x00"+a.ResultsRaceName], f)
+		if a.ResultsSex != "" {
+			key := "sex\x00" + a.ResultsRaceName + "\x00" + a.ResultsSex
+			groups[key] = append(groups[key], f)
+		}
+		if a.ResultsCategory != "" {
+			key := "category\x00" + a.ResultsRaceName + "\x00" + a.ResultsCategory
+			groups[key] = append(groups[key], f)
+		}
+	}
+
+	places := map[string]athletePlaces{}
+	for key, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool { return group[i].d < group[j].d })
+		kind, _, _ := strings.Cut(key, "\x00")
+		place := 0
+		for i, f := range group {
+			if i == 0 || f.d != group[i-1].d {
+				place = i + 1
+			}
+			p := places[f.a.ResultsBib]
+			switch kind {
+			case "race":
+				p.Overall = place
+			case "sex":
+				p.Sex = place
+			case "category":
+				p.Category = place
+			}
+			places[f.a.ResultsBib] = p
+		}
+	}
+	return places
+}
+
+// updatePlaces stores the computed places of every result of the event.
+// Both stores run it in the transaction of the bulk upsert, so the places
+// always match the stored times.
+func updatePlaces(tx *sql.Tx, eventID string) error {
+	rows, err := tx.Query(`
+		SELECT results_bib, COALESCE(results_time, ''), COALESCE(results_gun_time, ''),
+		COALESCE(results_race_name, ''), COALESCE(results_sex, ''), COALESCE(results_category, ''),
+		COALESCE(results_status, ''), COALESCE(place, 0), COALESCE(sex_place, 0), COALESCE(category_place, 0)
+		FROM laser WHERE event_id = $1;
+	`, eventID)
+	if err != nil {
+		return err
+	}
+	athletes := []*Athlete{}
+	stored := map[string]athletePlaces{}
+	for rows.Next() {
+		a := &Athlete{}
+		p := athletePlaces{}
+		if err := rows.Scan(&a.ResultsBib, &a.ResultsTime, &a.ResultsGunTime, &a.ResultsRaceName, &a.ResultsSex,
+			&a.ResultsCategory, &a.ResultsStatus, &p.Overall, &p.Sex, &p.Category); err != nil {
+			rows.Close()
+			return err
+		}
+		athletes = append(athletes, a)
+		stored[a.ResultsBib] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	places := computePlaces(athletes)
+	for _, a := range athletes {
+		p := places[a.ResultsBib]
+		if p == stored[a.ResultsBib] {
+			continue
+		}
+		_, err := tx.Exec(`UPDATE laser SET place = $1, sex_place = $2, category_place = $3 WHERE event_id = $4 AND results_bib = $5;`,
+			nullPlace(p.Overall), nullPlace(p.Sex), nullPlace(p.Category), eventID, a.ResultsBib)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullPlace(place int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(place), Valid: place > 0}
+}
+
+// updateAllPlaces places the results of every event again, the official
+// time or the rounding may have changed.
+func (s *APIServer) updateAllPlaces() {
+	events, err := s.store.GetEvents()
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	for _, e := range events {
+		if err := s.store.UpdatePlaces(e.EventID); err != nil {
+			fmt.Println("error", err)
+		}
+	}
+}
+
+// placeNote is the line with the places under the search result.
+func placeNote(a *Athlete) string {
+	parts := []string{}
+	if a.ResultsRank != "" {
+		parts = append(parts, fmt.Sprintf("абсолют <strong>%s</strong>", html.EscapeString(a.ResultsRank)))
+	}
+	if a.ResultsSexRank != "" && a.ResultsSex != "" {
+		parts = append(parts, fmt.Sprintf("%s <strong>%s</strong>", html.EscapeString(a.ResultsSex), html.EscapeString(a.ResultsSexRank)))
+	}
+	if a.ResultsCategoryRank != "" && a.ResultsCategory != "" {
+		parts = append(parts, fmt.Sprintf("%s <strong>%s</strong>", html.EscapeString(a.ResultsCategory), html.EscapeString(a.ResultsCategoryRank)))
+	}
+	if a.ResultsAge != "" {
+		parts = append(parts, fmt.Sprintf("возраст %s", html.EscapeString(a.ResultsAge)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`<div class='list-group-item small text-muted'>Место: %s</div>`, strings.Join(parts, ", "))
+}
+
+// athleteFilter picks results by race, sex, category and the highest place.
+// Empty fields let everything through.
+type athleteFilter struct {
+	Race     string
+	Sex      string
+	Category string
+	// MaxPlace keeps the first places overall, or within the sex or the
+	// category when one of them is set.
+	MaxPlace int
+}
+
+func parseAthleteFilter(values map[string][]string) (athleteFilter, error) {
+	get := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	f := athleteFilter{Race: get("race"), Sex: get("sex"), Category: get("category")}
+	if top := get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n <= 0 {
+			return f, fmt.Errorf("top must be a positive number")
+		}
+		f.MaxPlace = n
+	}
+	return f, nil
+}
+
+func (f athleteFilter) empty() bool {
+	return f == athleteFilter{}
+}
+
+func (f athleteFilter) match(a *Athlete) bool {
+	if f.Race != "" && a.ResultsRaceName != f.Race {
+		return false
+	}
+	if f.Sex != "" && !strings.EqualFold(a.ResultsSex, f.Sex) {
+		return false
+	}
+	if f.Category != "" && !strings.EqualFold(a.ResultsCategory, f.Category) {
+		return false
+	}
+	if f.MaxPlace > 0 {
+		rank := a.ResultsRank
+		switch {
+		case f.Category != "":
+			rank = a.ResultsCategoryRank
+		case f.Sex != "":
+			rank = a.ResultsSexRank
+		}
+		place, err := strconv.Atoi(rank)
+		if err != nil || place <= 0 || place > f.MaxPlace {
+			return false
+		}
+	}
+	return true
+}
+
+func (f athleteFilter) apply(athletes []*Athlete) []*Athlete {
+	if f.empty() {
+		return athletes
+	}
+	matched := []*Athlete{}
+	for _, a := range athletes {
+		if f.match(a) {
+			matched = append(matched, a)
+		}
+	}
+	return matched
+}
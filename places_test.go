@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputePlaces(t *testing.T) {
+	previous := activeTimePolicy()
+	t.Cleanup(func() { setTimePolicy(previous) })
+
+	athlete := func(bib, race, sex, category, chip, gun, status string) *Athlete {
+		return &Athlete{
+			EventID: "ev1", ResultsBib: bib, ResultsRaceName: race, ResultsSex: sex, ResultsCategory: category,
+			ResultsTime: chip, ResultsGunTime: gun, ResultsStatus: status,
+		}
+	}
+	tests := []struct {
+		name     string
+		policy   TimePolicy
+		athletes []*Athlete
+		want     map[string]athletePlaces
+	}{
+		{
+			name:   "race, sex and category",
+			policy: defaultTimePolicy,
+			athletes: []*Athlete{
+				athlete("1", "10K", "M", "M30", "40:00", "", ""),
+				athlete("2", "10K", "F", "F30", "41:00", "", ""),
+				athlete("3", "10K", "M", "M40", "42:00", "", ""),
+				athlete("4", "10K", "M", "M30", "43:00", "", ""),
+				athlete("5", "5K", "F", "", "20:00", "", ""),
+			},
+			want: map[string]athletePlaces{
+				"1": {Overall: 1, Sex: 1, Category: 1},
+				"2": {Overall: 2, Sex: 1, Category: 1},
+				"3": {Overall: 3, Sex: 2, Category: 1},
+				"4": {Overall: 4, Sex: 3, Category: 2},
+				"5": {Overall: 1, Sex: 1},
+			},
+		},
+		{
+			name:   "equal times share the place",
+			policy: defaultTimePolicy,
+			athletes: []*Athlete{
+				athlete("1", "10K", "", "", "40:00", "", ""),
+				athlete("2", "10K", "", "", "40:00", "", ""),
+				athlete("3", "10K", "", "", "41:00", "", ""),
+			},
+			want: map[string]athletePlaces{
+				"1": {Overall: 1},
+				"2": {Overall: 1},
+				"3": {Overall: 3},
+			},
+		},
+		{
+			name:   "rounded times are equal",
+			policy: defaultTimePolicy,
+			athletes: []*Athlete{
+				athlete("1", "10K", "", "", "40:00.2", "", ""),
+				athlete("2", "10K", "", "", "40:00.7", "", ""),
+			},
+			want: map[string]athletePlaces{
+				"1": {Overall: 1},
+				"2": {Overall: 1},
+			},
+		},
+		{
+			name:   "tenths keep them apart",
+			policy: TimePolicy{Rounding: RoundTenths, Format: TimeHHMMSS, Source: TimeChip},
+			athletes: []*Athlete{
+				athlete("1", "10K", "", "", "40:00.7", "", ""),
+				athlete("2", "10K", "", "", "40:00.2", "", ""),
+			},
+			want: map[string]athletePlaces{
+				"1": {Overall: 2},
+				"2": {Overall: 1},
+			},
+		},
+		{
+			name:   "gun time",
+			policy: TimePolicy{Rounding: RoundCeil, Format: TimeHHMMSS, Source: TimeChip, Races: map[string]map[string]RaceTimePolicy{"ev1": {"10K": {Source: TimeGun}}}},
+			athletes: []*Athlete{
+				athlete("1", "10K", "", "", "40:00", "41:30", ""),
+				athlete("2", "10K", "", "", "40:30", "41:00", ""),
+			},
+			want: map[string]athletePlaces{
+				"1": {Overall: 2},
+				"2": {Overall: 1},
+			},
+		},
+		{
+			name:   "no result is not placed",
+			policy: defaultTimePolicy,
+			athletes: []*Athlete{
+				athlete("1", "10K", "M", "", "40:00", "", StatusDNF),
+				athlete("2", "10K", "M", "", "", "", ""),
+				athlete("3", "10K", "M", "", "abc", "", ""),
+				athlete("4", "10K", "M", "", "45:00", "", ""),
+			},
+			want: map[string]athletePlaces{
+				"4": {Overall: 1, Sex: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTimePolicy(tt.policy)
+			if got := computePlaces(tt.athletes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("computePlaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrJobActive     = errors.New("участник уже в очереди")
+	ErrReprintReason = errors.New("укажите причину повторной гравировки")
+	ErrJobTransition = errors.New("недопустимая смена статуса")
+)
+
+// jobTransitions lists the statuses a job may move to from each status. A
+// plaque that has to be done again gets a new job instead of going back.
+var jobTransitions = map[JobStatus][]JobStatus{
+	JobQueued:     {JobEngraving, JobFailed},
+	JobEngraving:  {JobEngraved, JobFailed, JobQueued},
+	JobEngraved:   {JobHandedOver},
+	JobFailed:     {JobQueued},
+	JobHandedOver: {},
+}
+
+var jobStatusTitles = map[JobStatus]string{
+	JobQueued:     "в очереди",
+	JobEngraving:  "гравируется",
+	JobEngraved:   "выгравировано",
+	JobHandedOver: "выдано",
+	JobFailed:     "ошибка",
+}
+
+var jobStatusBadges = map[JobStatus]string{
+	JobQueued:     "bg-secondary",
+	JobEngraving:  "bg-primary",
+	JobEngraved:   "bg-success",
+	JobHandedOver: "bg-dark",
+	JobFailed:     "bg-danger",
+}
+
+func parseJobStatus(s string) (JobStatus, error) {
+	status := JobStatus(s)
+	if _, ok := jobTransitions[status]; !ok {
+		return "", fmt.Errorf("неизвестный статус %q", s)
+	}
+	return status, nil
+}
+
+func (s JobStatus) Title() string {
+	return jobStatusTitles[s]
+}
+
+// Badge is the bootstrap class of the status badge.
+func (s JobStatus) Badge() string {
+	return jobStatusBadges[s]
+}
+
+// Active reports whether the job still waits for the laser.
+func (s JobStatus) Active() bool {
+	return s == JobQueued || s == JobEngraving
+}
+
+func (s JobStatus) CanMoveTo(next JobStatus) bool {
+	for _, allowed := range jobTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+func checkJobTransition(from, to JobStatus) error {
+	if !from.CanMoveTo(to) {
+		return fmt.Errorf("%w: из «%s» в «%s»", ErrJobTransition, from.Title(), to.Title())
+	}
+	return nil
+}
+
+// checkEnqueue decides whether a new job may be added for an athlete with
+// the given earlier job statuses. The history tells whether the athlete has
+// been engraved, so a reprint needs a reason only while the earlier plaques
+// are in it.
+func checkEnqueue(statuses []JobStatus, engraved bool, reason string) error {
+	for _, status := range statuses {
+		if status.Active() {
+			return ErrJobActive
+		}
+	}
+	if engraved && reason == "" {
+		return ErrReprintReason
+	}
+	return nil
+}
+
+// jobAction is a button of a queue row.
+type jobAction struct {
+	Status JobStatus
+	Label  string
+	Class  string
+	// Prompt asks the operator for a reason before the change.
+	Prompt string
+}
+
+var jobActions = map[JobStatus][]jobAction{
+	JobQueued: {
+		{Status: JobEngraving, Label: "Гравировать", Class: "btn-primary"},
+		{Status: JobFailed, Label: "Отменить", Class: "btn-outline-danger", Prompt: "Причина отмены"},
+	},
+	JobEngraving: {
+		{Status: JobEngraved, Label: "Готово", Class: "btn-success"},
+		{Status: JobFailed, Label: "Ошибка", Class: "btn-outline-danger", Prompt: "Что пошло не так?"},
+		{Status: JobQueued, Label: "Вернуть в очередь", Class: "btn-outline-secondary"},
+	},
+	JobEngraved: {
+		{Status: JobHandedOver, Label: "Выдано", Class: "btn-outline-dark"},
+	},
+	JobFailed: {
+		{Status: JobQueued, Label: "В очередь", Class: "btn-outline-primary"},
+	},
+}
+
+func (j *QueueJob) Actions() []jobAction {
+	return jobActions[j.Status]
+}
+
+var queueRowsTmpl = template.Must(template.New("queue").Parse(`
+	{{ range .Jobs }}
+	<tr>
+		<td>{{ if .Position }}{{ .Position }}{{ end }}</td>
+		<th scope="row">{{ .Athlete.ResultsBib }}</th>
+		<td>{{ .Athlete.ResultsFirstName }} {{ .Athlete.ResultsLastName }}</td>
+		<td>{{ .Athlete.ResultsRaceName }}</td>
+		<td>{{ .Athlete.OfficialTime }}{{ with .Athlete }}{{ if .StatusLabel }} <span class="badge {{ .StatusClass }}" title="{{ .StatusTitle }}">{{ .StatusLabel }}</span>{{ end }}{{ end }}</td>
+		<td>
+			<span class="badge {{ .Status.Badge }}">{{ .Status.Title }}</span>
+			{{ if .Reason }}<div class="small text-muted">{{ .Reason }}</div>{{ end }}
+			{{ if .Failure }}<div class="small text-danger">{{ .Failure }}</div>{{ end }}
+			{{ if or .Operator .Station }}<div class="small text-muted">{{ .Operator }}{{ if and .Operator .Station }}, {{ end }}{{ if .Station }}станция {{ .Station }}{{ end }}</div>{{ end }}
+		</td>
+		<td class="text-end">
+			{{ $job := . }}
+			{{ range .Actions }}
+			<button type="button" class="btn btn-sm {{ .Class }}"
+				hx-post="/queue/{{ $job.ID }}/status" hx-vals='{"status": "{{ .Status }}"}'
+				{{ if .Prompt }}hx-prompt="{{ .Prompt }}"{{ end }}
+				hx-target="#notification" hx-swap="innerHTML">{{ .Label }}</button>
+			{{ end }}
+			{{ if and $.Laser (eq .Status "queued") }}
+			<button type="button" class="btn btn-sm btn-outline-primary" hx-post="/queue/{{ .ID }}/laser"
+				hx-target="#notification" hx-swap="innerHTML">На лазер</button>
+			{{ end }}
+		</td>
+	</tr>
+	{{ else }}
+	<tr><td colspan="7">Очередь пуста</td></tr>
+	{{ end }}
+`))
+
+func (s *APIServer) HandleGetQueue(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.store.GetQueue(s.activeEventID())
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	data := map[string]any{
+		"Jobs":  jobs,
+		"Laser": s.grblSettings().Device != "",
+	}
+	if err := queueRowsTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// promptReason is the answer to the hx-prompt of the button, or the reason
+// field of a form. Headers carry only Latin-1, so htmx sends an answer in
+// Russian URI encoded and says so in HX-Prompt-URI-AutoEncoded.
+func promptReason(r *http.Request) string {
+	reason := r.Header.Get("HX-Prompt")
+	if r.Header.Get("HX-Prompt-URI-AutoEncoded") == "true" {
+		if decoded, err := url.QueryUnescape(reason); err == nil {
+			reason = decoded
+		}
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = strings.TrimSpace(r.PostFormValue("reason"))
+	}
+	return reason
+}
+
+// HandleUpdateJobStatus moves a queue job on. The reason of a failure comes
+// from the hx-prompt answer.
+func (s *APIServer) HandleUpdateJobStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		alertDangerResponse(w, "Статус не изменён", "Неверный номер задания")
+		return
+	}
+	status, err := parseJobStatus(r.PostFormValue("status"))
+	if err != nil {
+		alertDangerResponse(w, "Статус не изменён", html.EscapeString(err.Error()))
+		return
+	}
+	reason := promptReason(r)
+	if _, err := s.store.UpdateJobStatus(id, status, reason, stamp(r)); err != nil {
+		alertDangerResponse(w, "Статус не изменён", html.EscapeString(err.Error()))
+		return
+	}
+	if status == JobEngraved {
+		s.notify(w, r, StreamQueue, StreamHistory)
+	} else {
+		s.notify(w, r, StreamQueue)
+	}
+}
+
+var jobControlsTmpl = template.Must(template.New("controls").Parse(`
+	<div class="list-group-item" id="queue-controls"
+		hx-get="/queue/athlete?event={{ .Athlete.EventID }}&bib={{ .Athlete.ResultsBib }}"
+		hx-trigger="queue from:body, stream:queue from:body" hx-swap="outerHTML">
+		{{ with .Latest }}
+		Гравировка: <span class="badge {{ .Status.Badge }}">{{ .Status.Title }}</span>
+		{{ if .Position }}<span class="small">№{{ .Position }} в очереди</span>{{ end }}
+		{{ if .Reason }}<span class="small text-muted">{{ .Reason }}</span>{{ end }}
+		{{ if .Failure }}<span class="small text-danger">{{ .Failure }}</span>{{ end }}
+		{{ else }}
+		<span class="text-muted">Ещё не гравировался</span>
+		{{ end }}
+		{{ $vals := printf "{\"bib\": %q, \"event\": %q}" .Athlete.ResultsBib .Athlete.EventID }}
+		{{ if .CanQueue }}
+		<button type="button" class="btn btn-sm btn-primary" hx-post="/queue" hx-vals="{{ $vals }}"
+			hx-target="#queue-controls" hx-swap="outerHTML">В очередь</button>
+		{{ end }}
+		{{ if .CanReprint }}
+		{{ $reprint := printf "{\"bib\": %q, \"event\": %q, \"reprint\": \"1\"}" .Athlete.ResultsBib .Athlete.EventID }}
+		<button type="button" class="btn btn-sm btn-outline-warning" hx-post="/queue" hx-vals="{{ $reprint }}"
+			hx-confirm="№{{ .Athlete.ResultsBib }} уже выгравирован. Гравировать ещё одну табличку?"
+			hx-prompt="Причина повторной гравировки" hx-target="#queue-controls" hx-swap="outerHTML">Гравировать повторно</button>
+		{{ end }}
+		{{ if .CanOverride }}
+		{{ $override := printf "{\"bib\": %q, \"event\": %q, \"override\": \"1\", \"reprint\": \"%s\"}" .Athlete.ResultsBib .Athlete.EventID .Reprint }}
+		<button type="button" class="btn btn-sm btn-outline-danger" hx-post="/queue" hx-vals="{{ $override }}"
+			{{ if .Reprint }}hx-confirm="№{{ .Athlete.ResultsBib }} уже выгравирован. Гравировать ещё одну табличку?"{{ end }}
+			hx-prompt="{{ .Athlete.StatusLabel }}: почему гравировать?" hx-target="#queue-controls" hx-swap="outerHTML">Гравировать вопреки статусу</button>
+		{{ end }}
+		<a class="btn btn-sm btn-outline-secondary" href="/export/svg?event={{ .Athlete.EventID }}&bib={{ .Athlete.ResultsBib }}" download>SVG</a>
+		<a class="btn btn-sm btn-outline-secondary" href="/export/lightburn?event={{ .Athlete.EventID }}&bib={{ .Athlete.ResultsBib }}" download>LightBurn</a>
+		<a class="btn btn-sm btn-outline-secondary" href="/export/gcode?event={{ .Athlete.EventID }}&bib={{ .Athlete.ResultsBib }}" download>G-code</a>
+		{{ if .Error }}<div class="text-danger small">{{ .Error }}</div>{{ end }}
+	</div>
+`))
+
+// renderJobControls shows the queue state of the athlete with the buttons
+// to queue or reprint the plaque.
+func (s *APIServer) renderJobControls(w http.ResponseWriter, a *Athlete, errText string) {
+	jobs, err := s.store.GetJobsByBib(a.EventID, a.ResultsBib)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	statuses := []JobStatus{}
+	for _, j := range jobs {
+		statuses = append(statuses, j.Status)
+	}
+	engravings, err := s.store.GetEngravings(a.EventID, a.ResultsBib)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	canQueue := checkEnqueue(statuses, len(engravings) > 0, "") == nil
+	canReprint := checkEnqueue(statuses, len(engravings) > 0, "") == ErrReprintReason
+	data := map[string]any{
+		"Athlete":     a,
+		"Latest":      nil,
+		"CanQueue":    canQueue && !a.Blocked(),
+		"CanReprint":  canReprint && !a.Blocked(),
+		"CanOverride": (canQueue || canReprint) && a.Blocked(),
+		"Reprint":     "",
+		"Error":       errText,
+	}
+	if len(jobs) > 0 {
+		data["Latest"] = jobs[0]
+	}
+	if canReprint {
+		data["Reprint"] = "1"
+	}
+	if err := jobControlsTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleJobControls(w http.ResponseWriter, r *http.Request) {
+	a, err := s.store.GetRecordByBib(r.FormValue("event"), r.FormValue("bib"))
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	s.renderJobControls(w, a, "")
+}
+
+// HandleEnqueue adds the athlete from the search result to the queue. The
+// reason of a reprint, or of engraving a DNF, DNS or DSQ anyway, comes from
+// the hx-prompt answer, a reprint is confirmed with hx-confirm first.
+func (s *APIServer) HandleEnqueue(w http.ResponseWriter, r *http.Request) {
+	eventID := r.PostFormValue("event")
+	if eventID == "" {
+		eventID = s.activeEventID()
+	}
+	a, err := s.store.GetRecordByBib(eventID, r.PostFormValue("bib"))
+	if err != nil {
+		alertDangerResponse(w, "Участник не добавлен в очередь", html.EscapeString(err.Error()))
+		return
+	}
+	reason := promptReason(r)
+	if err := checkResultStatus(a, r.PostFormValue("override") != "", reason); err != nil {
+		s.renderJobControls(w, a, err.Error())
+		return
+	}
+	if err := s.checkReprint(a, r.PostFormValue("reprint") != ""); err != nil {
+		s.renderJobControls(w, a, err.Error())
+		return
+	}
+	if _, err := s.store.EnqueueJob(a.EventID, a.ResultsBib, reason, stamp(r)); err != nil {
+		s.renderJobControls(w, a, err.Error())
+		return
+	}
+	s.notify(w, r, StreamQueue)
+	s.renderJobControls(w, a, "")
+}
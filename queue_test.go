@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckJobTransition(t *testing.T) {
+	tests := []struct {
+		from, to JobStatus
+		ok       bool
+	}{
+		{JobQueued, JobEngraving, true},
+		{JobQueued, JobFailed, true},
+		{JobQueued, JobEngraved, false},
+		{JobQueued, JobHandedOver, false},
+		{JobEngraving, JobEngraved, true},
+		{JobEngraving, JobFailed, true},
+		{JobEngraving, JobQueued, true},
+		{JobEngraving, JobHandedOver, false},
+		{JobEngraved, JobHandedOver, true},
+		{JobEngraved, JobQueued, false},
+		{JobEngraved, JobFailed, false},
+		{JobFailed, JobQueued, true},
+		{JobFailed, JobEngraved, false},
+		{JobHandedOver, JobQueued, false},
+		{JobHandedOver, JobEngraved, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			err := checkJobTransition(tt.from, tt.to)
+			if tt.ok && err != nil {
+				t.Fatalf("checkJobTransition() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrJobTransition) {
+				t.Fatalf("checkJobTransition() = %v, want %v", err, ErrJobTransition)
+			}
+		})
+	}
+}
+
+func TestCheckEnqueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []JobStatus
+		engraved bool
+		reason   string
+		want     error
+	}{
+		{"first job", nil, false, "", nil},
+		{"after a failure", []JobStatus{JobFailed}, false, "", nil},
+		{"already queued", []JobStatus{JobFailed, JobQueued}, false, "", ErrJobActive},
+		{"being engraved", []JobStatus{JobEngraving}, false, "упала", ErrJobActive},
+		{"reprint without reason", []JobStatus{JobEngraved}, true, "", ErrReprintReason},
+		{"reprint after hand over", []JobStatus{JobHandedOver, JobFailed}, true, "", ErrReprintReason},
+		{"reprint with reason", []JobStatus{JobHandedOver}, true, "упала", nil},
+		{"reprint while queued", []JobStatus{JobEngraved, JobQueued}, true, "упала", ErrJobActive},
+		{"history cleared", []JobStatus{JobHandedOver}, false, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkEnqueue(tt.statuses, tt.engraved, tt.reason); !errors.Is(err, tt.want) {
+				t.Errorf("checkEnqueue(%v, %v, %q) = %v, want %v", tt.statuses, tt.engraved, tt.reason, err, tt.want)
+			}
+		})
+	}
+}
+
+// engraveJob moves the job through the laser to engraved.
+func engraveJob(t *testing.T, store Storage, id int) {
+	t.Helper()
+	for _, status := range []JobStatus{JobEngraving, JobEngraved} {
+		if _, err := store.UpdateJobStatus(id, status, "", Stamp{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJobReasons(t *testing.T) {
+	_, store := newTestServer(t)
+	if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+		t.Fatal(err)
+	}
+	athletes := []Athlete{{ResultsBib: "101", ResultsFirstName: "Анна", ResultsTime: "0:40:05"}}
+	if _, err := store.CreateBulkRecords("ev1", &athletes); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := store.EnqueueJob("ev1", "101", "", Stamp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = store.UpdateJobStatus(job.ID, JobFailed, "сбилась фокусировка", Stamp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Failure != "сбилась фокусировка" || job.Reason != "" {
+		t.Fatalf("failed job: reason %q, failure %q", job.Reason, job.Failure)
+	}
+	if _, err := store.UpdateJobStatus(job.ID, JobQueued, "", Stamp{}); err != nil {
+		t.Fatal(err)
+	}
+	engraveJob(t, store, job.ID)
+
+	if _, err := store.EnqueueJob("ev1", "101", "", Stamp{}); err != ErrReprintReason {
+		t.Fatalf("reprint without reason: %v, want %v", err, ErrReprintReason)
+	}
+	reprint, err := store.EnqueueJob("ev1", "101", "табличка упала", Stamp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engraveJob(t, store, reprint.ID)
+
+	engravings, err := store.GetEngravings("ev1", "101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := []string{}
+	for _, e := range engravings {
+		reasons = append(reasons, e.Reason)
+	}
+	if want := []string{"табличка упала", ""}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("history reasons = %q, want %q", reasons, want)
+	}
+}
+
+func TestEnqueueAfterClearHistory(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "op", RoleOperator)
+	session := testSession(t, store, "op")
+	if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+		t.Fatal(err)
+	}
+	athletes := []Athlete{{ResultsBib: "101", ResultsFirstName: "Анна", ResultsTime: "0:40:05"}}
+	if _, err := store.CreateBulkRecords("ev1", &athletes); err != nil {
+		t.Fatal(err)
+	}
+	job, err := store.EnqueueJob("ev1", "101", "", Stamp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engraveJob(t, store, job.ID)
+	if err := store.ClearHistory("ev1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the athlete is no longer engraved, a plain job needs neither the
+	// confirmation nor a reason
+	form := url.Values{"event": {"ev1"}, "bib": {"101"}}
+	w := serve(s.routes(), http.MethodPost, "/queue", form, session, session.CSRF)
+	if strings.Contains(w.Body.String(), "text-danger") {
+		t.Fatalf("enqueue after clearing the history: %s", w.Body)
+	}
+	jobs, err := store.GetJobsByBib("ev1", "101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Status != JobQueued {
+		t.Errorf("jobs after enqueue: %d, latest %q", len(jobs), jobs[0].Status)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Result statuses. A finisher with an official result has none.
+const (
+	StatusDNF        = "DNF"
+	StatusDNS        = "DNS"
+	StatusDSQ        = "DSQ"
+	StatusUnofficial = "UNOFFICIAL"
+)
+
+var (
+	ErrNotFinisher    = errors.New("не гравировать")
+	ErrOverrideReason = errors.New("укажите, почему гравировать вопреки статусу")
+)
+
+var resultStatusTitles = map[string]string{
+	StatusDNF:        "сошёл с дистанции",
+	StatusDNS:        "не стартовал",
+	StatusDSQ:        "дисквалифицирован",
+	StatusUnofficial: "результат неофициальный",
+}
+
+// resultStatusAliases maps what timing software writes to a status. The
+// keys are upper case.
+var resultStatusAliases = map[string]string{
+	"":                StatusNone,
+	"OK":              StatusNone,
+	"FIN":             StatusNone,
+	"FINISHED":        StatusNone,
+	"OFFICIAL":        StatusNone,
+	"DNF":             StatusDNF,
+	"DID NOT FINISH":  StatusDNF,
+	"СОШЁЛ":           StatusDNF,
+	"СОШЕЛ":           StatusDNF,
+	"СОШЛА":           StatusDNF,
+	"СХОД":            StatusDNF,
+	"DNS":             StatusDNS,
+	"DID NOT START":   StatusDNS,
+	"НЕ СТАРТОВАЛ":    StatusDNS,
+	"НЕ СТАРТОВАЛА":   StatusDNS,
+	"DSQ":             StatusDSQ,
+	"DQ":              StatusDSQ,
+	"DISQ":            StatusDSQ,
+	"DISQUALIFIED":    StatusDSQ,
+	"ДИСКВ":           StatusDSQ,
+	"ДИСКВАЛИФИКАЦИЯ": StatusDSQ,
+	"UNOFFICIAL":      StatusUnofficial,
+	"PROVISIONAL":     StatusUnofficial,
+	"PRELIMINARY":     StatusUnofficial,
+	"НЕОФИЦИАЛЬНЫЙ":   StatusUnofficial,
+	"ПРЕДВАРИТЕЛЬНЫЙ": StatusUnofficial,
+}
+
+// StatusNone is the status of an official finish.
+const StatusNone = ""
+
+// parseResultStatus reads a status as timing software writes it. ok is
+// false for anything else, such as a time.
+func parseResultStatus(s string) (status string, ok bool) {
+	status, ok = resultStatusAliases[strings.ToUpper(strings.Trim(strings.TrimSpace(s), "."))]
+	return status, ok
+}
+
+// normalizeStatus brings the status to one of the known values. Sources
+// that have no status column write it in place of the time, it is moved
+// over. An unknown status is kept in upper case and shown as it is.
+func (a *Athlete) normalizeStatus() {
+	if status, ok := parseResultStatus(a.ResultsStatus); ok {
+		a.ResultsStatus = status
+	} else {
+		a.ResultsStatus = strings.ToUpper(strings.TrimSpace(a.ResultsStatus))
+	}
+	for _, t := range []*string{&a.ResultsTime, &a.ResultsGunTime} {
+		status, ok := parseResultStatus(*t)
+		if !ok || *t == "" {
+			continue
+		}
+		*t = ""
+		if a.ResultsStatus == StatusNone {
+			a.ResultsStatus = status
+		}
+	}
+}
+
+// Blocked reports whether the athlete has no result to engrave.
+func (a *Athlete) Blocked() bool {
+	switch a.ResultsStatus {
+	case StatusDNF, StatusDNS, StatusDSQ:
+		return true
+	case StatusNone:
+		return a.ResultsTime == "" && a.ResultsGunTime == ""
+	}
+	return false
+}
+
+// StatusLabel is the short status shown on a badge, "" for an official
+// finish.
+func (a *Athlete) StatusLabel() string {
+	if a.ResultsStatus == StatusNone && a.Blocked() {
+		return "Нет времени"
+	}
+	if a.ResultsStatus == StatusUnofficial {
+		return "Неофициальный"
+	}
+	return a.ResultsStatus
+}
+
+// StatusTitle explains the status, "" for an official finish.
+func (a *Athlete) StatusTitle() string {
+	if a.ResultsStatus == StatusNone && a.Blocked() {
+		return "результата пока нет"
+	}
+	if title, ok := resultStatusTitles[a.ResultsStatus]; ok {
+		return title
+	}
+	return a.ResultsStatus
+}
+
+// StatusClass is the badge colour of the status.
+func (a *Athlete) StatusClass() string {
+	if a.Blocked() {
+		return "bg-danger"
+	}
+	return "bg-warning text-dark"
+}
+
+// checkResultStatus refuses to queue an athlete without a result unless the
+// operator overrides it and says why.
+func checkResultStatus(a *Athlete, override bool, reason string) error {
+	if !a.Blocked() {
+		return nil
+	}
+	if !override {
+		return fmt.Errorf("%s — %s, %w", a.StatusLabel(), a.StatusTitle(), ErrNotFinisher)
+	}
+	if reason == "" {
+		return ErrOverrideReason
+	}
+	return nil
+}
+
+// statusNote is the line over the search result of an athlete without an
+// official result.
+func statusNote(a *Athlete) string {
+	switch {
+	case a.Blocked():
+		return fmt.Sprintf(`<div class='list-group-item list-group-item-danger fw-bold'>%s — %s, не гравировать</div>`,
+			html.EscapeString(a.StatusLabel()), html.EscapeString(a.StatusTitle()))
+	case a.ResultsStatus != StatusNone:
+		return fmt.Sprintf(`<div class='list-group-item list-group-item-warning'>%s — %s, проверьте перед гравировкой</div>`,
+			html.EscapeString(a.StatusLabel()), html.EscapeString(a.StatusTitle()))
+	}
+	return ""
+}
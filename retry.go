@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy controls how often and how patiently a failed request to the
+// results provider is repeated.
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	attempts:  5,
+	baseDelay: 500 * time.Millisecond,
+	maxDelay:  30 * time.Second,
+}
+
+// httpStatusError is returned for responses that are not 200 OK.
+type httpStatusError struct {
+	code       int
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("сервер ответил %s", e.status)
+}
+
+// retryable reports whether a response with this status may succeed later.
+func retryable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// backoff returns the delay before the given retry (starting at 1): the
+// exponential delay capped at maxDelay with jitter in its upper half.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	d := p.baseDelay << (retry - 1)
+	if d <= 0 || d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as an
+// HTTP date.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// getWithRetry performs a GET request and returns the body and headers of a
+// 200 response. Network errors, 429 and 5xx responses are retried with
+// exponential backoff, honouring Retry-After when the server sends it.
+func getWithRetry(ctx context.Context, url string, authHeader string, policy retryPolicy) ([]byte, http.Header, error) {
+	client := &http.Client{Timeout: time.Minute}
+	var lastErr error
+	for attempt := 1; attempt <= policy.attempts; attempt++ {
+		if attempt > 1 {
+			delay := policy.backoff(attempt - 1)
+			if statusErr, ok := lastErr.(*httpStatusError); ok && statusErr.retryAfter > 0 {
+				delay = min(statusErr.retryAfter, policy.maxDelay)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if authHeader != "" {
+			req.Header.Add("Authorization", authHeader)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			statusErr := &httpStatusError{code: resp.StatusCode, status: resp.Status}
+			if !retryable(resp.StatusCode) {
+				return nil, nil, statusErr
+			}
+			statusErr.retryAfter, _ = retryAfter(resp.Header)
+			lastErr = statusErr
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return data, resp.Header, nil
+	}
+	return nil, nil, fmt.Errorf("запрос не выполнен после %d попыток: %w", policy.attempts, lastErr)
+}
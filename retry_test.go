@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = retryPolicy{attempts: 3, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond}
+
+func TestGetWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		want     string
+		requests int32
+		wantCode int
+	}{
+		{"ok", []int{200}, "ok", 1, 0},
+		{"server error then ok", []int{503, 500, 200}, "ok", 3, 0},
+		{"rate limited then ok", []int{429, 200}, "ok", 2, 0},
+		{"not found", []int{404, 200}, "", 1, 404},
+		{"unauthorized", []int{401}, "", 1, 401},
+		{"gives up", []int{502, 502, 502, 200}, "", 3, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer x" {
+					t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+				}
+				code := tt.codes[requests.Add(1)-1]
+				if code == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(code)
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			data, _, err := getWithRetry(context.Background(), server.URL, "Bearer x", testRetryPolicy)
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("%d requests, want %d", got, tt.requests)
+			}
+			if tt.wantCode != 0 {
+				var statusErr *httpStatusError
+				if !errors.As(err, &statusErr) || statusErr.code != tt.wantCode {
+					t.Fatalf("error = %v, want status %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil || string(data) != tt.want {
+				t.Fatalf("getWithRetry() = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestGetWithRetryCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	policy := retryPolicy{attempts: 5, baseDelay: time.Hour, maxDelay: time.Hour}
+	start := time.Now()
+	if _, _, err := getWithRetry(ctx, server.URL, "", policy); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the backoff ignored the cancelled context")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	h := http.Header{}
+	if _, ok := retryAfter(h); ok {
+		t.Error("no header parsed as a delay")
+	}
+	h.Set("Retry-After", "7")
+	if d, ok := retryAfter(h); !ok || d != 7*time.Second {
+		t.Errorf("seconds: %v, %v", d, ok)
+	}
+	h.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d, ok := retryAfter(h); !ok || d <= 50*time.Second || d > time.Minute {
+		t.Errorf("date: %v, %v", d, ok)
+	}
+	h.Set("Retry-After", "soon")
+	if _, ok := retryAfter(h); ok {
+		t.Error("garbage parsed as a delay")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{attempts: 10, baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	for retry, limit := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 5: time.Second, 40: time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(retry); d < limit/2 || d > limit {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", retry, d, limit/2, limit)
+			}
+		}
+	}
+}
@@ -1,219 +1,275 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"strconv"
+	"sort"
 	"sync"
+	"time"
 )
 
+// DefaultUpdateInterval is used when auto update is started without an
+// explicit interval. The configured scrape interval replaces it.
+var DefaultUpdateInterval = 5 * time.Minute
+
+var ErrScrapeRunning = errors.New("обновление уже выполняется")
+
 type Scraper struct {
-	store  Storage
-	config ChronoTrackURLConfig
+	store Storage
+
+	mu      sync.Mutex
+	sources map[string]ResultSource // by event ID
+	running bool
+	cancel  context.CancelFunc
+	status  ScrapeStatus
+	// onUpdate is called after every run, see OnUpdate.
+	onUpdate func()
+}
+
+// ScrapeStatus describes the last update run and the auto update schedule.
+type ScrapeStatus struct {
+	AutoUpdate bool
+	Interval   time.Duration
+	Running    bool
+	LastRun    time.Time
+	NextRun    time.Time
+	LastError  string
+	LastStats  UpsertStats
 }
 
 func NewScraper(store Storage) *Scraper {
 	return &Scraper{
-		store:  store,
-		config: *new(ChronoTrackURLConfig),
+		store:   store,
+		sources: map[string]ResultSource{},
 	}
 }
 
-type ChronoTrackURLConfig struct {
-	source     string
-	clientID   string
-	eventID    string
-	size       int
-	page       int
-	columns    string
-	authHeader string
-}
-
-func (c *ChronoTrackURLConfig) Default(login string, password string, clientID string, eventID string) *ChronoTrackURLConfig {
-	source := "https://api.chronotrack.com/api/event.json"
-	size := 1000
-	page := 1
-	strToHash := fmt.Sprintf("%s:%s", login, password)
-	hash := base64.StdEncoding.EncodeToString([]byte(strToHash))
-	authHeader := fmt.Sprintf("Basic %s", hash)
-	columns := fmt.Sprintf("%s,%s,%s,%s,%s,%s",
-		"results_bib",
-		"results_first_name",
-		"results_last_name",
-		"results_time",
-		"results_gun_time",
-		"results_race_name",
-	)
-	return &ChronoTrackURLConfig{
-		source:     source,
-		clientID:   clientID,
-		eventID:    eventID,
-		size:       size,
-		page:       page,
-		columns:    columns,
-		authHeader: authHeader,
-	}
+// SetSource sets where the results of the event are scraped from.
+func (scraper *Scraper) SetSource(eventID string, source ResultSource) {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	scraper.sources[eventID] = source
 }
 
-func ResultsURL(opts ChronoTrackURLConfig) string {
-	return fmt.Sprintf("%s/%s/results?client_id=%s&size=%d&page=%d&columns=%s",
-		opts.source,
-		opts.eventID,
-		opts.clientID,
-		opts.size,
-		opts.page,
-		opts.columns)
+func (scraper *Scraper) RemoveSource(eventID string) {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	delete(scraper.sources, eventID)
 }
 
-func EventInfoURL(opts ChronoTrackURLConfig) string {
-	return fmt.Sprintf("%s/%s?client_id=%s",
-		opts.source,
-		opts.eventID,
-		opts.clientID,
-	)
+// HasSource reports whether results of the event can be scraped.
+func (scraper *Scraper) HasSource(eventID string) bool {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	_, ok := scraper.sources[eventID]
+	return ok
 }
 
-func (scraper *Scraper) CheckEventURL() (*Event, error) {
-	config := scraper.config
-	url := EventInfoURL(config)
-
-	authHeader := config.authHeader
+// Configured reports whether at least one event to scrape has been set up.
+func (scraper *Scraper) Configured() bool {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	return len(scraper.sources) > 0
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
+func (scraper *Scraper) Status() ScrapeStatus {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	status := scraper.status
+	status.Running = scraper.running
+	return status
+}
 
-	req.Header.Add("Authorization", authHeader)
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// Update runs a single scrape. Only one scrape runs at a time, a call made
+// while another one is in progress returns ErrScrapeRunning. A failed scrape
+// leaves the stored results untouched apart from the pages that did arrive.
+func (scraper *Scraper) Update(ctx context.Context) (UpsertStats, error) {
+	scraper.mu.Lock()
+	if scraper.running {
+		scraper.mu.Unlock()
+		return UpsertStats{}, ErrScrapeRunning
 	}
+	scraper.running = true
+	scraper.mu.Unlock()
 
-	defer resp.Body.Close()
+	stats, err := scraper.StartScraping(ctx)
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("проверьте правильность clientID.\n%s", resp.Status)
-	}
-	data, err := io.ReadAll(resp.Body)
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	scraper.running = false
+	scraper.status.LastRun = time.Now()
+	scraper.status.LastError = ""
 	if err != nil {
-		return nil, err
+		scraper.status.LastError = err.Error()
 	}
-
-	res := EventInfoResp{}
-	err = json.Unmarshal(data, &res)
-	if err != nil {
-		return nil, fmt.Errorf("неверно указан ID соревнования")
+	scraper.status.LastStats = stats
+	if scraper.onUpdate != nil {
+		go scraper.onUpdate()
 	}
-	return &res.Event, nil
+	return stats, err
 }
 
-func (scraper *Scraper) getTotalPagesForRequest(pageSize int) (totalRowsCount int, totalPagesCount int) {
-	config := scraper.config
-	config.size = 1
-	config.page = 1
-	url := ResultsURL(config)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Fatal("Fail to make request", err)
-	}
-	req.Header.Add("Authorization", config.authHeader)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal("Fail to make request", err)
+// OnUpdate sets what to do after each scrape run, such as telling the
+// browsers to refresh.
+func (scraper *Scraper) OnUpdate(f func()) {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	scraper.onUpdate = f
+}
+
+// StartAutoUpdate runs Update right away and then every interval until
+// StopAutoUpdate is called. Starting an already running schedule restarts it
+// with the new interval.
+func (scraper *Scraper) StartAutoUpdate(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultUpdateInterval
 	}
-	defer resp.Body.Close()
+	scraper.StopAutoUpdate()
 
-	rowQty := resp.Header.Get("x-ctlive-row-count")
-	totalRowsCount, err = strconv.Atoi(rowQty)
-	if err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	scraper.mu.Lock()
+	scraper.cancel = cancel
+	scraper.status.AutoUpdate = true
+	scraper.status.Interval = interval
+	scraper.status.NextRun = time.Now()
+	scraper.mu.Unlock()
+
+	go scraper.autoUpdate(ctx, interval)
+}
+
+func (scraper *Scraper) StopAutoUpdate() {
+	scraper.mu.Lock()
+	defer scraper.mu.Unlock()
+	if scraper.cancel != nil {
+		scraper.cancel()
+		scraper.cancel = nil
 	}
-	totalPagesCount = totalRowsCount/pageSize + 1
-	return totalRowsCount, totalPagesCount
+	scraper.status.AutoUpdate = false
+	scraper.status.NextRun = time.Time{}
 }
 
-func (scraper *Scraper) StartScraping() {
-	config := scraper.config
-	totalRecords, pageQty := scraper.getTotalPagesForRequest(config.size)
-	fmt.Printf("всего страниц = %d\n", pageQty)
+func (scraper *Scraper) autoUpdate(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	recordsInDB := scraper.store.GetRecordsCount()
-	if totalRecords == recordsInDB {
-		return
-	}
-	wg := &sync.WaitGroup{}
-	for i := 1; i <= pageQty; i++ {
-		config.page = i
-		url := ResultsURL(config)
-		wg.Add(1)
-		go scraper.scrape(url, wg)
+	for {
+		if _, err := scraper.Update(ctx); err != nil {
+			log.Println("auto update:", err)
+		}
+		scraper.mu.Lock()
+		if ctx.Err() == nil {
+			scraper.status.NextRun = time.Now().Add(interval)
+		}
+		scraper.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
-	wg.Wait()
 }
 
-func (scraper *Scraper) StartPartialScraping() int {
-	config := scraper.config
-	totalRecords, pageQty := scraper.getTotalPagesForRequest(config.size)
-	fmt.Printf("всего страниц = %d\n", pageQty)
+type pageResult struct {
+	athletes []Athlete
+	err      error
+}
 
-	recordsInDB := scraper.store.GetRecordsCount()
-	if totalRecords == recordsInDB {
-		return 0
+// StartScraping scrapes every configured event one after another. An event
+// that fails does not stop the others, the first error is returned together
+// with the stats of what was stored.
+func (scraper *Scraper) StartScraping(ctx context.Context) (UpsertStats, error) {
+	scraper.mu.Lock()
+	eventIDs := make([]string, 0, len(scraper.sources))
+	sources := make(map[string]ResultSource, len(scraper.sources))
+	for eventID, source := range scraper.sources {
+		eventIDs = append(eventIDs, eventID)
+		sources[eventID] = source
 	}
-	fromPage := recordsInDB/config.size + 1
-	wg := &sync.WaitGroup{}
-	for i := fromPage; i <= pageQty; i++ {
-		config.page = i
-		url := ResultsURL(config)
-		wg.Add(1)
-		go scraper.scrape(url, wg)
+	scraper.mu.Unlock()
+	if len(eventIDs) == 0 {
+		return UpsertStats{}, errors.New("источник результатов не настроен")
 	}
-	wg.Wait()
-	return scraper.store.GetRecordsCount() - recordsInDB
-}
-
-func (scraper *Scraper) scrape(url string, wg *sync.WaitGroup) {
-	defer wg.Done()
+	sort.Strings(eventIDs)
 
-	authHeader := scraper.config.authHeader
+	stats := UpsertStats{}
+	var firstErr error
+	for _, eventID := range eventIDs {
+		eventStats, err := scraper.scrapeEvent(ctx, eventID, sources[eventID])
+		stats.Add(eventStats)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("соревнование %s: %w", eventID, err)
+		}
+	}
+	scraper.store.Checkpoint()
+	return stats, firstErr
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+// scrapeEvent fetches every result page of the event and upserts them into
+// the store. All pages are fetched on each run since corrections can touch
+// any row. Pages are downloaded concurrently and written one by one. Pages
+// that could not be fetched are skipped, the others are still stored.
+func (scraper *Scraper) scrapeEvent(ctx context.Context, eventID string, source ResultSource) (UpsertStats, error) {
+	stats := UpsertStats{}
+	total, err := source.TotalCount(ctx)
 	if err != nil {
-		log.Fatal("Fail to make request", err)
+		return stats, err
+	}
+	pageQty := pageCount(total, source.PageSize())
+	fmt.Printf("%s: всего страниц = %d\n", eventID, pageQty)
+	if pageQty == 0 {
+		return stats, nil
 	}
 
-	req.Header.Add("Authorization", authHeader)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal("Fail to make request", err)
+	pages := make(chan pageResult, pageQty)
+	wg := &sync.WaitGroup{}
+	for i := 1; i <= pageQty; i++ {
+		wg.Add(1)
+		go scraper.scrape(ctx, source, i, pages, wg)
 	}
+	wg.Wait()
+	close(pages)
 
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal("Fail to read body", err)
+	var firstErr error
+	for page := range pages {
+		if page.err != nil {
+			log.Println("Fail to fetch results", page.err)
+			if firstErr == nil {
+				firstErr = page.err
+			}
+			continue
+		}
+		pageStats, err := scraper.store.CreateBulkRecords(eventID, &page.athletes)
+		if err != nil {
+			log.Println("Fail to store results", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		stats.Add(pageStats)
 	}
 
-	res := Response{}
-	err = json.Unmarshal(data, &res)
-	if err != nil {
-		log.Fatal("cannot parse json", err)
+	if splitSource, ok := source.(SplitSource); ok {
+		splits, err := splitSource.FetchSplits(ctx)
+		if err == nil {
+			err = scraper.store.SaveSplits(eventID, splits)
+		}
+		if err != nil {
+			log.Println("Fail to update splits", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	return stats, firstErr
+}
 
-	// pageNum := resp.Header.Get("X-Ctlive-Current-Page")
-	// fmt.Printf("Количество записей = %d на странице %s\n", len(res.EventResults), pageNum)
+func (scraper *Scraper) scrape(ctx context.Context, source ResultSource, page int, pages chan<- pageResult, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	// for i := 0; i < len(res.EventResults); i++ {
-	// 	scraper.store.CreateRecord(&res.EventResults[i])
-	// }
-	scraper.store.CreateBulkRecords(&res.EventResults)
-	scraper.store.Checkpoint()
+	athletes, err := source.FetchPage(ctx, page)
+	pages <- pageResult{athletes: athletes, err: err}
 }
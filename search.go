@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"unicode"
+)
+
+// maxNameMatches limits the candidate list of a name search.
+const maxNameMatches = 30
+
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "h", 'ц': "c", 'ч': "ch", 'ш': "sh", 'щ': "sh", 'ъ': "",
+	'ы': "i", 'ь': "", 'э': "e", 'ю': "iu", 'я': "ia",
+	'і': "i", 'ї': "i", 'є': "e", 'ґ': "g",
+}
+
+// latinFolds merges the spellings that different transliteration schemes
+// produce for the same sound, so "Yuliya", "Julia" and "Юлия" get one key.
+var latinFolds = strings.NewReplacer(
+	"kh", "h",
+	"ks", "x",
+	"tch", "ch",
+	"tsch", "ch",
+	"ts", "c",
+	"tz", "c",
+	"ph", "f",
+	"ck", "k",
+	"q", "k",
+	"w", "v",
+	"y", "i",
+	"j", "i",
+)
+
+// nameKey reduces a name to the form it is searched by: lower case Latin
+// letters and digits with transliteration differences folded and repeated
+// letters collapsed. Everything else is treated as a word break.
+func nameKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if latin, ok := cyrillicToLatin[r]; ok {
+			b.WriteString(latin)
+			continue
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	folded := latinFolds.Replace(b.String())
+
+	b.Reset()
+	var prev rune
+	for _, r := range folded {
+		if r == prev && r != ' ' {
+			continue
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// athleteNameKey is stored in laser.search_name.
+func athleteNameKey(a *Athlete) string {
+	return nameKey(a.ResultsFirstName + " " + a.ResultsLastName)
+}
+
+// nameQueryTerms splits a name query into the keys every match must contain.
+func nameQueryTerms(query string) []string {
+	return strings.Fields(nameKey(query))
+}
+
+// isNameQuery reports whether the search input is a name rather than a bib.
+func isNameQuery(query string) bool {
+	return strings.IndexFunc(query, unicode.IsLetter) >= 0 && nameKey(query) != "" &&
+		strings.IndexFunc(query, unicode.IsDigit) < 0
+}
+
+// fillSearchNames computes search_name for rows stored before the column
+// existed or written by an older version.
+func fillSearchNames(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(results_first_name, ''), COALESCE(results_last_name, '')
+		FROM laser WHERE search_name IS NULL;
+	`)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id  int
+		key string
+	}
+	pending := []row{}
+	for rows.Next() {
+		a := Athlete{}
+		var id int
+		if err := rows.Scan(&id, &a.ResultsFirstName, &a.ResultsLastName); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, row{id: id, key: athleteNameKey(&a)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range pending {
+		if _, err := tx.Exec(`UPDATE laser SET search_name = $1 WHERE id = $2;`, r.key, r.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestNameKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Юлия", "iulia"},
+		{"Yuliya", "iulia"},
+		{"Julia", "iulia"},
+		{"Ёлкина", "elkina"},
+		{"Elkina", "elkina"},
+		{"Хабибуллин", "habibulin"},
+		{"Khabibullin", "habibulin"},
+		{"Цой", "coi"},
+		{"Tsoi", "coi"},
+		{"Щукин", "shukin"},
+		{"Ткаченко-Петренко", "tkachenko petrenko"},
+		{"  O'Brien  ", "o brien"},
+		{"Anna Maria", "ana maria"},
+		{"Runner 42", "runer 42"},
+		{"!?", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nameKey(tt.name); got != tt.want {
+				t.Errorf("nameKey(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
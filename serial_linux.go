@@ -0,0 +1,127 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var baudRates = map[int]uint32{
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+	230400: syscall.B230400,
+}
+
+// cbaud masks the baud rate bits of Cflag, the syscall package lacks it.
+const cbaud = 0x100f
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw puts the terminal in raw 8N1 mode at the baud rate, 0 keeps the
+// rate as it is. The descriptor is reached through SyscallConn, f.Fd would
+// make the file blocking and a pending read could not be interrupted.
+func makeRaw(f *os.File, baud int) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var termErr error
+	err = conn.Control(func(fd uintptr) {
+		termErr = setRaw(fd, baud)
+	})
+	if err != nil {
+		return err
+	}
+	return termErr
+}
+
+func setRaw(fd uintptr, baud int) error {
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if baud != 0 {
+		rate, ok := baudRates[baud]
+		if !ok {
+			return fmt.Errorf("скорость порта %d не поддерживается", baud)
+		}
+		t.Cflag &^= cbaud
+		t.Cflag |= rate
+		t.Ispeed = rate
+		t.Ospeed = rate
+	}
+	return ioctl(fd, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+// openSerial opens the serial port of the laser controller.
+func openSerial(device string, baud int) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeRaw(f, baud); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", device, err)
+	}
+	return f, nil
+}
+
+// openPty creates a pseudo terminal pair. The slave end is kept open as
+// well so that the master does not fail while nobody else has it open.
+func openPty() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var n uint32
+	var ptyErr error
+	err = conn.Control(func(fd uintptr) {
+		unlock := int32(0)
+		if ptyErr = ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); ptyErr == nil {
+			ptyErr = ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&n))
+		}
+	})
+	if err == nil {
+		err = ptyErr
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if err := makeRaw(slave, 0); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
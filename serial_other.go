@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var errNoSerial = errors.New("последовательный порт поддерживается только в Linux")
+
+func openSerial(device string, baud int) (io.ReadWriteCloser, error) {
+	return nil, errNoSerial
+}
+
+func openPty() (master *os.File, slave *os.File, err error) {
+	return nil, nil, errNoSerial
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// ResultSource is a provider of event results such as a timing company API
+// or an export published by the timing software.
+type ResultSource interface {
+	// EventInfo returns the configured event. It is also used to check the
+	// source configuration.
+	EventInfo(ctx context.Context) (*Event, error)
+	// TotalCount returns the number of results the source currently holds.
+	TotalCount(ctx context.Context) (int, error)
+	// PageSize is the maximum number of results returned by FetchPage.
+	PageSize() int
+	// FetchPage returns the results of the 1-based page.
+	FetchPage(ctx context.Context, page int) ([]Athlete, error)
+}
+
+// SplitSource is a ResultSource that also has the interval times of the
+// athletes. The scraper fetches them after the results.
+type SplitSource interface {
+	FetchSplits(ctx context.Context) ([]Split, error)
+}
+
+// SourceConfig holds the settings entered in the event configuration form.
+// Every source type uses only the fields it needs.
+type SourceConfig struct {
+	Type      string
+	EventName string
+	Login     string
+	Password  string
+	ClientID  string
+	EventID   string
+	URL       string
+}
+
+type sourceType struct {
+	Name  string
+	Title string
+	New   func(SourceConfig) (ResultSource, error)
+}
+
+// sourceTypes lists the result sources the operator can choose from, the
+// first one is the default.
+var sourceTypes = []sourceType{
+	{Name: "chronotrack", Title: "ChronoTrack", New: newChronoTrackSource},
+	{Name: "json", Title: "JSON-выгрузка по ссылке", New: newJSONExportSource},
+	{Name: "offline", Title: "Без источника, импорт из файла", New: newOfflineSource},
+}
+
+func NewResultSource(config SourceConfig) (ResultSource, error) {
+	if config.Type == "" {
+		config.Type = sourceTypes[0].Name
+	}
+	for _, t := range sourceTypes {
+		if t.Name == config.Type {
+			return t.New(config)
+		}
+	}
+	return nil, fmt.Errorf("неизвестный источник результатов %q", config.Type)
+}
+
+// pageCount returns how many pages hold total results.
+func pageCount(total int, pageSize int) int {
+	if total <= 0 {
+		return 0
+	}
+	if pageSize <= 0 {
+		return 1
+	}
+	return (total + pageSize - 1) / pageSize
+}
+
+// offlineSource is used for events whose results are only imported from
+// files, it never returns any results itself.
+type offlineSource struct {
+	event Event
+}
+
+func newOfflineSource(config SourceConfig) (ResultSource, error) {
+	if config.EventID == "" {
+		return nil, fmt.Errorf("укажите ID соревнования")
+	}
+	return &offlineSource{event: Event{EventID: config.EventID, EventName: config.EventID}}, nil
+}
+
+func (o *offlineSource) EventInfo(ctx context.Context) (*Event, error) {
+	event := o.event
+	return &event, nil
+}
+
+func (o *offlineSource) TotalCount(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (o *offlineSource) PageSize() int {
+	return 0
+}
+
+func (o *offlineSource) FetchPage(ctx context.Context, page int) ([]Athlete, error) {
+	return nil, nil
+}
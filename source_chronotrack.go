@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type ChronoTrackURLConfig struct {
+	source     string
+	clientID   string
+	eventID    string
+	size       int
+	page       int
+	columns    string
+	authHeader string
+}
+
+// chronoTrackPageSize is the number of results asked for in one request, it
+// is the configured page size.
+var chronoTrackPageSize = 1000
+
+func (c *ChronoTrackURLConfig) Default(login string, password string, clientID string, eventID string) *ChronoTrackURLConfig {
+	source := "https://api.chronotrack.com/api/event.json"
+	size := chronoTrackPageSize
+	page := 1
+	strToHash := fmt.Sprintf("%s:%s", login, password)
+	hash := base64.StdEncoding.EncodeToString([]byte(strToHash))
+	authHeader := fmt.Sprintf("Basic %s", hash)
+	columns := strings.Join([]string{
+		"results_bib",
+		"results_first_name",
+		"results_last_name",
+		"results_time",
+		"results_gun_time",
+		"results_race_name",
+		"results_sex",
+		"results_age",
+		"results_primary_bracket_name",
+		"results_rank",
+		"results_sex_rank",
+		"results_primary_bracket_rank",
+		"results_status",
+	}, ",")
+	return &ChronoTrackURLConfig{
+		source:     source,
+		clientID:   clientID,
+		eventID:    eventID,
+		size:       size,
+		page:       page,
+		columns:    columns,
+		authHeader: authHeader,
+	}
+}
+
+func ResultsURL(opts ChronoTrackURLConfig) string {
+	return fmt.Sprintf("%s/%s/results?client_id=%s&size=%d&page=%d&columns=%s",
+		opts.source,
+		opts.eventID,
+		opts.clientID,
+		opts.size,
+		opts.page,
+		opts.columns)
+}
+
+func EventInfoURL(opts ChronoTrackURLConfig) string {
+	return fmt.Sprintf("%s/%s?client_id=%s",
+		opts.source,
+		opts.eventID,
+		opts.clientID,
+	)
+}
+
+// ChronoTrackSource reads results from the ChronoTrack Live API.
+type ChronoTrackSource struct {
+	config ChronoTrackURLConfig
+}
+
+func newChronoTrackSource(config SourceConfig) (ResultSource, error) {
+	if config.Login == "" || config.Password == "" || config.ClientID == "" || config.EventID == "" {
+		return nil, fmt.Errorf("для ChronoTrack нужны login, password, clientID и eventID")
+	}
+	return &ChronoTrackSource{
+		config: *new(ChronoTrackURLConfig).Default(config.Login, config.Password, config.ClientID, config.EventID),
+	}, nil
+}
+
+func (c *ChronoTrackSource) EventInfo(ctx context.Context) (*Event, error) {
+	data, _, err := getWithRetry(ctx, EventInfoURL(c.config), c.config.authHeader, defaultRetryPolicy)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && !retryable(statusErr.code) {
+		return nil, fmt.Errorf("проверьте правильность clientID.\n%s", statusErr.status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := EventInfoResp{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("неверно указан ID соревнования")
+	}
+	return &res.Event, nil
+}
+
+func (c *ChronoTrackSource) PageSize() int {
+	return c.config.size
+}
+
+func (c *ChronoTrackSource) TotalCount(ctx context.Context) (int, error) {
+	config := c.config
+	config.size = 1
+	config.page = 1
+	url := ResultsURL(config)
+	_, header, err := getWithRetry(ctx, url, config.authHeader, defaultRetryPolicy)
+	if err != nil {
+		return 0, err
+	}
+
+	rowQty := header.Get("x-ctlive-row-count")
+	totalRowsCount, err := strconv.Atoi(rowQty)
+	if err != nil {
+		return 0, fmt.Errorf("неверное количество записей %q в ответе сервера", rowQty)
+	}
+	return totalRowsCount, nil
+}
+
+func (c *ChronoTrackSource) FetchPage(ctx context.Context, page int) ([]Athlete, error) {
+	config := c.config
+	config.page = page
+	data, _, err := getWithRetry(ctx, ResultsURL(config), config.authHeader, defaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	res := Response{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось разобрать ответ сервера: %w", err)
+	}
+	// a disqualified athlete may still have a time, only the status
+	// keeps the plaque from being engraved
+	for i := range res.EventResults {
+		res.EventResults[i].normalizeStatus()
+	}
+	return res.EventResults, nil
+}
+
+// IntervalsURL lists the intervals of the event, such as the swim, bike and
+// run of a triathlon.
+func IntervalsURL(opts ChronoTrackURLConfig) string {
+	return fmt.Sprintf("%s/%s/interval?client_id=%s",
+		opts.source,
+		opts.eventID,
+		opts.clientID,
+	)
+}
+
+// IntervalResultsURL is the page of times at the interval.
+func IntervalResultsURL(opts ChronoTrackURLConfig, intervalID string) string {
+	return fmt.Sprintf("%s/%s/results?client_id=%s&size=%d&page=%d&columns=results_bib,results_time",
+		strings.Replace(opts.source, "/event.json", "/interval.json", 1),
+		intervalID,
+		opts.clientID,
+		opts.size,
+		opts.page)
+}
+
+type chronoTrackInterval struct {
+	ID   string `json:"interval_id"`
+	Name string `json:"interval_name"`
+	// Order and FullCourse come as strings.
+	Order      string `json:"interval_order"`
+	FullCourse string `json:"interval_is_full_course"`
+}
+
+// FetchSplits reads the times at every interval but the full course, which
+// is the result itself.
+func (c *ChronoTrackSource) FetchSplits(ctx context.Context) ([]Split, error) {
+	data, _, err := getWithRetry(ctx, IntervalsURL(c.config), c.config.authHeader, defaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		Intervals []chronoTrackInterval `json:"event_interval"`
+	}{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("не удалось разобрать список отсечек: %w", err)
+	}
+
+	splits := []Split{}
+	for _, interval := range res.Intervals {
+		if interval.FullCourse == "1" {
+			continue
+		}
+		order, _ := strconv.Atoi(interval.Order)
+		config := c.config
+		// the API may send fewer results than asked for, only an empty
+		// page, or the same page again, is the end
+		previous := ""
+		for config.page = 1; ; config.page++ {
+			data, _, err := getWithRetry(ctx, IntervalResultsURL(config, interval.ID), config.authHeader, defaultRetryPolicy)
+			if err != nil {
+				return nil, err
+			}
+			page := struct {
+				Results []Athlete `json:"interval_results"`
+			}{}
+			if err := json.Unmarshal(data, &page); err != nil {
+				return nil, fmt.Errorf("не удалось разобрать отсечку %s: %w", interval.Name, err)
+			}
+			if len(page.Results) == 0 || string(data) == previous {
+				break
+			}
+			previous = string(data)
+			for _, r := range page.Results {
+				if r.ResultsBib == "" || r.ResultsTime == "" {
+					continue
+				}
+				splits = append(splits, Split{Bib: r.ResultsBib, Name: interval.Name, Time: r.ResultsTime, Order: order})
+			}
+		}
+	}
+	return splits, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChronoTrackStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Query().Get("columns"), "results_status") {
+			t.Errorf("status column not asked for: %s", r.URL)
+		}
+		w.Write([]byte(`{"event_results": [
+			{"results_bib": "1", "results_time": "40:00", "results_status": ""},
+			{"results_bib": "2", "results_time": "41:00", "results_status": "DQ"},
+			{"results_bib": "3", "results_time": "42:00", "results_status": "Disqualified"},
+			{"results_bib": "4", "results_time": "", "results_status": "DNF"},
+			{"results_bib": "5", "results_time": "", "results_status": "dns"},
+			{"results_bib": "6", "results_time": "43:00", "results_status": "Provisional"},
+			{"results_bib": "7", "results_time": "44:00", "results_status": "Official"},
+			{"results_bib": "8", "results_time": "DNF"}
+		]}`))
+	}))
+	defer server.Close()
+
+	source := &ChronoTrackSource{config: *new(ChronoTrackURLConfig).Default("login", "password", "client", "42")}
+	source.config.source = server.URL + "/api/event.json"
+	athletes, err := source.FetchPage(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status  string
+		blocked bool
+	}{
+		{StatusNone, false},
+		{StatusDSQ, true},
+		{StatusDSQ, true},
+		{StatusDNF, true},
+		{StatusDNS, true},
+		{StatusUnofficial, false},
+		{StatusNone, false},
+		{StatusDNF, true},
+	}
+	if len(athletes) != len(tests) {
+		t.Fatalf("got %d athletes, want %d", len(athletes), len(tests))
+	}
+	for i, tt := range tests {
+		a := athletes[i]
+		if a.ResultsStatus != tt.status || a.Blocked() != tt.blocked {
+			t.Errorf("bib %s: status %q blocked %v, want %q %v", a.ResultsBib, a.ResultsStatus, a.Blocked(), tt.status, tt.blocked)
+		}
+	}
+}
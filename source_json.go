@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// JSONExportSource reads a results file published by the timing software,
+// e.g. on a laptop in the timing tent. The file holds either a list of
+// results or an object with an "event_results" list, using the ChronoTrack
+// field names.
+type JSONExportSource struct {
+	url     string
+	eventID string
+
+	mu sync.Mutex
+	// fetched holds the export read by TotalCount until FetchPage takes it,
+	// so a run downloads the file once.
+	fetched []Athlete
+	cached  bool
+}
+
+func newJSONExportSource(config SourceConfig) (ResultSource, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("укажите ссылку на файл с результатами")
+	}
+	if config.EventID == "" {
+		return nil, fmt.Errorf("укажите ID соревнования")
+	}
+	return &JSONExportSource{url: config.URL, eventID: config.EventID}, nil
+}
+
+func (j *JSONExportSource) EventInfo(ctx context.Context) (*Event, error) {
+	if _, err := j.fetch(ctx); err != nil {
+		return nil, err
+	}
+	return &Event{EventID: j.eventID, EventName: j.eventID}, nil
+}
+
+// PageSize is 0 as the whole export is always returned as a single page.
+func (j *JSONExportSource) PageSize() int {
+	return 0
+}
+
+func (j *JSONExportSource) TotalCount(ctx context.Context) (int, error) {
+	athletes, err := j.fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	j.mu.Lock()
+	j.fetched, j.cached = athletes, true
+	j.mu.Unlock()
+	return len(athletes), nil
+}
+
+func (j *JSONExportSource) FetchPage(ctx context.Context, page int) ([]Athlete, error) {
+	if page != 1 {
+		return nil, nil
+	}
+	j.mu.Lock()
+	athletes, cached := j.fetched, j.cached
+	j.fetched, j.cached = nil, false
+	j.mu.Unlock()
+	if cached {
+		return athletes, nil
+	}
+	return j.fetch(ctx)
+}
+
+func (j *JSONExportSource) fetch(ctx context.Context) ([]Athlete, error) {
+	data, _, err := getWithRetry(ctx, j.url, "", defaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var athletes []Athlete
+	if err := json.Unmarshal(data, &athletes); err == nil {
+		return athletes, nil
+	}
+	res := Response{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("не удалось разобрать файл результатов: %w", err)
+	}
+	return res.EventResults, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJSONExportFetchedOnce(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"event_results": [
+			{"results_bib": "1", "results_time": "40:00"},
+			{"results_bib": "2", "results_time": "41:00"}
+		]}`))
+	}))
+	defer server.Close()
+
+	_, store := newTestServer(t)
+	if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+		t.Fatal(err)
+	}
+	source, err := newJSONExportSource(SourceConfig{Type: "json", EventID: "ev1", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scraper := NewScraper(store)
+	for run := 1; run <= 2; run++ {
+		stats, err := scraper.scrapeEvent(context.Background(), "ev1", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requests.Load(); got != int32(run) {
+			t.Errorf("run %d: %d downloads, want %d", run, got, run)
+		}
+		if run == 1 && stats.New != 2 {
+			t.Errorf("run %d: %d new results, want 2", run, stats.New)
+		}
+	}
+}
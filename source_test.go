@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestPageCount(t *testing.T) {
+	tests := []struct {
+		total, pageSize, want int
+	}{
+		{0, 50, 0},
+		{1, 50, 1},
+		{49, 50, 1},
+		{50, 50, 1},
+		{51, 50, 2},
+		{100, 50, 2},
+		{0, 0, 0},
+		{120, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := pageCount(tt.total, tt.pageSize); got != tt.want {
+			t.Errorf("pageCount(%d, %d) = %d, want %d", tt.total, tt.pageSize, got, tt.want)
+		}
+	}
+}
+
+// pagedSource serves total results in pages of two and records the pages
+// asked for.
+type pagedSource struct {
+	total int
+
+	mu    sync.Mutex
+	pages []int
+}
+
+func (p *pagedSource) EventInfo(ctx context.Context) (*Event, error) {
+	return &Event{EventID: "ev1", EventName: "ev1"}, nil
+}
+
+func (p *pagedSource) TotalCount(ctx context.Context) (int, error) {
+	return p.total, nil
+}
+
+func (p *pagedSource) PageSize() int {
+	return 2
+}
+
+func (p *pagedSource) FetchPage(ctx context.Context, page int) ([]Athlete, error) {
+	p.mu.Lock()
+	p.pages = append(p.pages, page)
+	p.mu.Unlock()
+	athletes := []Athlete{}
+	for i := (page-1)*2 + 1; i <= page*2 && i <= p.total; i++ {
+		athletes = append(athletes, Athlete{ResultsBib: strconv.Itoa(i), ResultsTime: "0:40:05"})
+	}
+	return athletes, nil
+}
+
+func TestScrapeEventPages(t *testing.T) {
+	tests := []struct {
+		total int
+		pages []int
+	}{
+		{0, nil},
+		{3, []int{1, 2}},
+		{4, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		_, store := newTestServer(t)
+		if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+			t.Fatal(err)
+		}
+		source := &pagedSource{total: tt.total}
+		stats, err := NewScraper(store).scrapeEvent(context.Background(), "ev1", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Ints(source.pages)
+		if !reflect.DeepEqual(source.pages, tt.pages) {
+			t.Errorf("%d results: pages %v, want %v", tt.total, source.pages, tt.pages)
+		}
+		if stats.New != tt.total || store.GetRecordsCount("ev1") != tt.total {
+			t.Errorf("%d results: new %d, stored %d", tt.total, stats.New, store.GetRecordsCount("ev1"))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// loadSplits reads the splits of the athlete, written the way the time
+// policy says. A time that does not parse is kept as the source sent it.
+func (s *APIServer) loadSplits(a *Athlete) {
+	if a.Splits != nil {
+		return
+	}
+	splits, err := s.store.GetSplits(a.EventID, a.ResultsBib)
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	policy := activeTimePolicy()
+	format := policy.race(a.EventID, a.ResultsRaceName).Format
+	for i := range splits {
+		if t, err := formatResultTime(splits[i].Time, policy, format); err == nil {
+			splits[i].Time = t
+		}
+	}
+	a.Splits = splits
+}
+
+// splitsNote is the line with the splits under the search result.
+func splitsNote(a *Athlete) string {
+	if len(a.Splits) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(a.Splits))
+	for _, split := range a.Splits {
+		parts = append(parts, fmt.Sprintf("%s <strong>%s</strong>", html.EscapeString(split.Name), html.EscapeString(split.Time)))
+	}
+	return fmt.Sprintf(`<div class='list-group-item small text-muted'>Отсечки: %s</div>`, strings.Join(parts, " · "))
+}
@@ -0,0 +1,9 @@
+// Connects the page to the event stream of the server, see stream.go. Every
+// event is fired on the body as "stream:<name>", the parts of the page that
+// depend on it listen with hx-trigger="stream:<name> from:body".
+(function () {
+  var source = new EventSource(document.body.dataset.stream);
+  source.onmessage = function (e) {
+    htmx.trigger(document.body, "stream:" + e.data);
+  };
+})();
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// athleteColumns is the laser column list read by scanAthlete.
+const athleteColumns = `laser.event_id,
+		COALESCE((SELECT event_name FROM events WHERE events.event_id = laser.event_id), ''),
+		laser.results_bib,
+		COALESCE(laser.results_first_name, ''),
+		COALESCE(laser.results_last_name, ''),
+		COALESCE(laser.results_time, ''),
+		COALESCE(laser.results_gun_time, ''),
+		COALESCE(laser.results_race_name, ''),
+		COALESCE(laser.results_sex, ''),
+		COALESCE(laser.results_category, ''),
+		COALESCE(laser.results_status, ''),
+		COALESCE(laser.results_age, ''),
+		COALESCE(NULLIF(laser.results_rank, ''), CAST(laser.place AS TEXT), ''),
+		COALESCE(NULLIF(laser.results_sex_rank, ''), CAST(laser.sex_place AS TEXT), ''),
+		COALESCE(NULLIF(laser.results_category_rank, ''), CAST(laser.category_place AS TEXT), '')`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// athleteFields returns the scan destinations of athleteColumns.
+func athleteFields(a *Athlete) []any {
+	return []any{
+		&a.EventID,
+		&a.EventName,
+		&a.ResultsBib,
+		&a.ResultsFirstName,
+		&a.ResultsLastName,
+		&a.ResultsTime,
+		&a.ResultsGunTime,
+		&a.ResultsRaceName,
+		&a.ResultsSex,
+		&a.ResultsCategory,
+		&a.ResultsStatus,
+		&a.ResultsAge,
+		&a.ResultsRank,
+		&a.ResultsSexRank,
+		&a.ResultsCategoryRank,
+	}
+}
+
+// scanAthlete reads a row selected with athleteColumns.
+func scanAthlete(row rowScanner) (*Athlete, error) {
+	a := new(Athlete)
+	if err := row.Scan(athleteFields(a)...); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func scanAthletes(rows *sql.Rows) ([]*Athlete, error) {
+	defer rows.Close()
+
+	athletes := []*Athlete{}
+	for rows.Next() {
+		a, err := scanAthlete(rows)
+		if err != nil {
+			return nil, err
+		}
+		athletes = append(athletes, a)
+	}
+	return athletes, rows.Err()
+}
+
+// eventColumns is the events column list read by scanEvent.
+const eventColumns = `event_id, event_name, source_type, start_time, active`
+
+func scanEvent(row rowScanner) (*Event, error) {
+	e := new(Event)
+	err := row.Scan(
+		&e.EventID,
+		&e.EventName,
+		&e.SourceType,
+		&e.StartTime,
+		&e.Active,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func scanEvents(rows *sql.Rows) ([]*Event, error) {
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// jobColumns is the column list read by scanJob, selected from queue joined
+// with laser.
+const jobColumns = `queue.id, queue.status, COALESCE(queue.reason, ''), COALESCE(queue.failure, ''),
+		queue.created_at, queue.updated_at,
+		COALESCE(queue.operator, ''), COALESCE(queue.station, ''),
+		CASE WHEN queue.status = 'queued' THEN (
+			SELECT COUNT(*) FROM queue AS ahead
+			WHERE ahead.event_id = queue.event_id AND ahead.status = 'queued' AND ahead.id <= queue.id
+		) ELSE 0 END,
+		` + athleteColumns
+
+// jobJoin joins queue jobs with their results.
+const jobJoin = `queue JOIN laser ON queue.event_id = laser.event_id AND queue.bib = laser.results_bib`
+
+func scanJob(row rowScanner) (*QueueJob, error) {
+	j := &QueueJob{Athlete: new(Athlete)}
+	dest := append([]any{
+		&j.ID,
+		&j.Status,
+		&j.Reason,
+		&j.Failure,
+		&j.CreatedAt,
+		&j.UpdatedAt,
+		&j.Operator,
+		&j.Station,
+		&j.Position,
+	}, athleteFields(j.Athlete)...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	// a job is still worth showing when its time does not parse
+	processTimeForRecord(j.Athlete)
+	return j, nil
+}
+
+func scanJobs(rows *sql.Rows) ([]*QueueJob, error) {
+	defer rows.Close()
+
+	jobs := []*QueueJob{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// historyColumns is the column list read by scanHistoryEntries, selected from
+// history joined with laser.
+const historyColumns = `history.id, COALESCE(history.operator, ''), COALESCE(history.station, ''), COALESCE(history.reason, ''), history.created_at,
+		EXISTS (
+			SELECT 1 FROM history AS earlier
+			WHERE earlier.event_id = history.event_id AND earlier.bib = history.bib AND earlier.id < history.id
+		),
+		` + athleteColumns
+
+// historyJoin joins history entries with their results.
+const historyJoin = `history JOIN laser ON history.event_id = laser.event_id AND history.bib = laser.results_bib`
+
+func scanHistoryEntries(rows *sql.Rows) ([]*HistoryEntry, error) {
+	defer rows.Close()
+
+	entries := []*HistoryEntry{}
+	for rows.Next() {
+		e := &HistoryEntry{Athlete: new(Athlete)}
+		dest := append([]any{
+			&e.ID,
+			&e.Operator,
+			&e.Station,
+			&e.Reason,
+			&e.CreatedAt,
+			&e.Reprint,
+		}, athleteFields(e.Athlete)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		processTimeForRecord(e.Athlete)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func scanUsers(rows *sql.Rows) ([]*User, error) {
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u := new(User)
+		if err := rows.Scan(&u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func jobStatuses(values []string) []JobStatus {
+	statuses := make([]JobStatus, 0, len(values))
+	for _, v := range values {
+		statuses = append(statuses, JobStatus(v))
+	}
+	return statuses
+}
+
+// loadJSONSetting reads a setting stored as JSON into v. A missing setting
+// leaves v as it is.
+func loadJSONSetting(store Storage, key string, v any) error {
+	value, err := store.GetSetting(key)
+	if err != nil || value == "" {
+		return err
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+func saveJSONSetting(store Storage, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return store.SetSetting(key, string(value))
+}
@@ -2,31 +2,71 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type Storage interface {
+	Init() error
+	SaveEvent(e *Event) error
+	GetEvents() ([]*Event, error)
+	GetActiveEvent() (*Event, error)
+	SetActiveEvent(eventID string) error
+	ResetEvent(eventID string) error
+	DeleteEvent(eventID string) error
 	// CreateLaserTable() error
 	// CreateRecord(*Athlete) error
 	// GetRecords() ([]*Athlete, error)
-	GetHistoryRecords() ([]*Athlete, error)
-	CreateBulkRecords(a *[]Athlete) error
-	GetRecordByBib(bib string) (*Athlete, error)
-	GetLatestHistoryRecord() (*Athlete, error)
-	GetRecordsCount() int
-	ClearHistory()
+	GetHistoryRecords(eventID string, raceName string) ([]*HistoryEntry, error)
+	GetEngravings(eventID string, bib string) ([]*HistoryEntry, error)
+	GetReprintCount(eventID string) int
+	GetRaceNames(eventID string) ([]string, error)
+	CreateBulkRecords(eventID string, a *[]Athlete) (UpsertStats, error)
+	GetRecordByBib(eventID string, bib string) (*Athlete, error)
+	FindRecordsByBib(bib string) ([]*Athlete, error)
+	FindRecordsByName(eventID string, query string) ([]*Athlete, error)
+	GetRecords(eventID string) ([]*Athlete, error)
+	GetRecordsCount(eventID string) int
+	ClearHistory(eventID string) error
+	EnqueueJob(eventID string, bib string, reason string, by Stamp) (*QueueJob, error)
+	UpdateJobStatus(id int, status JobStatus, reason string, by Stamp) (*QueueJob, error)
+	GetJob(id int) (*QueueJob, error)
+	GetQueue(eventID string) ([]*QueueJob, error)
+	GetJobsByBib(eventID string, bib string) ([]*QueueJob, error)
+	GetTemplates(eventID string) ([]*EngravingTemplate, error)
+	SaveTemplate(t *EngravingTemplate) error
+	DeleteTemplate(eventID string, raceName string) error
+	GetSetting(key string) (string, error)
+	SetSetting(key string, value string) error
+	UpdatePlaces(eventID string) error
+	SaveSplits(eventID string, splits []Split) error
+	GetSplits(eventID string, bib string) ([]Split, error)
+	GetUsers() ([]*User, error)
+	GetUser(username string) (*User, error)
+	SaveUser(u *User) error
+	CreateFirstUser(u *User) (bool, error)
+	DeleteUser(username string) error
+	CreateSession(session *Session) error
+	GetSession(token string) (*Session, error)
+	DeleteSession(token string) error
+	DeleteUserSessions(username string, except string) error
+	SaveSourceConfig(eventID string, sealed string) error
+	GetSourceConfig(eventID string) (string, error)
 	Checkpoint()
 }
 type PostgresStore struct {
 	db *sql.DB
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-	connStr := "user=postgres dbname=postgres password=postgres sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+// NewPostgresStore connects with the DSN, a URL or key=value pairs. What it
+// leaves out is taken from the PG* environment variables.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -40,228 +80,829 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}, nil
 }
 
+var postgresMigrations = []migration{
+	{
+		`CREATE TABLE IF NOT EXISTS laser (
+			id SERIAL PRIMARY KEY,
+			results_bib TEXT NOT NULL UNIQUE,
+			results_first_name TEXT,
+			results_last_name TEXT,
+			results_time TEXT,
+			results_gun_time TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS history (
+			id SERIAL PRIMARY KEY,
+			bib TEXT NOT NULL UNIQUE REFERENCES laser(results_bib),
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS meta (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN updated_at TIMESTAMP;`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN results_race_name TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_sex TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_category TEXT;`,
+	},
+	// Results and history are keyed by event, the rows stored so far are
+	// moved to the event that was configured last.
+	{
+		`CREATE TABLE events (
+			event_id TEXT PRIMARY KEY,
+			event_name TEXT NOT NULL,
+			source_type TEXT NOT NULL,
+			start_time TEXT NOT NULL DEFAULT '',
+			active BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`INSERT INTO events (event_id, event_name, source_type, active, created_at)
+		SELECT COALESCE((SELECT value FROM meta WHERE key = 'event_id'), 'default'),
+			COALESCE((SELECT value FROM meta WHERE key = 'event_id'), 'default'),
+			'chronotrack', TRUE, NOW()
+		WHERE EXISTS (SELECT 1 FROM laser) OR EXISTS (SELECT 1 FROM meta WHERE key = 'event_id');`,
+		`ALTER TABLE history DROP CONSTRAINT IF EXISTS history_bib_fkey;`,
+		`ALTER TABLE history DROP CONSTRAINT IF EXISTS history_bib_key;`,
+		`ALTER TABLE laser DROP CONSTRAINT IF EXISTS laser_results_bib_key;`,
+		`ALTER TABLE laser ADD COLUMN event_id TEXT REFERENCES events(event_id);`,
+		`UPDATE laser SET event_id = (SELECT event_id FROM events);`,
+		`ALTER TABLE laser ALTER COLUMN event_id SET NOT NULL;`,
+		`ALTER TABLE laser ADD UNIQUE (event_id, results_bib);`,
+		`ALTER TABLE history ADD COLUMN event_id TEXT;`,
+		`UPDATE history SET event_id = (SELECT event_id FROM events);`,
+		`ALTER TABLE history ALTER COLUMN event_id SET NOT NULL;`,
+		`ALTER TABLE history ADD UNIQUE (event_id, bib);`,
+		`ALTER TABLE history ADD FOREIGN KEY (event_id, bib) REFERENCES laser(event_id, results_bib);`,
+		`DELETE FROM meta WHERE key = 'event_id';`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN search_name TEXT;`,
+	},
+	// Lookups no longer count as engraving. What was looked up so far is
+	// taken over as already handed over.
+	{
+		`CREATE TABLE queue (
+			id SERIAL PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			bib TEXT NOT NULL,
+			status TEXT NOT NULL,
+			reason TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (event_id, bib) REFERENCES laser(event_id, results_bib)
+		);`,
+		`CREATE INDEX queue_event_bib ON queue (event_id, bib);`,
+		`INSERT INTO queue (event_id, bib, status, created_at, updated_at)
+		SELECT event_id, bib, 'handed_over', created_at, created_at FROM history ORDER BY created_at;`,
+	},
+	{
+		`CREATE TABLE templates (
+			event_id TEXT NOT NULL REFERENCES events(event_id),
+			race_name TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL,
+			PRIMARY KEY (event_id, race_name)
+		);`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN results_status TEXT;`,
+	},
+	// The places from the source are kept apart from the computed ones, so
+	// a scrape does not see its own rows as changed.
+	{
+		`ALTER TABLE laser ADD COLUMN results_age TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_rank TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_sex_rank TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_category_rank TEXT;`,
+		`ALTER TABLE laser ADD COLUMN place INTEGER;`,
+		`ALTER TABLE laser ADD COLUMN sex_place INTEGER;`,
+		`ALTER TABLE laser ADD COLUMN category_place INTEGER;`,
+	},
+	// Splits can come before the result of the athlete, they are not tied
+	// to the laser rows.
+	{
+		`CREATE TABLE splits (
+			event_id TEXT NOT NULL,
+			bib TEXT NOT NULL,
+			name TEXT NOT NULL,
+			time TEXT NOT NULL,
+			position INTEGER NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, bib, name)
+		);`,
+	},
+	// A reprint is a history entry of its own, the bib is no longer unique.
+	{
+		`ALTER TABLE history DROP CONSTRAINT IF EXISTS history_event_id_bib_key;`,
+		`ALTER TABLE history ADD COLUMN station TEXT;`,
+		`ALTER TABLE history ADD COLUMN reason TEXT;`,
+		`ALTER TABLE history ADD COLUMN job_id INTEGER;`,
+		`CREATE INDEX history_event_bib ON history (event_id, bib);`,
+	},
+	// Operators log in. Queue and history entries name who made them.
+	{
+		`CREATE TABLE users (
+			username TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE sessions (
+			token TEXT PRIMARY KEY,
+			username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+			csrf TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);`,
+		`ALTER TABLE queue ADD COLUMN operator TEXT;`,
+		`ALTER TABLE queue ADD COLUMN station TEXT;`,
+		`ALTER TABLE history ADD COLUMN operator TEXT;`,
+	},
+	// The source configuration is encrypted by the server, see
+	// saveSourceConfig.
+	{
+		`ALTER TABLE events ADD COLUMN source_config TEXT;`,
+	},
+	// Why a job failed is kept apart from why it was queued, only the
+	// latter goes to the history.
+	{
+		`ALTER TABLE queue ADD COLUMN failure TEXT;`,
+	},
+}
+
 func (s *PostgresStore) Init() error {
-	err := s.CreateLaserTable()
-	if err != nil {
+	if err := migrate(s.db, postgresMigrations); err != nil {
 		return err
 	}
-	return s.CreateHistoryTable()
+	return fillSearchNames(s.db)
 }
 
-func (s *PostgresStore) CreateLaserTable() error {
-	query := `CREATE TABLE IF NOT EXISTS laser (
-		id SERIAL PRIMARY KEY,
-		results_bib TEXT NOT NULL UNIQUE,
-		results_first_name TEXT,
-		results_last_name TEXT,
-		results_time TEXT,
-		results_gun_time TEXT
-	);`
-	_, err := s.db.Exec(query)
+func (s *PostgresStore) SaveEvent(e *Event) error {
+	query := `
+		INSERT INTO events (event_id, event_name, source_type, start_time, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (event_id) DO UPDATE SET
+			event_name = excluded.event_name,
+			source_type = excluded.source_type,
+			start_time = excluded.start_time
+		;`
+	_, err := s.db.Exec(query, e.EventID, e.EventName, e.SourceType, e.StartTime, time.Now().UTC())
 	return err
 }
 
-func (s *PostgresStore) CreateHistoryTable() error {
-	query := `CREATE TABLE IF NOT EXISTS history (
-		id SERIAL PRIMARY KEY,
-		bib TEXT NOT NULL UNIQUE REFERENCES laser(results_bib),
-		created_at TIMESTAMP NOT NULL
-	);`
-	_, err := s.db.Exec(query)
-	return err
+func (s *PostgresStore) GetEvents() ([]*Event, error) {
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events ORDER BY created_at, event_id;
+	`
+	resp, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(resp)
 }
 
-func (s *PostgresStore) CreateRecord(a *Athlete) error {
+func (s *PostgresStore) GetActiveEvent() (*Event, error) {
 	query := `
-		INSERT INTO laser (results_bib, results_first_name, results_last_name, results_time, results_gun_time)
-		VALUES ($1, $2, $3, $4, $5)
-		;`
-	_, err := s.db.Exec(query, a.ResultsBib, a.ResultsFirstName, a.ResultsLastName, a.ResultsTime, a.ResultsGunTime)
+		SELECT ` + eventColumns + `
+		FROM events WHERE active;
+	`
+	e, err := scanEvent(s.db.QueryRow(query))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+func (s *PostgresStore) SetActiveEvent(eventID string) error {
+	query := `UPDATE events SET active = (event_id = $1);`
+	_, err := s.db.Exec(query, eventID)
+	return err
+}
+
+func (s *PostgresStore) ResetEvent(eventID string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM history WHERE event_id = $1;`,
+		`DELETE FROM queue WHERE event_id = $1;`,
+		`DELETE FROM splits WHERE event_id = $1;`,
+		`DELETE FROM laser WHERE event_id = $1;`,
+	} {
+		if _, err := tx.Exec(query, eventID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *PostgresStore) CreateHistoryRecord(a *Athlete) error {
-	query := `
-		INSERT INTO history (bib, created_at)
-		VALUES ($1, $2)
-		;`
-	_, err := s.db.Exec(query, a.ResultsBib, time.Now().UTC())
+func (s *PostgresStore) DeleteEvent(eventID string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM history WHERE event_id = $1;`,
+		`DELETE FROM queue WHERE event_id = $1;`,
+		`DELETE FROM splits WHERE event_id = $1;`,
+		`DELETE FROM laser WHERE event_id = $1;`,
+		`DELETE FROM templates WHERE event_id = $1;`,
+		`DELETE FROM events WHERE event_id = $1;`,
+	} {
+		if _, err := tx.Exec(query, eventID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *PostgresStore) GetHistoryRecords() ([]*Athlete, error) {
+func (s *PostgresStore) CreateBulkRecords(eventID string, a *[]Athlete) (UpsertStats, error) {
+	stats := UpsertStats{}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	selectStmt, err := tx.Prepare(`
+		SELECT COALESCE(results_first_name, ''), COALESCE(results_last_name, ''),
+		COALESCE(results_time, ''), COALESCE(results_gun_time, ''),
+		COALESCE(results_race_name, ''), COALESCE(results_sex, ''), COALESCE(results_category, ''),
+		COALESCE(results_status, ''), COALESCE(results_age, ''), COALESCE(results_rank, ''),
+		COALESCE(results_sex_rank, ''), COALESCE(results_category_rank, ''),
+		EXISTS (SELECT 1 FROM history WHERE history.event_id = laser.event_id AND history.bib = laser.results_bib)
+		FROM laser WHERE event_id = $1 AND results_bib = $2
+		FOR UPDATE;
+	`)
+	if err != nil {
+		return stats, err
+	}
+	defer selectStmt.Close()
+	insertStmt, err := tx.Prepare(`
+		INSERT INTO laser (event_id, results_bib, results_first_name, results_last_name, results_time, results_gun_time,
+			results_race_name, results_sex, results_category, updated_at, search_name, results_status,
+			results_age, results_rank, results_sex_rank, results_category_rank)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16);
+	`)
+	if err != nil {
+		return stats, err
+	}
+	defer insertStmt.Close()
+	updateStmt, err := tx.Prepare(`
+		UPDATE laser SET results_first_name = $3, results_last_name = $4, results_time = $5, results_gun_time = $6,
+			results_race_name = $7, results_sex = $8, results_category = $9, updated_at = $10, search_name = $11,
+			results_status = $12, results_age = $13, results_rank = $14, results_sex_rank = $15,
+			results_category_rank = $16
+		WHERE event_id = $1 AND results_bib = $2;
+	`)
+	if err != nil {
+		return stats, err
+	}
+	defer updateStmt.Close()
+
+	now := time.Now().UTC()
+	for _, athlete := range *a {
+		athlete.normalizeStatus()
+		stored := Athlete{}
+		var engraved bool
+		err := selectStmt.QueryRow(eventID, athlete.ResultsBib).Scan(
+			&stored.ResultsFirstName,
+			&stored.ResultsLastName,
+			&stored.ResultsTime,
+			&stored.ResultsGunTime,
+			&stored.ResultsRaceName,
+			&stored.ResultsSex,
+			&stored.ResultsCategory,
+			&stored.ResultsStatus,
+			&stored.ResultsAge,
+			&stored.ResultsRank,
+			&stored.ResultsSexRank,
+			&stored.ResultsCategoryRank,
+			&engraved,
+		)
+		args := []any{eventID, athlete.ResultsBib, athlete.ResultsFirstName, athlete.ResultsLastName, athlete.ResultsTime, athlete.ResultsGunTime,
+			athlete.ResultsRaceName, athlete.ResultsSex, athlete.ResultsCategory, now, athleteNameKey(&athlete), athlete.ResultsStatus,
+			athlete.ResultsAge, athlete.ResultsRank, athlete.ResultsSexRank, athlete.ResultsCategoryRank}
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := insertStmt.Exec(args...); err != nil {
+				return stats, err
+			}
+			stats.New++
+		case err != nil:
+			return stats, err
+		case !stored.sameResult(&athlete):
+			if _, err := updateStmt.Exec(args...); err != nil {
+				return stats, err
+			}
+			stats.Changed++
+			if engraved {
+				stats.EngravedChanged = append(stats.EngravedChanged, athlete.ResultsBib)
+			}
+		}
+	}
+	if err := updatePlaces(tx, eventID); err != nil {
+		return stats, err
+	}
+	return stats, tx.Commit()
+}
+
+// UpdatePlaces works the computed places of the event out again.
+func (s *PostgresStore) UpdatePlaces(eventID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := updatePlaces(tx, eventID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Checkpoint is a no-op, Postgres manages its write-ahead log itself.
+func (s *PostgresStore) Checkpoint() {}
+
+func (s *PostgresStore) GetHistoryRecords(eventID string, raceName string) ([]*HistoryEntry, error) {
 	query := `
-		SELECT history.bib,
-		laser.results_first_name, 
-		laser.results_last_name,
-		laser.results_time,
-		laser.results_gun_time
-		FROM history JOIN laser ON history.bib = laser.results_bib ORDER BY history.created_at DESC;
+		SELECT ` + historyColumns + `
+		FROM ` + historyJoin + `
+		WHERE history.event_id = $1 AND ($2 = '' OR laser.results_race_name = $2)
+		ORDER BY history.created_at DESC, history.id DESC;
 	`
-	resp, err := s.db.Query(query)
+	resp, err := s.db.Query(query, eventID, raceName)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Close()
+	return scanHistoryEntries(resp)
+}
 
-	athletes := []*Athlete{}
-	for resp.Next() {
-		a := new(Athlete)
-		if err := resp.Scan(
-			&a.ResultsBib,
-			&a.ResultsFirstName,
-			&a.ResultsLastName,
-			&a.ResultsTime,
-			&a.ResultsGunTime,
-		); err != nil {
-			return nil, err
-		}
-		athletes = append(athletes, a)
+func (s *PostgresStore) GetEngravings(eventID string, bib string) ([]*HistoryEntry, error) {
+	query := `
+		SELECT ` + historyColumns + `
+		FROM ` + historyJoin + `
+		WHERE history.event_id = $1 AND history.bib = $2
+		ORDER BY history.created_at DESC, history.id DESC;
+	`
+	resp, err := s.db.Query(query, eventID, bib)
+	if err != nil {
+		return nil, err
 	}
+	return scanHistoryEntries(resp)
+}
 
-	for _, a := range athletes {
-		err := processTimeForRecord(a)
-		if err != nil {
-			return nil, err
-		}
+func (s *PostgresStore) GetReprintCount(eventID string) int {
+	var count int
+	query := `SELECT COUNT(*) - COUNT(DISTINCT bib) FROM history WHERE event_id = $1`
+	resp := s.db.QueryRow(query, eventID)
+	err := resp.Scan(&count)
+	if err != nil {
+		log.Println(err)
 	}
-	return athletes, nil
+	return count
 }
 
-func (s *PostgresStore) GetLatestHistoryRecord() (*Athlete, error) {
+func (s *PostgresStore) GetRecordByBib(eventID string, bib string) (*Athlete, error) {
 	query := `
-		SELECT history.bib,
-		laser.results_first_name, 
-		laser.results_last_name,
-		laser.results_time,
-		laser.results_gun_time
-		FROM history JOIN laser ON history.bib = laser.results_bib ORDER BY history.created_at DESC
-		LIMIT 1
+		SELECT ` + athleteColumns + `
+		FROM laser WHERE event_id = $1 AND results_bib = $2;
 	`
-	row := s.db.QueryRow(query)
-	a := new(Athlete)
-	err := row.Scan(
-		&a.ResultsBib,
-		&a.ResultsFirstName,
-		&a.ResultsLastName,
-		&a.ResultsTime,
-		&a.ResultsGunTime,
-	)
+	res := s.db.QueryRow(query, eventID, bib)
+	a, err := scanAthlete(res)
 	if err != nil {
 		return nil, err
 	}
-	err = processTimeForRecord(a)
+	processTimeForRecord(a)
+	return a, nil
+}
+
+func (s *PostgresStore) FindRecordsByBib(bib string) ([]*Athlete, error) {
+	query := `
+		SELECT ` + athleteColumns + `
+		FROM laser JOIN events ON events.event_id = laser.event_id
+		WHERE laser.results_bib = $1
+		ORDER BY events.created_at;
+	`
+	resp, err := s.db.Query(query, bib)
 	if err != nil {
 		return nil, err
 	}
-	return a, nil
+	return scanAthletes(resp)
+}
 
+// FindRecordsByName returns the results whose names contain every word of
+// the query, in the event or in all events if eventID is empty. The history
+// is not touched.
+func (s *PostgresStore) FindRecordsByName(eventID string, query string) ([]*Athlete, error) {
+	terms := nameQueryTerms(query)
+	if len(terms) == 0 {
+		return []*Athlete{}, nil
+	}
+	where := []string{"($1 = '' OR laser.event_id = $1)"}
+	args := []any{eventID}
+	for _, term := range terms {
+		args = append(args, "%"+term+"%")
+		where = append(where, fmt.Sprintf("laser.search_name LIKE $%d", len(args)))
+	}
+	q := `
+		SELECT ` + athleteColumns + `
+		FROM laser JOIN events ON events.event_id = laser.event_id
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY laser.results_last_name, laser.results_first_name, events.created_at
+		LIMIT ` + strconv.Itoa(maxNameMatches) + `;
+	`
+	resp, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAthletes(resp)
 }
 
-func processTimeForRecord(a *Athlete) error {
-	gunTime, err := processTimeStr(a.ResultsGunTime)
+func (s *PostgresStore) GetRecords(eventID string) ([]*Athlete, error) {
+	query := `
+		SELECT ` + athleteColumns + ` FROM laser WHERE event_id = $1;
+	`
+	resp, err := s.db.Query(query, eventID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return scanAthletes(resp)
+}
+
+func (s *PostgresStore) GetRaceNames(eventID string) ([]string, error) {
+	query := `
+		SELECT DISTINCT results_race_name FROM laser
+		WHERE event_id = $1 AND results_race_name IS NOT NULL AND results_race_name <> ''
+		ORDER BY results_race_name;
+	`
+	resp, err := s.db.Query(query, eventID)
+	if err != nil {
+		return nil, err
 	}
-	netTime, err := processTimeStr(a.ResultsTime)
+	return scanStrings(resp)
+}
+
+func (s *PostgresStore) GetRecordsCount(eventID string) int {
+	var count int
+	query := `SELECT COUNT(*) FROM laser WHERE event_id = $1`
+	resp := s.db.QueryRow(query, eventID)
+	err := resp.Scan(&count)
 	if err != nil {
-		return err
+		log.Println(err)
 	}
-	a.ResultsGunTime = gunTime
-	a.ResultsTime = netTime
-	return nil
+	return count
 }
 
-func (s *PostgresStore) GetRecordByBib(bib string) (*Athlete, error) {
+func (s *PostgresStore) ClearHistory(eventID string) error {
+	query := `DELETE FROM history WHERE event_id = $1;`
+	_, err := s.db.Exec(query, eventID)
+	return err
+}
+
+func (s *PostgresStore) EnqueueJob(eventID string, bib string, reason string, by Stamp) (*QueueJob, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// locking the result row keeps two stations from queueing it at once
+	var id int
+	row := tx.QueryRow(`SELECT id FROM laser WHERE event_id = $1 AND results_bib = $2 FOR UPDATE;`, eventID, bib)
+	if err := row.Scan(&id); err != nil {
+		return nil, err
+	}
+	resp, err := tx.Query(`SELECT status FROM queue WHERE event_id = $1 AND bib = $2;`, eventID, bib)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := scanStrings(resp)
+	if err != nil {
+		return nil, err
+	}
+	var engraved bool
+	row = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM history WHERE event_id = $1 AND bib = $2);`, eventID, bib)
+	if err := row.Scan(&engraved); err != nil {
+		return nil, err
+	}
+	if err := checkEnqueue(jobStatuses(statuses), engraved, reason); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	row = tx.QueryRow(`
+		INSERT INTO queue (event_id, bib, status, reason, created_at, updated_at, operator, station)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id;
+	`, eventID, bib, JobQueued, reason, now, now, by.Operator, by.Station)
+	if err := row.Scan(&id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetJob(id)
+}
+
+func (s *PostgresStore) UpdateJobStatus(id int, status JobStatus, reason string, by Stamp) (*QueueJob, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var eventID, bib string
+	var current JobStatus
+	row := tx.QueryRow(`SELECT event_id, bib, status FROM queue WHERE id = $1 FOR UPDATE;`, id)
+	if err := row.Scan(&eventID, &bib, &current); err != nil {
+		return nil, err
+	}
+	if err := checkJobTransition(current, status); err != nil {
+		return nil, err
+	}
+	failure := sql.NullString{}
+	if status == JobFailed {
+		failure = sql.NullString{String: reason, Valid: true}
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE queue SET status = $2, failure = COALESCE($3, failure), updated_at = $4
+		WHERE id = $1;
+	`, id, status, failure, now)
+	if err != nil {
+		return nil, err
+	}
+	if status == JobEngraved {
+		_, err = tx.Exec(`
+			INSERT INTO history (event_id, bib, created_at, station, operator, reason, job_id)
+			SELECT event_id, bib, $2, $3, $4, reason, id FROM queue WHERE id = $1;
+		`, id, now, by.Station, by.Operator)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetJob(id)
+}
+
+func (s *PostgresStore) GetJob(id int) (*QueueJob, error) {
+	query := `
+		SELECT ` + jobColumns + `
+		FROM ` + jobJoin + `
+		WHERE queue.id = $1;
+	`
+	return scanJob(s.db.QueryRow(query, id))
+}
+
+func (s *PostgresStore) GetQueue(eventID string) ([]*QueueJob, error) {
 	query := `
-		SELECT results_bib, results_first_name, results_last_name, results_time, results_gun_time
-		FROM laser WHERE results_bib = $1;
+		SELECT ` + jobColumns + `
+		FROM ` + jobJoin + `
+		WHERE queue.event_id = $1 AND queue.status <> 'handed_over'
+		ORDER BY CASE queue.status WHEN 'engraving' THEN 0 WHEN 'queued' THEN 1 WHEN 'failed' THEN 2 ELSE 3 END, queue.id;
 	`
-	res := s.db.QueryRow(query, bib)
-	a := new(Athlete)
-	err := res.Scan(
-		&a.ResultsBib,
-		&a.ResultsFirstName,
-		&a.ResultsLastName,
-		&a.ResultsTime,
-		&a.ResultsGunTime,
-	)
+	resp, err := s.db.Query(query, eventID)
 	if err != nil {
 		return nil, err
 	}
-	err = processTimeForRecord(a)
+	return scanJobs(resp)
+}
+
+func (s *PostgresStore) GetJobsByBib(eventID string, bib string) ([]*QueueJob, error) {
+	query := `
+		SELECT ` + jobColumns + `
+		FROM ` + jobJoin + `
+		WHERE queue.event_id = $1 AND queue.bib = $2
+		ORDER BY queue.id DESC;
+	`
+	resp, err := s.db.Query(query, eventID, bib)
 	if err != nil {
 		return nil, err
 	}
-	s.CreateHistoryRecord(a)
-	return a, nil
+	return scanJobs(resp)
 }
 
-func processTimeStr(timeToParse string) (string, error) {
-	t, err := time.Parse(time.TimeOnly, timeToParse)
+// SaveSplits creates or updates the splits, the others of the event are
+// kept.
+func (s *PostgresStore) SaveSplits(eventID string, splits []Split) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		INSERT INTO splits (event_id, bib, name, time, position, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (event_id, bib, name) DO UPDATE SET time = excluded.time, position = excluded.position,
+			updated_at = excluded.updated_at;
+	`)
+	if err != nil {
+		return err
 	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, split := range splits {
+		if _, err := stmt.Exec(eventID, split.Bib, split.Name, split.Time, split.Order, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-	ms := t.Nanosecond()
-	truncTime := t.Truncate(time.Second)
-	if ms > 0 {
-		truncTime = truncTime.Add(time.Second)
+// GetSplits returns the splits of the athlete in course order.
+func (s *PostgresStore) GetSplits(eventID string, bib string) ([]Split, error) {
+	query := `
+		SELECT bib, name, time, position FROM splits
+		WHERE event_id = $1 AND bib = $2
+		ORDER BY position, name;
+	`
+	resp, err := s.db.Query(query, eventID, bib)
+	if err != nil {
+		return nil, err
 	}
-	return truncTime.Format(time.TimeOnly), nil
+	defer resp.Close()
 
+	splits := []Split{}
+	for resp.Next() {
+		split := Split{}
+		if err := resp.Scan(&split.Bib, &split.Name, &split.Time, &split.Order); err != nil {
+			return nil, err
+		}
+		splits = append(splits, split)
+	}
+	return splits, resp.Err()
 }
 
-func (s *PostgresStore) GetRecords() ([]*Athlete, error) {
+func (s *PostgresStore) GetTemplates(eventID string) ([]*EngravingTemplate, error) {
 	query := `
-		SELECT * FROM laser;
+		SELECT event_id, race_name, body FROM templates
+		WHERE event_id = $1
+		ORDER BY race_name;
 	`
-	resp, err := s.db.Query(query)
+	resp, err := s.db.Query(query, eventID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Close()
 
-	athletes := []*Athlete{}
+	templates := []*EngravingTemplate{}
 	for resp.Next() {
-		a := new(Athlete)
-		if err := resp.Scan(
-			&a.ResultsBib,
-			&a.ResultsFirstName,
-			&a.ResultsLastName,
-			&a.ResultsTime,
-			&a.ResultsGunTime,
-		); err != nil {
+		t := new(EngravingTemplate)
+		if err := resp.Scan(&t.EventID, &t.RaceName, &t.Body); err != nil {
 			return nil, err
 		}
-		athletes = append(athletes, a)
+		templates = append(templates, t)
+	}
+	return templates, resp.Err()
+}
+
+func (s *PostgresStore) SaveTemplate(t *EngravingTemplate) error {
+	query := `
+		INSERT INTO templates (event_id, race_name, body)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (event_id, race_name) DO UPDATE SET body = excluded.body;
+	`
+	_, err := s.db.Exec(query, t.EventID, t.RaceName, t.Body)
+	return err
+}
+
+func (s *PostgresStore) DeleteTemplate(eventID string, raceName string) error {
+	query := `DELETE FROM templates WHERE event_id = $1 AND race_name = $2;`
+	_, err := s.db.Exec(query, eventID, raceName)
+	return err
+}
+
+func (s *PostgresStore) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = $1;`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
+	return value, err
+}
 
-	return athletes, nil
+func (s *PostgresStore) SetSetting(key string, value string) error {
+	query := `
+		INSERT INTO meta (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value;
+	`
+	_, err := s.db.Exec(query, key, value)
+	return err
 }
 
-func (s *PostgresStore) GetRecordsCount() int {
-	var count int
-	query := `SELECT COUNT(*) FROM laser`
-	resp := s.db.QueryRow(query)
-	err := resp.Scan(&count)
+func (s *PostgresStore) GetUsers() ([]*User, error) {
+	resp, err := s.db.Query(`SELECT username, password_hash, role, created_at FROM users ORDER BY username;`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return count
+	return scanUsers(resp)
+}
+
+func (s *PostgresStore) GetUser(username string) (*User, error) {
+	u := new(User)
+	row := s.db.QueryRow(`SELECT username, password_hash, role, created_at FROM users WHERE username = $1;`, username)
+	if err := row.Scan(&u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *PostgresStore) SaveUser(u *User) error {
+	query := `
+		INSERT INTO users (username, password_hash, role, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role;
+	`
+	_, err := s.db.Exec(query, u.Username, u.PasswordHash, u.Role, time.Now().UTC())
+	return err
+}
+
+func (s *PostgresStore) CreateFirstUser(u *User) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`LOCK TABLE users IN EXCLUSIVE MODE;`); err != nil {
+		return false, err
+	}
+	query := `
+		INSERT INTO users (username, password_hash, role, created_at)
+		SELECT $1, $2, $3, $4 WHERE NOT EXISTS (SELECT 1 FROM users);
+	`
+	res, err := tx.Exec(query, u.Username, u.PasswordHash, u.Role, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, tx.Commit()
 }
 
-func (s *PostgresStore) ClearHistory() {
-	query := `TRUNCATE TABLE history;`
-	_, err := s.db.Exec(query)
+func (s *PostgresStore) DeleteUser(username string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM sessions WHERE username = $1;`,
+		`DELETE FROM users WHERE username = $1;`,
+	} {
+		if _, err := tx.Exec(query, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) CreateSession(session *Session) error {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at < $1;`, time.Now().UTC()); err != nil {
+		return err
+	}
+	query := `INSERT INTO sessions (token, username, csrf, expires_at) VALUES ($1, $2, $3, $4);`
+	_, err := s.db.Exec(query, session.Token, session.Username, session.CSRF, session.ExpiresAt.UTC())
+	return err
+}
 
+func (s *PostgresStore) GetSession(token string) (*Session, error) {
+	session := new(Session)
+	row := s.db.QueryRow(`SELECT token, username, csrf, expires_at FROM sessions WHERE token = $1 AND expires_at > $2;`,
+		token, time.Now().UTC())
+	if err := row.Scan(&session.Token, &session.Username, &session.CSRF, &session.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *PostgresStore) DeleteSession(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = $1;`, token)
+	return err
+}
+
+func (s *PostgresStore) DeleteUserSessions(username string, except string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE username = $1 AND token <> $2;`, username, except)
+	return err
+}
+
+func (s *PostgresStore) SaveSourceConfig(eventID string, sealed string) error {
+	_, err := s.db.Exec(`UPDATE events SET source_config = $1 WHERE event_id = $2;`, sealed, eventID)
+	return err
+}
+
+func (s *PostgresStore) GetSourceConfig(eventID string) (string, error) {
+	var sealed sql.NullString
+	err := s.db.QueryRow(`SELECT source_config FROM events WHERE event_id = $1;`, eventID).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return sealed.String, err
 }
@@ -2,10 +2,8 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
-	"math"
-	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,8 +14,14 @@ type SqliteStore struct {
 	db *sql.DB
 }
 
-func NewSqliteStore() (*SqliteStore, error) {
-	db, err := sql.Open("sqlite3", "laser.db?cache=shared&mode=rwc&_journal=WAL&_timeout=2000")
+// sqliteParams are added to a DSN that has no parameters of its own.
+const sqliteParams = "?cache=shared&mode=rwc&_journal=WAL&_timeout=2000"
+
+func NewSqliteStore(dsn string) (*SqliteStore, error) {
+	if !strings.Contains(dsn, "?") {
+		dsn += sqliteParams
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -31,87 +35,395 @@ func NewSqliteStore() (*SqliteStore, error) {
 	}, nil
 }
 
+// sqliteMigrations holds the schema history of the SQLite store. The first
+// migration uses IF NOT EXISTS so databases created before versioning are
+// adopted as they are.
+var sqliteMigrations = []migration{
+	{
+		`CREATE TABLE IF NOT EXISTS laser (
+			id INTEGER PRIMARY KEY,
+			results_bib TEXT NOT NULL UNIQUE,
+			results_first_name TEXT NOT NULL,
+			results_last_name TEXT NOT NULL,
+			results_time TEXT,
+			results_gun_time TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			bib TEXT NOT NULL UNIQUE REFERENCES laser(results_bib),
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS meta (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN updated_at TIMESTAMP;`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN results_race_name TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_sex TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_category TEXT;`,
+	},
+	// Results and history are keyed by event. SQLite cannot change
+	// constraints in place, so both tables are rebuilt and the rows stored so
+	// far are moved to the event that was configured last.
+	{
+		`CREATE TABLE events (
+			event_id TEXT PRIMARY KEY,
+			event_name TEXT NOT NULL,
+			source_type TEXT NOT NULL,
+			start_time TEXT NOT NULL DEFAULT '',
+			active INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`INSERT INTO events (event_id, event_name, source_type, active, created_at)
+		SELECT COALESCE((SELECT value FROM meta WHERE key = 'event_id'), 'default'),
+			COALESCE((SELECT value FROM meta WHERE key = 'event_id'), 'default'),
+			'chronotrack', 1, CURRENT_TIMESTAMP
+		WHERE EXISTS (SELECT 1 FROM laser) OR EXISTS (SELECT 1 FROM meta WHERE key = 'event_id');`,
+		`CREATE TABLE laser_new (
+			id INTEGER PRIMARY KEY,
+			event_id TEXT NOT NULL REFERENCES events(event_id),
+			results_bib TEXT NOT NULL,
+			results_first_name TEXT NOT NULL,
+			results_last_name TEXT NOT NULL,
+			results_time TEXT,
+			results_gun_time TEXT,
+			updated_at TIMESTAMP,
+			results_race_name TEXT,
+			results_sex TEXT,
+			results_category TEXT,
+			UNIQUE (event_id, results_bib)
+		);`,
+		`INSERT INTO laser_new (id, event_id, results_bib, results_first_name, results_last_name, results_time,
+			results_gun_time, updated_at, results_race_name, results_sex, results_category)
+		SELECT id, (SELECT event_id FROM events), results_bib, results_first_name, results_last_name, results_time,
+			results_gun_time, updated_at, results_race_name, results_sex, results_category
+		FROM laser;`,
+		`CREATE TABLE history_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id TEXT NOT NULL,
+			bib TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (event_id, bib),
+			FOREIGN KEY (event_id, bib) REFERENCES laser(event_id, results_bib)
+		);`,
+		`INSERT INTO history_new (id, event_id, bib, created_at)
+		SELECT id, (SELECT event_id FROM events), bib, created_at FROM history;`,
+		`DROP TABLE history;`,
+		`DROP TABLE laser;`,
+		`ALTER TABLE laser_new RENAME TO laser;`,
+		`ALTER TABLE history_new RENAME TO history;`,
+		`DELETE FROM meta WHERE key = 'event_id';`,
+	},
+	// search_name is filled in Go by fillSearchNames, SQLite lower() only
+	// knows ASCII.
+	{
+		`ALTER TABLE laser ADD COLUMN search_name TEXT;`,
+	},
+	// Lookups no longer count as engraving. What was looked up so far is
+	// taken over as already handed over.
+	{
+		`CREATE TABLE queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id TEXT NOT NULL,
+			bib TEXT NOT NULL,
+			status TEXT NOT NULL,
+			reason TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (event_id, bib) REFERENCES laser(event_id, results_bib)
+		);`,
+		`CREATE INDEX queue_event_bib ON queue (event_id, bib);`,
+		`INSERT INTO queue (event_id, bib, status, created_at, updated_at)
+		SELECT event_id, bib, 'handed_over', created_at, created_at FROM history ORDER BY created_at;`,
+	},
+	{
+		`CREATE TABLE templates (
+			event_id TEXT NOT NULL REFERENCES events(event_id),
+			race_name TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL,
+			PRIMARY KEY (event_id, race_name)
+		);`,
+	},
+	{
+		`ALTER TABLE laser ADD COLUMN results_status TEXT;`,
+	},
+	// The places from the source are kept apart from the computed ones, so
+	// a scrape does not see its own rows as changed.
+	{
+		`ALTER TABLE laser ADD COLUMN results_age TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_rank TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_sex_rank TEXT;`,
+		`ALTER TABLE laser ADD COLUMN results_category_rank TEXT;`,
+		`ALTER TABLE laser ADD COLUMN place INTEGER;`,
+		`ALTER TABLE laser ADD COLUMN sex_place INTEGER;`,
+		`ALTER TABLE laser ADD COLUMN category_place INTEGER;`,
+	},
+	// Splits can come before the result of the athlete, they are not tied
+	// to the laser rows.
+	{
+		`CREATE TABLE splits (
+			event_id TEXT NOT NULL,
+			bib TEXT NOT NULL,
+			name TEXT NOT NULL,
+			time TEXT NOT NULL,
+			position INTEGER NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, bib, name)
+		);`,
+	},
+	// A reprint is a history entry of its own, the bib is no longer unique.
+	{
+		`CREATE TABLE history_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id TEXT NOT NULL,
+			bib TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			station TEXT,
+			reason TEXT,
+			job_id INTEGER,
+			FOREIGN KEY (event_id, bib) REFERENCES laser(event_id, results_bib)
+		);`,
+		`INSERT INTO history_new (id, event_id, bib, created_at)
+		SELECT id, event_id, bib, created_at FROM history;`,
+		`DROP TABLE history;`,
+		`ALTER TABLE history_new RENAME TO history;`,
+		`CREATE INDEX history_event_bib ON history (event_id, bib);`,
+	},
+	// Operators log in. Queue and history entries name who made them.
+	{
+		`CREATE TABLE users (
+			username TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE sessions (
+			token TEXT PRIMARY KEY,
+			username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+			csrf TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);`,
+		`ALTER TABLE queue ADD COLUMN operator TEXT;`,
+		`ALTER TABLE queue ADD COLUMN station TEXT;`,
+		`ALTER TABLE history ADD COLUMN operator TEXT;`,
+	},
+	// The source configuration is encrypted by the server, see
+	// saveSourceConfig.
+	{
+		`ALTER TABLE events ADD COLUMN source_config TEXT;`,
+	},
+	// Why a job failed is kept apart from why it was queued, only the
+	// latter goes to the history.
+	{
+		`ALTER TABLE queue ADD COLUMN failure TEXT;`,
+	},
+}
+
 func (s *SqliteStore) Init() error {
-	err := s.CreateLaserTable()
-	if err != nil {
+	if err := migrate(s.db, sqliteMigrations); err != nil {
 		return err
 	}
-	return s.CreateHistoryTable()
+	return fillSearchNames(s.db)
 }
 
-func (s *SqliteStore) CreateLaserTable() error {
-	query := `CREATE TABLE IF NOT EXISTS laser (
-		id INTEGER PRIMARY KEY,
-		results_bib TEXT NOT NULL UNIQUE,
-		results_first_name TEXT NOT NULL,
-		results_last_name TEXT NOT NULL,
-		results_time TEXT,
-		results_gun_time TEXT
-	);`
+// SaveEvent creates the event or updates its name, source and start time.
+func (s *SqliteStore) SaveEvent(e *Event) error {
+	query := `
+		INSERT INTO events (event_id, event_name, source_type, start_time, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (event_id) DO UPDATE SET
+			event_name = excluded.event_name,
+			source_type = excluded.source_type,
+			start_time = excluded.start_time
+		;`
+	_, err := s.db.Exec(query, e.EventID, e.EventName, e.SourceType, e.StartTime, time.Now().UTC())
+	return err
+}
 
-	queryClear := `DELETE FROM laser`
-	_, err := s.db.Exec(query)
+// GetEvents returns all events in the order they were added.
+func (s *SqliteStore) GetEvents() ([]*Event, error) {
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events ORDER BY created_at, event_id;
+	`
+	resp, err := s.db.Query(query)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return scanEvents(resp)
+}
+
+// GetActiveEvent returns the event searches and history refer to by default,
+// or nil if there is none.
+func (s *SqliteStore) GetActiveEvent() (*Event, error) {
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events WHERE active = 1;
+	`
+	e, err := scanEvent(s.db.QueryRow(query))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	_, err = s.db.Exec(queryClear)
+	return e, err
+}
+
+func (s *SqliteStore) SetActiveEvent(eventID string) error {
+	query := `UPDATE events SET active = (event_id = $1);`
+	_, err := s.db.Exec(query, eventID)
 	return err
 }
 
-func (s *SqliteStore) CreateHistoryTable() error {
-	query := `CREATE TABLE IF NOT EXISTS history (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		bib TEXT NOT NULL UNIQUE REFERENCES laser(results_bib),
-		created_at TIMESTAMP NOT NULL
-	);`
-	queryClear := `DELETE FROM history`
-	_, err := s.db.Exec(query)
+// ResetEvent deletes all results and history of the event.
+func (s *SqliteStore) ResetEvent(eventID string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = s.db.Exec(queryClear)
-	return err
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM history WHERE event_id = $1;`,
+		`DELETE FROM queue WHERE event_id = $1;`,
+		`DELETE FROM splits WHERE event_id = $1;`,
+		`DELETE FROM laser WHERE event_id = $1;`,
+	} {
+		if _, err := tx.Exec(query, eventID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *SqliteStore) CreateRecord(a *Athlete) error {
-
-	randID := rand.Intn(math.MaxInt64)
-	query := `
-		INSERT INTO laser (id, results_bib, results_first_name, results_last_name, results_time, results_gun_time)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		;`
-	_, err := s.db.Exec(query, randID, a.ResultsBib, a.ResultsFirstName, a.ResultsLastName, a.ResultsTime, a.ResultsGunTime)
+// DeleteEvent deletes the event together with its results and history.
+func (s *SqliteStore) DeleteEvent(eventID string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM history WHERE event_id = $1;`,
+		`DELETE FROM queue WHERE event_id = $1;`,
+		`DELETE FROM splits WHERE event_id = $1;`,
+		`DELETE FROM laser WHERE event_id = $1;`,
+		`DELETE FROM templates WHERE event_id = $1;`,
+		`DELETE FROM events WHERE event_id = $1;`,
+	} {
+		if _, err := tx.Exec(query, eventID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *SqliteStore) CreateBulkRecords(a *[]Athlete) error {
-	// valueStrings := make([]string, 0, len(*a))
-	var valueStrings string
-	valueArgs := make([]interface{}, 0, len(*a)*6)
+// CreateBulkRecords inserts new results of the event and updates the ones
+// whose names, times or race details differ from the stored row.
+func (s *SqliteStore) CreateBulkRecords(eventID string, a *[]Athlete) (UpsertStats, error) {
+	stats := UpsertStats{}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
 
-	valueStrings = strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?),", len(*a)), ",")
-	for _, athlete := range *a {
-		// valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?)")
-		valueArgs = append(valueArgs, rand.Intn(math.MaxInt64))
-		valueArgs = append(valueArgs, athlete.ResultsBib)
-		valueArgs = append(valueArgs, athlete.ResultsFirstName)
-		valueArgs = append(valueArgs, athlete.ResultsLastName)
-		valueArgs = append(valueArgs, athlete.ResultsTime)
-		valueArgs = append(valueArgs, athlete.ResultsGunTime)
+	selectStmt, err := tx.Prepare(`
+		SELECT results_first_name, results_last_name,
+		COALESCE(results_time, ''), COALESCE(results_gun_time, ''),
+		COALESCE(results_race_name, ''), COALESCE(results_sex, ''), COALESCE(results_category, ''),
+		COALESCE(results_status, ''), COALESCE(results_age, ''), COALESCE(results_rank, ''),
+		COALESCE(results_sex_rank, ''), COALESCE(results_category_rank, ''),
+		EXISTS (SELECT 1 FROM history WHERE history.event_id = laser.event_id AND history.bib = laser.results_bib)
+		FROM laser WHERE event_id = ? AND results_bib = ?;
+	`)
+	if err != nil {
+		return stats, err
+	}
+	defer selectStmt.Close()
+	insertStmt, err := tx.Prepare(`
+		INSERT INTO laser (event_id, results_bib, results_first_name, results_last_name, results_time, results_gun_time,
+			results_race_name, results_sex, results_category, results_status, results_age, results_rank,
+			results_sex_rank, results_category_rank, updated_at, search_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`)
+	if err != nil {
+		return stats, err
+	}
+	defer insertStmt.Close()
+	updateStmt, err := tx.Prepare(`
+		UPDATE laser SET results_first_name = ?, results_last_name = ?, results_time = ?, results_gun_time = ?,
+			results_race_name = ?, results_sex = ?, results_category = ?, results_status = ?, results_age = ?, results_rank = ?,
+			results_sex_rank = ?, results_category_rank = ?, updated_at = ?, search_name = ?
+		WHERE event_id = ? AND results_bib = ?;
+	`)
+	if err != nil {
+		return stats, err
 	}
-	// this query for append option to create valueStrings
-	// query := fmt.Sprintf("INSERT INTO laser (id, results_bib, results_first_name, results_last_name, results_time, results_gun_time) VALUES %s;", strings.Join(valueStrings, ","))
+	defer updateStmt.Close()
 
-	query := fmt.Sprintf("INSERT INTO laser (id, results_bib, results_first_name, results_last_name, results_time, results_gun_time) VALUES %s;", valueStrings)
+	now := time.Now().UTC()
+	for _, athlete := range *a {
+		athlete.normalizeStatus()
+		stored := Athlete{}
+		var engraved bool
+		err := selectStmt.QueryRow(eventID, athlete.ResultsBib).Scan(
+			&stored.ResultsFirstName,
+			&stored.ResultsLastName,
+			&stored.ResultsTime,
+			&stored.ResultsGunTime,
+			&stored.ResultsRaceName,
+			&stored.ResultsSex,
+			&stored.ResultsCategory,
+			&stored.ResultsStatus,
+			&stored.ResultsAge,
+			&stored.ResultsRank,
+			&stored.ResultsSexRank,
+			&stored.ResultsCategoryRank,
+			&engraved,
+		)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = insertStmt.Exec(eventID, athlete.ResultsBib, athlete.ResultsFirstName, athlete.ResultsLastName, athlete.ResultsTime, athlete.ResultsGunTime,
+				athlete.ResultsRaceName, athlete.ResultsSex, athlete.ResultsCategory, athlete.ResultsStatus,
+				athlete.ResultsAge, athlete.ResultsRank, athlete.ResultsSexRank, athlete.ResultsCategoryRank, now, athleteNameKey(&athlete))
+			if err != nil {
+				return stats, err
+			}
+			stats.New++
+		case err != nil:
+			return stats, err
+		case !stored.sameResult(&athlete):
+			_, err = updateStmt.Exec(athlete.ResultsFirstName, athlete.ResultsLastName, athlete.ResultsTime, athlete.ResultsGunTime,
+				athlete.ResultsRaceName, athlete.ResultsSex, athlete.ResultsCategory, athlete.ResultsStatus,
+				athlete.ResultsAge, athlete.ResultsRank, athlete.ResultsSexRank, athlete.ResultsCategoryRank, now, athleteNameKey(&athlete), eventID, athlete.ResultsBib)
+			if err != nil {
+				return stats, err
+			}
+			stats.Changed++
+			if engraved {
+				stats.EngravedChanged = append(stats.EngravedChanged, athlete.ResultsBib)
+			}
+		}
+	}
+	if err := updatePlaces(tx, eventID); err != nil {
+		return stats, err
+	}
+	return stats, tx.Commit()
+}
 
-	_, err := s.db.Exec(query, valueArgs...)
+// UpdatePlaces works the computed places of the event out again.
+func (s *SqliteStore) UpdatePlaces(eventID string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	if err := updatePlaces(tx, eventID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *SqliteStore) Checkpoint() {
@@ -121,155 +433,508 @@ func (s *SqliteStore) Checkpoint() {
 	}
 }
 
-func (s *SqliteStore) CreateHistoryRecord(a *Athlete) error {
+// GetHistoryRecords returns the history of the event, newest first. A
+// non-empty raceName limits it to that race.
+func (s *SqliteStore) GetHistoryRecords(eventID string, raceName string) ([]*HistoryEntry, error) {
 	query := `
-		INSERT INTO history (bib, created_at)
-		VALUES ($1, $2)
-		;`
-	_, err := s.db.Exec(query, a.ResultsBib, time.Now().UTC())
+		SELECT ` + historyColumns + `
+		FROM ` + historyJoin + `
+		WHERE history.event_id = ? AND (? = '' OR laser.results_race_name = ?)
+		ORDER BY history.created_at DESC, history.id DESC;
+	`
+	resp, err := s.db.Query(query, eventID, raceName, raceName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return scanHistoryEntries(resp)
 }
 
-func (s *SqliteStore) GetHistoryRecords() ([]*Athlete, error) {
+// GetEngravings returns every plaque engraved for the bib, newest first.
+func (s *SqliteStore) GetEngravings(eventID string, bib string) ([]*HistoryEntry, error) {
 	query := `
-		SELECT history.bib,
-		laser.results_first_name, 
-		laser.results_last_name,
-		laser.results_time,
-		laser.results_gun_time
-		FROM history JOIN laser ON history.bib = laser.results_bib ORDER BY history.created_at DESC;
+		SELECT ` + historyColumns + `
+		FROM ` + historyJoin + `
+		WHERE history.event_id = $1 AND history.bib = $2
+		ORDER BY history.created_at DESC, history.id DESC;
 	`
-	resp, err := s.db.Query(query)
+	resp, err := s.db.Query(query, eventID, bib)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Close()
+	return scanHistoryEntries(resp)
+}
 
-	athletes := []*Athlete{}
-	for resp.Next() {
-		a := new(Athlete)
-		if err := resp.Scan(
-			&a.ResultsBib,
-			&a.ResultsFirstName,
-			&a.ResultsLastName,
-			&a.ResultsTime,
-			&a.ResultsGunTime,
-		); err != nil {
-			return nil, err
-		}
-		athletes = append(athletes, a)
+// GetReprintCount returns how many plaques of the event were engraved again,
+// the material spent on top of one plaque per athlete.
+func (s *SqliteStore) GetReprintCount(eventID string) int {
+	var count int
+	query := `SELECT COUNT(*) - COUNT(DISTINCT bib) FROM history WHERE event_id = $1`
+	resp := s.db.QueryRow(query, eventID)
+	err := resp.Scan(&count)
+	if err != nil {
+		log.Println(err)
+	}
+	return count
+}
+
+func (s *SqliteStore) GetRecordByBib(eventID string, bib string) (*Athlete, error) {
+	query := `
+		SELECT ` + athleteColumns + `
+		FROM laser WHERE event_id = $1 AND results_bib = $2;
+	`
+	res := s.db.QueryRow(query, eventID, bib)
+	a, err := scanAthlete(res)
+	if err != nil {
+		return nil, err
+	}
+	processTimeForRecord(a)
+	return a, nil
+}
+
+// FindRecordsByBib looks the bib up in every event without touching the
+// history.
+func (s *SqliteStore) FindRecordsByBib(bib string) ([]*Athlete, error) {
+	query := `
+		SELECT ` + athleteColumns + `
+		FROM laser JOIN events ON events.event_id = laser.event_id
+		WHERE laser.results_bib = $1
+		ORDER BY events.created_at;
+	`
+	resp, err := s.db.Query(query, bib)
+	if err != nil {
+		return nil, err
 	}
+	return scanAthletes(resp)
+}
 
-	for _, a := range athletes {
-		err := processTimeForRecord(a)
+// FindRecordsByName returns the results whose names contain every word of
+// the query, in the event or in all events if eventID is empty. The history
+// is not touched.
+func (s *SqliteStore) FindRecordsByName(eventID string, query string) ([]*Athlete, error) {
+	terms := nameQueryTerms(query)
+	if len(terms) == 0 {
+		return []*Athlete{}, nil
+	}
+	where := []string{"(? = '' OR laser.event_id = ?)"}
+	args := []any{eventID, eventID}
+	for _, term := range terms {
+		where = append(where, "laser.search_name LIKE ?")
+		args = append(args, "%"+term+"%")
+	}
+	q := `
+		SELECT ` + athleteColumns + `
+		FROM laser JOIN events ON events.event_id = laser.event_id
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY laser.results_last_name, laser.results_first_name, events.created_at
+		LIMIT ` + strconv.Itoa(maxNameMatches) + `;
+	`
+	resp, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAthletes(resp)
+}
+
+func (s *SqliteStore) GetRecords(eventID string) ([]*Athlete, error) {
+	query := `
+		SELECT ` + athleteColumns + ` FROM laser WHERE event_id = $1;
+	`
+	resp, err := s.db.Query(query, eventID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAthletes(resp)
+}
+
+// GetRaceNames returns the distinct race names of the event results.
+func (s *SqliteStore) GetRaceNames(eventID string) ([]string, error) {
+	query := `
+		SELECT DISTINCT results_race_name FROM laser
+		WHERE event_id = $1 AND results_race_name IS NOT NULL AND results_race_name <> ''
+		ORDER BY results_race_name;
+	`
+	resp, err := s.db.Query(query, eventID)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(resp)
+}
+
+func (s *SqliteStore) GetRecordsCount(eventID string) int {
+	var count int
+	query := `SELECT COUNT(*) FROM laser WHERE event_id = $1`
+	resp := s.db.QueryRow(query, eventID)
+	err := resp.Scan(&count)
+	if err != nil {
+		log.Println(err)
+	}
+	return count
+}
+
+func (s *SqliteStore) ClearHistory(eventID string) error {
+	query := `DELETE FROM history WHERE event_id = $1;`
+	_, err := s.db.Exec(query, eventID)
+	return err
+}
+
+// EnqueueJob adds the athlete to the engraving queue. An athlete already
+// waiting is refused, a reprint needs a reason.
+func (s *SqliteStore) EnqueueJob(eventID string, bib string, reason string, by Stamp) (*QueueJob, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	row := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM laser WHERE event_id = $1 AND results_bib = $2);`, eventID, bib)
+	if err := row.Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+	resp, err := tx.Query(`SELECT status FROM queue WHERE event_id = $1 AND bib = $2;`, eventID, bib)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := scanStrings(resp)
+	if err != nil {
+		return nil, err
+	}
+	var engraved bool
+	row = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM history WHERE event_id = $1 AND bib = $2);`, eventID, bib)
+	if err := row.Scan(&engraved); err != nil {
+		return nil, err
+	}
+	if err := checkEnqueue(jobStatuses(statuses), engraved, reason); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(`
+		INSERT INTO queue (event_id, bib, status, reason, created_at, updated_at, operator, station)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+	`, eventID, bib, JobQueued, reason, now, now, by.Operator, by.Station)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetJob(int(id))
+}
+
+// UpdateJobStatus moves the job to the status. The reason is kept as the
+// failure of a failed job. An engraved job is added to the history with who
+// engraved it where and the reason it was queued for.
+func (s *SqliteStore) UpdateJobStatus(id int, status JobStatus, reason string, by Stamp) (*QueueJob, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var eventID, bib string
+	var current JobStatus
+	row := tx.QueryRow(`SELECT event_id, bib, status FROM queue WHERE id = $1;`, id)
+	if err := row.Scan(&eventID, &bib, &current); err != nil {
+		return nil, err
+	}
+	if err := checkJobTransition(current, status); err != nil {
+		return nil, err
+	}
+	failure := sql.NullString{}
+	if status == JobFailed {
+		failure = sql.NullString{String: reason, Valid: true}
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE queue SET status = ?, failure = COALESCE(?, failure), updated_at = ?
+		WHERE id = ?;
+	`, status, failure, now, id)
+	if err != nil {
+		return nil, err
+	}
+	if status == JobEngraved {
+		_, err = tx.Exec(`
+			INSERT INTO history (event_id, bib, created_at, station, operator, reason, job_id)
+			SELECT event_id, bib, ?, ?, ?, reason, id FROM queue WHERE id = ?;
+		`, now, by.Station, by.Operator, id)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return athletes, nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetJob(id)
+}
+
+func (s *SqliteStore) GetJob(id int) (*QueueJob, error) {
+	query := `
+		SELECT ` + jobColumns + `
+		FROM ` + jobJoin + `
+		WHERE queue.id = $1;
+	`
+	return scanJob(s.db.QueryRow(query, id))
 }
 
-func (s *SqliteStore) GetLatestHistoryRecord() (*Athlete, error) {
+// GetQueue returns the jobs of the event that are not handed over yet, the
+// one on the laser first and then the waiting ones in order.
+func (s *SqliteStore) GetQueue(eventID string) ([]*QueueJob, error) {
 	query := `
-		SELECT history.bib,
-		laser.results_first_name, 
-		laser.results_last_name,
-		laser.results_time,
-		laser.results_gun_time
-		FROM history JOIN laser ON history.bib = laser.results_bib ORDER BY history.created_at DESC
-		LIMIT 1
+		SELECT ` + jobColumns + `
+		FROM ` + jobJoin + `
+		WHERE queue.event_id = $1 AND queue.status <> 'handed_over'
+		ORDER BY CASE queue.status WHEN 'engraving' THEN 0 WHEN 'queued' THEN 1 WHEN 'failed' THEN 2 ELSE 3 END, queue.id;
 	`
-	row := s.db.QueryRow(query)
-	a := new(Athlete)
-	err := row.Scan(
-		&a.ResultsBib,
-		&a.ResultsFirstName,
-		&a.ResultsLastName,
-		&a.ResultsTime,
-		&a.ResultsGunTime,
-	)
+	resp, err := s.db.Query(query, eventID)
 	if err != nil {
 		return nil, err
 	}
-	err = processTimeForRecord(a)
+	return scanJobs(resp)
+}
+
+// GetJobsByBib returns all jobs of the athlete, newest first.
+func (s *SqliteStore) GetJobsByBib(eventID string, bib string) ([]*QueueJob, error) {
+	query := `
+		SELECT ` + jobColumns + `
+		FROM ` + jobJoin + `
+		WHERE queue.event_id = $1 AND queue.bib = $2
+		ORDER BY queue.id DESC;
+	`
+	resp, err := s.db.Query(query, eventID, bib)
 	if err != nil {
 		return nil, err
 	}
-	return a, nil
+	return scanJobs(resp)
+}
 
+// SaveSplits creates or updates the splits, the others of the event are
+// kept.
+func (s *SqliteStore) SaveSplits(eventID string, splits []Split) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		INSERT INTO splits (event_id, bib, name, time, position, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (event_id, bib, name) DO UPDATE SET time = excluded.time, position = excluded.position,
+			updated_at = excluded.updated_at;
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, split := range splits {
+		if _, err := stmt.Exec(eventID, split.Bib, split.Name, split.Time, split.Order, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *SqliteStore) GetRecordByBib(bib string) (*Athlete, error) {
+// GetSplits returns the splits of the athlete in course order.
+func (s *SqliteStore) GetSplits(eventID string, bib string) ([]Split, error) {
 	query := `
-		SELECT results_bib, results_first_name, results_last_name, results_time, results_gun_time
-		FROM laser WHERE results_bib = $1;
+		SELECT bib, name, time, position FROM splits
+		WHERE event_id = $1 AND bib = $2
+		ORDER BY position, name;
 	`
-	res := s.db.QueryRow(query, bib)
-	a := new(Athlete)
-	err := res.Scan(
-		&a.ResultsBib,
-		&a.ResultsFirstName,
-		&a.ResultsLastName,
-		&a.ResultsTime,
-		&a.ResultsGunTime,
-	)
+	resp, err := s.db.Query(query, eventID, bib)
 	if err != nil {
 		return nil, err
 	}
-	err = processTimeForRecord(a)
-	if err != nil {
-		return nil, err
+	defer resp.Close()
+
+	splits := []Split{}
+	for resp.Next() {
+		split := Split{}
+		if err := resp.Scan(&split.Bib, &split.Name, &split.Time, &split.Order); err != nil {
+			return nil, err
+		}
+		splits = append(splits, split)
 	}
-	s.CreateHistoryRecord(a)
-	return a, nil
+	return splits, resp.Err()
 }
 
-func (s *SqliteStore) GetRecords() ([]*Athlete, error) {
+// GetTemplates returns the engraving templates of the event.
+func (s *SqliteStore) GetTemplates(eventID string) ([]*EngravingTemplate, error) {
 	query := `
-		SELECT * FROM laser;
+		SELECT event_id, race_name, body FROM templates
+		WHERE event_id = $1
+		ORDER BY race_name;
 	`
-	resp, err := s.db.Query(query)
+	resp, err := s.db.Query(query, eventID)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Close()
 
-	athletes := []*Athlete{}
+	templates := []*EngravingTemplate{}
 	for resp.Next() {
-		a := new(Athlete)
-		if err := resp.Scan(
-			&a.ResultsBib,
-			&a.ResultsFirstName,
-			&a.ResultsLastName,
-			&a.ResultsTime,
-			&a.ResultsGunTime,
-		); err != nil {
+		t := new(EngravingTemplate)
+		if err := resp.Scan(&t.EventID, &t.RaceName, &t.Body); err != nil {
 			return nil, err
 		}
-		athletes = append(athletes, a)
+		templates = append(templates, t)
 	}
+	return templates, resp.Err()
+}
 
-	return athletes, nil
+// SaveTemplate creates or replaces the template of the event and race.
+func (s *SqliteStore) SaveTemplate(t *EngravingTemplate) error {
+	query := `
+		INSERT INTO templates (event_id, race_name, body)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (event_id, race_name) DO UPDATE SET body = excluded.body;
+	`
+	_, err := s.db.Exec(query, t.EventID, t.RaceName, t.Body)
+	return err
 }
 
-func (s *SqliteStore) GetRecordsCount() int {
-	var count int
-	query := `SELECT COUNT(*) FROM laser`
-	resp := s.db.QueryRow(query)
-	err := resp.Scan(&count)
+func (s *SqliteStore) DeleteTemplate(eventID string, raceName string) error {
+	query := `DELETE FROM templates WHERE event_id = $1 AND race_name = $2;`
+	_, err := s.db.Exec(query, eventID, raceName)
+	return err
+}
+
+// GetSetting returns the stored value of the key or "" if it is not set.
+func (s *SqliteStore) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = $1;`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *SqliteStore) SetSetting(key string, value string) error {
+	query := `
+		INSERT INTO meta (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value;
+	`
+	_, err := s.db.Exec(query, key, value)
+	return err
+}
+
+func (s *SqliteStore) GetUsers() ([]*User, error) {
+	resp, err := s.db.Query(`SELECT username, password_hash, role, created_at FROM users ORDER BY username;`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return count
+	return scanUsers(resp)
+}
+
+func (s *SqliteStore) GetUser(username string) (*User, error) {
+	u := new(User)
+	row := s.db.QueryRow(`SELECT username, password_hash, role, created_at FROM users WHERE username = $1;`, username)
+	if err := row.Scan(&u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// SaveUser adds the user or changes the password and the role of an
+// existing one.
+func (s *SqliteStore) SaveUser(u *User) error {
+	query := `
+		INSERT INTO users (username, password_hash, role, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role;
+	`
+	_, err := s.db.Exec(query, u.Username, u.PasswordHash, u.Role, time.Now().UTC())
+	return err
 }
 
-func (s *SqliteStore) ClearHistory() {
-	query := `DELETE FROM history;`
-	_, err := s.db.Exec(query)
+// CreateFirstUser adds the user only while there are no users at all, false
+// tells that somebody else was first. SQLite runs one statement at a time,
+// so the check and the insert cannot be split by another request.
+func (s *SqliteStore) CreateFirstUser(u *User) (bool, error) {
+	query := `
+		INSERT INTO users (username, password_hash, role, created_at)
+		SELECT $1, $2, $3, $4 WHERE NOT EXISTS (SELECT 1 FROM users);
+	`
+	res, err := s.db.Exec(query, u.Username, u.PasswordHash, u.Role, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteUser deletes the user and logs out their sessions.
+func (s *SqliteStore) DeleteUser(username string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM sessions WHERE username = $1;`,
+		`DELETE FROM users WHERE username = $1;`,
+	} {
+		if _, err := tx.Exec(query, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateSession stores the session and drops the expired ones.
+func (s *SqliteStore) CreateSession(session *Session) error {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at < $1;`, time.Now().UTC()); err != nil {
+		return err
+	}
+	query := `INSERT INTO sessions (token, username, csrf, expires_at) VALUES ($1, $2, $3, $4);`
+	_, err := s.db.Exec(query, session.Token, session.Username, session.CSRF, session.ExpiresAt.UTC())
+	return err
+}
 
+// GetSession returns the session of the token, sql.ErrNoRows when it is
+// unknown or expired.
+func (s *SqliteStore) GetSession(token string) (*Session, error) {
+	session := new(Session)
+	row := s.db.QueryRow(`SELECT token, username, csrf, expires_at FROM sessions WHERE token = $1 AND expires_at > $2;`,
+		token, time.Now().UTC())
+	if err := row.Scan(&session.Token, &session.Username, &session.CSRF, &session.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *SqliteStore) DeleteSession(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = $1;`, token)
+	return err
+}
+
+// DeleteUserSessions logs the user out everywhere but in the session except,
+// which may be "".
+func (s *SqliteStore) DeleteUserSessions(username string, except string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE username = $1 AND token <> $2;`, username, except)
+	return err
+}
+
+// SaveSourceConfig stores the encrypted source configuration of the event.
+func (s *SqliteStore) SaveSourceConfig(eventID string, sealed string) error {
+	_, err := s.db.Exec(`UPDATE events SET source_config = $1 WHERE event_id = $2;`, sealed, eventID)
+	return err
+}
+
+// GetSourceConfig returns the encrypted source configuration of the event,
+// "" if there is none.
+func (s *SqliteStore) GetSourceConfig(eventID string) (string, error) {
+	var sealed sql.NullString
+	err := s.db.QueryRow(`SELECT source_config FROM events WHERE event_id = $1;`, eventID).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return sealed.String, err
 }
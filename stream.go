@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the events pushed to the browsers. They are the HX-Trigger names
+// the page already listens to, prefixed with "stream:" there, see
+// static/stream.js.
+const (
+	StreamQueue   = "queue"
+	StreamHistory = "history"
+	StreamEvents  = "events"
+	StreamReset   = "reset"
+	StreamScrape  = "scrape"
+	StreamConfig  = "config"
+	// StreamLaser carries the progress of the laser job.
+	StreamLaser = "laser"
+	// StreamActivate reloads the page, another event became active.
+	StreamActivate = "activate"
+)
+
+// streamKeepAlive keeps proxies from closing an idle stream.
+const streamKeepAlive = 30 * time.Second
+
+// tabHeader names the browser tab a request comes from. The page sends it
+// with every htmx request, so the tab that made a change is refreshed by
+// HX-Trigger and is not sent the same change again.
+const tabHeader = "X-Golaser-Tab"
+
+// eventStream fans the changes out to every connected browser, so the
+// stations see what the others did.
+type eventStream struct {
+	mu      sync.Mutex
+	clients map[chan string]string // to the tab
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{clients: map[chan string]string{}}
+}
+
+func (e *eventStream) subscribe(tab string) chan string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan string, 16)
+	e.clients[ch] = tab
+	return ch
+}
+
+func (e *eventStream) unsubscribe(ch chan string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.clients, ch)
+}
+
+// publish sends the events to every tab but origin, "" sends them to all. A
+// browser that does not keep up misses them rather than holding the others
+// back.
+func (e *eventStream) publish(origin string, names ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch, tab := range e.clients {
+		if origin != "" && tab == origin {
+			continue
+		}
+		for _, name := range names {
+			select {
+			case ch <- name:
+			default:
+			}
+		}
+	}
+}
+
+// notify refreshes the parts of the page the change touches: in this tab
+// through HX-Trigger, in the others through the stream.
+func (s *APIServer) notify(w http.ResponseWriter, r *http.Request, names ...string) {
+	w.Header().Add("HX-Trigger", strings.Join(names, ", "))
+	s.stream.publish(r.Header.Get(tabHeader), names...)
+}
+
+// HandleRefresh reloads the page that asks, see StreamActivate.
+func (s *APIServer) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("HX-Refresh", "true")
+}
+
+// HandleStream is the Server-Sent Events stream the page connects to from
+// static/stream.js.
+func (s *APIServer) HandleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := s.stream.subscribe(r.FormValue("tab"))
+	defer s.stream.unsubscribe(ch)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case name := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", name)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// received drains the events waiting in the channel.
+func received(ch chan string) []string {
+	names := []string{}
+	for {
+		select {
+		case name := <-ch:
+			names = append(names, name)
+		default:
+			return names
+		}
+	}
+}
+
+func TestEventStreamPublish(t *testing.T) {
+	e := newEventStream()
+	a, b := e.subscribe("a"), e.subscribe("b")
+
+	e.publish("a", StreamQueue)
+	e.publish("", StreamHistory, StreamConfig)
+	if got := strings.Join(received(a), " "); got != "history config" {
+		t.Errorf("origin tab got %q", got)
+	}
+	if got := strings.Join(received(b), " "); got != "queue history config" {
+		t.Errorf("other tab got %q", got)
+	}
+
+	// a tab that does not read is skipped, not waited for
+	for i := 0; i < 100; i++ {
+		e.publish("", StreamQueue)
+	}
+	if got := len(received(a)); got != cap(a) {
+		t.Errorf("slow tab got %d events, want %d", got, cap(a))
+	}
+
+	received(b)
+	e.unsubscribe(b)
+	e.publish("", StreamQueue)
+	if got := received(b); len(got) != 0 {
+		t.Errorf("unsubscribed tab got %q", got)
+	}
+}
+
+// streamLines connects to the stream as the tab and returns its lines.
+func streamLines(t *testing.T, ctx context.Context, server *httptest.Server, session *Session, tab string) <-chan string {
+	t.Helper()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/stream?tab="+tab, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.Token})
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := make(chan string, 16)
+	go func() {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines <- scanner.Text()
+			}
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+func nextLine(t *testing.T, lines <-chan string) string {
+	t.Helper()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event on the stream")
+		return ""
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	s, store := newTestServer(t)
+	addTestUser(t, store, "op", RoleOperator)
+	session := testSession(t, store, "op")
+	if err := store.SaveEvent(&Event{EventID: "ev1", EventName: "ev1"}); err != nil {
+		t.Fatal(err)
+	}
+	athletes := []Athlete{{ResultsBib: "101", ResultsFirstName: "Анна", ResultsTime: "0:40:05"}}
+	if _, err := store.CreateBulkRecords("ev1", &athletes); err != nil {
+		t.Fatal(err)
+	}
+	job, err := store.EnqueueJob("ev1", "101", "", Stamp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := s.routes()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if w := serve(router, http.MethodGet, "/stream", nil, nil, ""); w.Code != http.StatusSeeOther {
+		t.Errorf("stream without a session: %d", w.Code)
+	}
+	mine, other := streamLines(t, ctx, server, session, "t1"), streamLines(t, ctx, server, session, "t2")
+	for _, lines := range []<-chan string{mine, other} {
+		if line := nextLine(t, lines); line != ": connected" {
+			t.Fatalf("first line %q", line)
+		}
+	}
+
+	// the tab that made the change is refreshed by HX-Trigger, the other one
+	// by the stream
+	form := url.Values{"status": {string(JobEngraving)}}
+	r := httptest.NewRequest(http.MethodPost, "/queue/"+strconv.Itoa(job.ID)+"/status", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(csrfHeader, session.CSRF)
+	r.Header.Set(tabHeader, "t1")
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.Token})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Header().Get("HX-Trigger") != StreamQueue {
+		t.Fatalf("HX-Trigger %q: %s", w.Header().Get("HX-Trigger"), w.Body)
+	}
+	s.stream.publish("", StreamConfig)
+
+	if line := nextLine(t, mine); line != "data: "+StreamConfig {
+		t.Errorf("tab of the change got %q", line)
+	}
+	for _, want := range []string{StreamQueue, StreamConfig} {
+		if line := nextLine(t, other); line != "data: "+want {
+			t.Errorf("other tab got %q, want %q", line, want)
+		}
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.stream.mu.Lock()
+		clients := len(s.stream.clients)
+		s.stream.mu.Unlock()
+		if clients == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams left after the browsers went away", clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
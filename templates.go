@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+var templateEditorTmpl = template.Must(template.New("editor").Parse(`
+	<form id="template-form" hx-post="/templates" hx-target="#template-editor" hx-swap="innerHTML">
+		<div class="row g-2">
+			<div class="col-sm-5">
+				<select class="form-select" name="race" hx-get="/templates/editor" hx-target="#template-editor" hx-swap="innerHTML" aria-label="Дистанция">
+					<option value="">Все дистанции</option>
+					{{ range .Races }}
+					<option value="{{ . }}" {{ if eq . $.Race }}selected{{ end }}>{{ . }}</option>
+					{{ end }}
+				</select>
+			</div>
+			<div class="col-sm-4">
+				<input type="text" class="form-control" name="bib" placeholder="Номер для примера" aria-label="Номер для примера"
+					hx-post="/templates/preview" hx-trigger="keyup changed delay:300ms" hx-target="#template-preview" hx-include="#template-form">
+			</div>
+		</div>
+		<textarea class="form-control font-monospace mt-2" name="body" rows="3" aria-label="Шаблон"
+			hx-post="/templates/preview" hx-trigger="load, keyup changed delay:300ms" hx-target="#template-preview" hx-include="#template-form">{{ .Body }}</textarea>
+		<div class="form-text">
+			Поля: <code>.FirstName .LastName .Time .ChipTime .GunTime .Race .Bib .Sex .Category .Age .Place .SexPlace .CategoryPlace .Event .Status .Distance .Splits</code>, отсечка по названию: <code>{{ "{{ .Split \"Swim\" }}" }}</code>.
+			Функции: <code>upper lower title translit</code>, <code>truncate 12 .LastName</code>, <code>pad 10 .Time</code>,
+			<code>padleft</code>, <code>center</code>, <code>pace .Distance .Time</code>.
+			Пример: <code>{{ "{{ upper .LastName }} {{ .FirstName }}" }}</code>, перенос строки — новая строка в шаблоне.
+		</div>
+		<pre id="template-preview" class="border rounded p-2 mt-2 mb-2"></pre>
+		<button type="submit" class="btn btn-primary">Сохранить</button>
+		{{ if .Saved }}
+		<button type="button" class="btn btn-outline-danger" hx-delete="/templates?race={{ .Race }}" hx-target="#template-editor" hx-swap="innerHTML">Удалить</button>
+		{{ end }}
+		{{ if .Message }}<span class="ms-2 text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="mt-2 text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+	{{ if .Templates }}
+	<table class="table table-sm small mt-3">
+		<thead><tr><th>Дистанция</th><th>Шаблон</th><th></th></tr></thead>
+		<tbody>
+		{{ range .Templates }}
+		<tr>
+			<td>{{ if .RaceName }}{{ .RaceName }}{{ else }}Все дистанции{{ end }}</td>
+			<td><code>{{ .Body }}</code></td>
+			<td class="text-end">
+				<button type="button" class="btn btn-sm btn-outline-primary" hx-get="/templates/editor?race={{ .RaceName }}" hx-target="#template-editor" hx-swap="innerHTML">Изменить</button>
+			</td>
+		</tr>
+		{{ end }}
+		</tbody>
+	</table>
+	{{ end }}
+`))
+
+// renderTemplateEditor shows the template of the race in the active event.
+// A non-empty body is shown instead of the stored one, e.g. after a failed
+// save.
+func (s *APIServer) renderTemplateEditor(w http.ResponseWriter, race string, body string, message string, errText string) {
+	eventID := s.activeEventID()
+	templates, err := s.store.GetTemplates(eventID)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	races, err := s.store.GetRaceNames(eventID)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	saved := false
+	stored := DefaultEngravingTemplate
+	for _, t := range templates {
+		if t.RaceName == race {
+			saved = true
+			stored = t.Body
+		}
+	}
+	if !saved {
+		stored = pickTemplate(templates, race)
+	}
+	if body == "" {
+		body = stored
+	}
+	data := map[string]any{
+		"Race":      race,
+		"Races":     races,
+		"Body":      body,
+		"Saved":     saved,
+		"Templates": templates,
+		"Message":   message,
+		"Error":     errText,
+	}
+	if err := templateEditorTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleTemplateEditor(w http.ResponseWriter, r *http.Request) {
+	s.renderTemplateEditor(w, r.FormValue("race"), "", "", "")
+}
+
+func (s *APIServer) HandleSaveTemplate(w http.ResponseWriter, r *http.Request) {
+	eventID := s.activeEventID()
+	if eventID == "" {
+		alertDangerResponse(w, "Шаблон не сохранён", "Нет активного соревнования")
+		return
+	}
+	race := r.PostFormValue("race")
+	body := strings.TrimSpace(r.PostFormValue("body"))
+	if body == "" {
+		s.renderTemplateEditor(w, race, "", "", "Шаблон пустой")
+		return
+	}
+	if _, err := parseEngravingTemplate(body); err != nil {
+		s.renderTemplateEditor(w, race, body, "", fmt.Sprintf("Ошибка в шаблоне: %s", err))
+		return
+	}
+	err := s.store.SaveTemplate(&EngravingTemplate{EventID: eventID, RaceName: race, Body: body})
+	if err != nil {
+		s.renderTemplateEditor(w, race, body, "", fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.notify(w, r, StreamConfig)
+	s.renderTemplateEditor(w, race, "", "Шаблон сохранён", "")
+}
+
+func (s *APIServer) HandleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	race := r.FormValue("race")
+	if err := s.store.DeleteTemplate(s.activeEventID(), race); err != nil {
+		s.renderTemplateEditor(w, race, "", "", fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.notify(w, r, StreamConfig)
+	s.renderTemplateEditor(w, race, "", "Шаблон удалён", "")
+}
+
+// HandleTemplatePreview renders the template being edited for the given bib
+// or for a made up athlete.
+func (s *APIServer) HandleTemplatePreview(w http.ResponseWriter, r *http.Request) {
+	a := *sampleAthlete
+	if race := r.PostFormValue("race"); race != "" {
+		a.ResultsRaceName = race
+	}
+	if bib := strings.TrimSpace(r.PostFormValue("bib")); bib != "" {
+		found, err := s.store.GetRecordByBib(s.activeEventID(), bib)
+		if err != nil {
+			fmt.Fprintf(w, `<span class="text-danger">Участник %s не найден</span>`, html.EscapeString(bib))
+			return
+		}
+		s.loadSplits(found)
+		a = *found
+	}
+	text, err := renderEngraving(r.PostFormValue("body"), &a)
+	if err != nil {
+		fmt.Fprintf(w, `<span class="text-danger">%s</span>`, html.EscapeString(err.Error()))
+		return
+	}
+	fmt.Fprint(w, html.EscapeString(text))
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const timePolicyKey = "time_policy"
+
+// Rounding of the fractions of a second.
+const (
+	RoundCeil       = "ceil"
+	RoundFloor      = "floor"
+	RoundNearest    = "nearest"
+	RoundTenths     = "tenths"
+	RoundHundredths = "hundredths"
+)
+
+// Display formats. TimeAuto drops the hours under an hour.
+const (
+	TimeHHMMSS = "hh:mm:ss"
+	TimeHMMSS  = "h:mm:ss"
+	TimeMMSS   = "mm:ss"
+	TimeAuto   = "auto"
+)
+
+// Which result time is the official one.
+const (
+	TimeChip = "chip"
+	TimeGun  = "gun"
+)
+
+var (
+	roundingTitles = map[string]string{
+		RoundCeil:       "вверх до секунды",
+		RoundFloor:      "вниз до секунды",
+		RoundNearest:    "до ближайшей секунды",
+		RoundTenths:     "десятые доли",
+		RoundHundredths: "сотые доли",
+	}
+	formatTitles = map[string]string{
+		TimeHHMMSS: "ЧЧ:ММ:СС",
+		TimeHMMSS:  "Ч:ММ:СС",
+		TimeMMSS:   "ММ:СС",
+		TimeAuto:   "без нулевых часов",
+	}
+	sourceTitles = map[string]string{
+		TimeChip: "чистое",
+		TimeGun:  "грязное",
+	}
+)
+
+// TimePolicy says how result times are rounded and written. Races can pick
+// their own format and which time counts.
+type TimePolicy struct {
+	Rounding string `json:"rounding"`
+	Format   string `json:"format"`
+	Source   string `json:"source"`
+	// Races are keyed by the event ID and the race name, a 10K of another
+	// event has its own.
+	Races map[string]map[string]RaceTimePolicy `json:"races,omitempty"`
+}
+
+// RaceTimePolicy overrides the policy for a race, empty fields keep the
+// common value.
+type RaceTimePolicy struct {
+	Format string `json:"format,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+var defaultTimePolicy = TimePolicy{
+	Rounding: RoundCeil,
+	Format:   TimeHHMMSS,
+	Source:   TimeChip,
+}
+
+func (p *TimePolicy) validate() error {
+	if _, ok := roundingTitles[p.Rounding]; !ok {
+		return fmt.Errorf("неизвестное округление %q", p.Rounding)
+	}
+	if _, ok := formatTitles[p.Format]; !ok {
+		return fmt.Errorf("неизвестный формат %q", p.Format)
+	}
+	if _, ok := sourceTitles[p.Source]; !ok {
+		return fmt.Errorf("неизвестное время %q", p.Source)
+	}
+	for eventID, races := range p.Races {
+		for race, rp := range races {
+			if _, ok := formatTitles[rp.Format]; rp.Format != "" && !ok {
+				return fmt.Errorf("%s: неизвестный формат %q", race, rp.Format)
+			}
+			if _, ok := sourceTitles[rp.Source]; rp.Source != "" && !ok {
+				return fmt.Errorf("%s: неизвестное время %q", race, rp.Source)
+			}
+			if rp == (RaceTimePolicy{}) {
+				delete(races, race)
+			}
+		}
+		if len(races) == 0 {
+			delete(p.Races, eventID)
+		}
+	}
+	return nil
+}
+
+// cloneRaces copies the races, the current policy is shared and must not
+// change under its readers.
+func (p TimePolicy) cloneRaces() map[string]map[string]RaceTimePolicy {
+	races := map[string]map[string]RaceTimePolicy{}
+	for eventID, eventRaces := range p.Races {
+		races[eventID] = map[string]RaceTimePolicy{}
+		for name, rp := range eventRaces {
+			races[eventID][name] = rp
+		}
+	}
+	return races
+}
+
+func (p TimePolicy) race(eventID string, raceName string) RaceTimePolicy {
+	rp := p.Races[eventID][raceName]
+	if rp.Format == "" {
+		rp.Format = p.Format
+	}
+	if rp.Source == "" {
+		rp.Source = p.Source
+	}
+	return rp
+}
+
+// The policy is read by the stores on every row, so it is kept here rather
+// than looked up in the database each time.
+var (
+	timePolicyMu      sync.RWMutex
+	currentTimePolicy = defaultTimePolicy
+)
+
+func activeTimePolicy() TimePolicy {
+	timePolicyMu.RLock()
+	defer timePolicyMu.RUnlock()
+	return currentTimePolicy
+}
+
+func setTimePolicy(p TimePolicy) {
+	timePolicyMu.Lock()
+	defer timePolicyMu.Unlock()
+	currentTimePolicy = p
+}
+
+// loadTimePolicy makes the saved policy current.
+func (s *APIServer) loadTimePolicy() {
+	policy := defaultTimePolicy
+	if err := loadJSONSetting(s.store, timePolicyKey, &policy); err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	if err := policy.validate(); err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	setTimePolicy(policy)
+}
+
+func (s *APIServer) saveTimePolicy(p TimePolicy) error {
+	if err := saveJSONSetting(s.store, timePolicyKey, p); err != nil {
+		return err
+	}
+	setTimePolicy(p)
+	// the official time decides the places
+	s.updateAllPlaces()
+	return nil
+}
+
+// parseDuration reads H:MM:SS or MM:SS with optional fractions. Hours may
+// go past 24 for ultra races.
+func parseDuration(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("неверное время %q", s)
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, invalid
+	}
+	seconds, fraction, _ := strings.Cut(parts[len(parts)-1], ".")
+	if fraction == "" {
+		seconds, fraction, _ = strings.Cut(seconds, ",")
+	}
+	var d time.Duration
+	for i, part := range append(parts[:len(parts)-1], seconds) {
+		if !isDigits(part) {
+			return 0, invalid
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, invalid
+		}
+		// the first number is not limited: 75:12 or 26:03:04
+		if i > 0 && n > 59 {
+			return 0, invalid
+		}
+		d = d*60 + time.Duration(n)*time.Second
+	}
+	if fraction != "" {
+		if len(fraction) > 9 {
+			fraction = fraction[:9]
+		}
+		if !isDigits(fraction) {
+			return 0, invalid
+		}
+		n, err := strconv.Atoi(fraction)
+		if err != nil {
+			return 0, invalid
+		}
+		for i := len(fraction); i < 9; i++ {
+			n *= 10
+		}
+		d += time.Duration(n)
+	}
+	return d, nil
+}
+
+// isDigits reports whether s is a number without a sign.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// roundDuration applies the rounding and returns the number of decimals to
+// show.
+func roundDuration(d time.Duration, rounding string) (time.Duration, int) {
+	switch rounding {
+	case RoundFloor:
+		return d.Truncate(time.Second), 0
+	case RoundNearest:
+		return d.Round(time.Second), 0
+	case RoundTenths:
+		return d.Truncate(100 * time.Millisecond), 1
+	case RoundHundredths:
+		return d.Truncate(10 * time.Millisecond), 2
+	}
+	if rest := d % time.Second; rest > 0 {
+		d += time.Second - rest
+	}
+	return d, 0
+}
+
+func formatDuration(d time.Duration, format string, decimals int) string {
+	total := int(d / time.Second)
+	h, m, sec := total/3600, total/60%60, total%60
+	var out string
+	switch {
+	case format == TimeMMSS:
+		out = fmt.Sprintf("%02d:%02d", total/60, sec)
+	case format == TimeAuto && h == 0:
+		out = fmt.Sprintf("%d:%02d", m, sec)
+	case format == TimeHMMSS, format == TimeAuto:
+		out = fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	default:
+		out = fmt.Sprintf("%02d:%02d:%02d", h, m, sec)
+	}
+	if decimals > 0 {
+		fraction := fmt.Sprintf("%09d", d%time.Second)
+		out += "." + fraction[:decimals]
+	}
+	return out
+}
+
+func formatResultTime(s string, policy TimePolicy, format string) (string, error) {
+	d, err := parseDuration(s)
+	if err != nil {
+		return "", err
+	}
+	d, decimals := roundDuration(d, policy.Rounding)
+	return formatDuration(d, format, decimals), nil
+}
+
+// processTimeStr checks a result time and writes it the way the current
+// policy says.
+func processTimeStr(timeToParse string) (string, error) {
+	policy := activeTimePolicy()
+	return formatResultTime(timeToParse, policy, policy.Format)
+}
+
+// processTimeForRecord writes the times of the athlete the way the policy
+// says. A missing time stays empty. A time that cannot be read is kept as
+// the source wrote it and the result becomes unofficial, so the athlete is
+// still found and the operator is warned before engraving it.
+func processTimeForRecord(a *Athlete) {
+	// rows stored before statuses were kept may have one in place of the time
+	a.normalizeStatus()
+	policy := activeTimePolicy()
+	format := policy.race(a.EventID, a.ResultsRaceName).Format
+	for _, t := range []*string{&a.ResultsGunTime, &a.ResultsTime} {
+		if *t == "" {
+			continue
+		}
+		formatted, err := formatResultTime(*t, policy, format)
+		if err != nil {
+			if a.ResultsStatus == StatusNone {
+				a.ResultsStatus = StatusUnofficial
+			}
+			continue
+		}
+		*t = formatted
+	}
+}
+
+// OfficialTime is the chip or the gun time, as the race is set up. A
+// missing gun time falls back to the chip time.
+func (a *Athlete) OfficialTime() string {
+	if activeTimePolicy().race(a.EventID, a.ResultsRaceName).Source == TimeGun && a.ResultsGunTime != "" {
+		return a.ResultsGunTime
+	}
+	return a.ResultsTime
+}
+
+var timePolicyTmpl = template.Must(template.New("time").Parse(`
+	<form hx-post="/time-policy" hx-target="#time-policy" hx-swap="innerHTML">
+		<div class="row g-2">
+			<div class="col-sm-4">
+				<label class="form-label small">Округление</label>
+				<select class="form-select" name="rounding">
+					{{ range $value, $title := .Roundings }}
+					<option value="{{ $value }}" {{ if eq $value $.Policy.Rounding }}selected{{ end }}>{{ $title }}</option>
+					{{ end }}
+				</select>
+			</div>
+			<div class="col-sm-4">
+				<label class="form-label small">Формат</label>
+				<select class="form-select" name="format">
+					{{ range $value, $title := .Formats }}
+					<option value="{{ $value }}" {{ if eq $value $.Policy.Format }}selected{{ end }}>{{ $title }}</option>
+					{{ end }}
+				</select>
+			</div>
+			<div class="col-sm-4">
+				<label class="form-label small">Время на табличке</label>
+				<select class="form-select" name="source">
+					{{ range $value, $title := .Sources }}
+					<option value="{{ $value }}" {{ if eq $value $.Policy.Source }}selected{{ end }}>{{ $title }}</option>
+					{{ end }}
+				</select>
+			</div>
+		</div>
+		{{ if .Races }}
+		<table class="table table-sm small mt-3">
+			<thead><tr><th>Дистанция</th><th>Формат</th><th>Время</th></tr></thead>
+			<tbody>
+			{{ range .Races }}
+			{{ $race := . }}
+			<tr>
+				<td>{{ .Name }}<input type="hidden" name="race" value="{{ .Name }}"></td>
+				<td>
+					<select class="form-select form-select-sm" name="race_format">
+						<option value="">как у всех</option>
+						{{ range $value, $title := $.Formats }}
+						<option value="{{ $value }}" {{ if eq $value $race.Format }}selected{{ end }}>{{ $title }}</option>
+						{{ end }}
+					</select>
+				</td>
+				<td>
+					<select class="form-select form-select-sm" name="race_source">
+						<option value="">как у всех</option>
+						{{ range $value, $title := $.Sources }}
+						<option value="{{ $value }}" {{ if eq $value $race.Source }}selected{{ end }}>{{ $title }}</option>
+						{{ end }}
+					</select>
+				</td>
+			</tr>
+			{{ end }}
+			</tbody>
+		</table>
+		{{ end }}
+		<div class="form-text">
+			В шаблонах гравировки <code>.Time</code> — выбранное время, <code>.ChipTime</code> и <code>.GunTime</code> — чистое и грязное.
+			Время больше суток пишется как 26:03:04.
+		</div>
+		<button type="submit" class="btn btn-primary mt-2">Сохранить</button>
+		{{ if .Message }}<span class="ms-2 text-success">{{ .Message }}</span>{{ end }}
+		{{ if .Error }}<div class="mt-2 text-danger">{{ .Error }}</div>{{ end }}
+	</form>
+`))
+
+type raceTimeRow struct {
+	Name string
+	RaceTimePolicy
+}
+
+func (s *APIServer) renderTimePolicy(w http.ResponseWriter, policy TimePolicy, message string, errText string) {
+	races := []raceTimeRow{}
+	eventID := s.activeEventID()
+	names, err := s.store.GetRaceNames(eventID)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+	for _, name := range names {
+		races = append(races, raceTimeRow{name, policy.Races[eventID][name]})
+	}
+	data := map[string]any{
+		"Policy":    policy,
+		"Races":     races,
+		"Roundings": roundingTitles,
+		"Formats":   formatTitles,
+		"Sources":   sourceTitles,
+		"Message":   message,
+		"Error":     errText,
+	}
+	if err := timePolicyTmpl.Execute(w, data); err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (s *APIServer) HandleGetTimePolicy(w http.ResponseWriter, r *http.Request) {
+	s.renderTimePolicy(w, activeTimePolicy(), "", "")
+}
+
+func (s *APIServer) HandleSaveTimePolicy(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	policy := TimePolicy{
+		Rounding: r.PostFormValue("rounding"),
+		Format:   r.PostFormValue("format"),
+		Source:   r.PostFormValue("source"),
+		// races of other events keep their settings
+		Races: activeTimePolicy().cloneRaces(),
+	}
+	eventID := s.activeEventID()
+	eventRaces := map[string]RaceTimePolicy{}
+	races, formats, sources := r.PostForm["race"], r.PostForm["race_format"], r.PostForm["race_source"]
+	for i, name := range races {
+		if i < len(formats) && i < len(sources) {
+			eventRaces[name] = RaceTimePolicy{Format: formats[i], Source: sources[i]}
+		}
+	}
+	if eventID != "" {
+		policy.Races[eventID] = eventRaces
+	}
+	if err := policy.validate(); err != nil {
+		s.renderTimePolicy(w, policy, "", err.Error())
+		return
+	}
+	if err := s.saveTimePolicy(policy); err != nil {
+		s.renderTimePolicy(w, policy, "", fmt.Sprintf("Ошибка базы данных: %s", err))
+		return
+	}
+	s.notify(w, r, StreamQueue, StreamHistory, StreamConfig)
+	s.renderTimePolicy(w, policy, "Настройки сохранены", "")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "45:10", want: 45*time.Minute + 10*time.Second},
+		{in: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{in: "01:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{in: " 0:59:59 ", want: 59*time.Minute + 59*time.Second},
+		{in: "75:12", want: 75*time.Minute + 12*time.Second},
+		{in: "26:03:04", want: 26*time.Hour + 3*time.Minute + 4*time.Second},
+		{in: "1:02:03.4", want: time.Hour + 2*time.Minute + 3*time.Second + 400*time.Millisecond},
+		{in: "1:02:03,45", want: time.Hour + 2*time.Minute + 3*time.Second + 450*time.Millisecond},
+		{in: "0:00:01.1234567891", want: time.Second + 123456789},
+		{in: "", wantErr: true},
+		{in: "45", wantErr: true},
+		{in: "1:2:3:4", wantErr: true},
+		{in: "1:60:00", wantErr: true},
+		{in: "1:00:60", wantErr: true},
+		{in: "1::00", wantErr: true},
+		{in: "-1:00", wantErr: true},
+		{in: "+5:00", wantErr: true},
+		{in: "1:+5:00", wantErr: true},
+		{in: "1:05:00.+5", wantErr: true},
+		{in: "1: 5:00", wantErr: true},
+		{in: "1:00.x", wantErr: true},
+		{in: "DNF", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseDuration(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDuration(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDuration(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundDuration(t *testing.T) {
+	d := time.Minute + 2*time.Second + 567*time.Millisecond
+	tests := []struct {
+		d            time.Duration
+		rounding     string
+		want         time.Duration
+		wantDecimals int
+	}{
+		{d, RoundCeil, time.Minute + 3*time.Second, 0},
+		{time.Minute, RoundCeil, time.Minute, 0},
+		{d, RoundFloor, time.Minute + 2*time.Second, 0},
+		{d, RoundNearest, time.Minute + 3*time.Second, 0},
+		{time.Minute + 2*time.Second + 499*time.Millisecond, RoundNearest, time.Minute + 2*time.Second, 0},
+		{d, RoundTenths, time.Minute + 2*time.Second + 500*time.Millisecond, 1},
+		{d, RoundHundredths, time.Minute + 2*time.Second + 560*time.Millisecond, 2},
+		{d, "", time.Minute + 3*time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rounding, func(t *testing.T) {
+			got, decimals := roundDuration(tt.d, tt.rounding)
+			if got != tt.want || decimals != tt.wantDecimals {
+				t.Errorf("roundDuration(%v, %q) = %v, %d, want %v, %d", tt.d, tt.rounding, got, decimals, tt.want, tt.wantDecimals)
+			}
+		})
+	}
+}
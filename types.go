@@ -1,16 +1,61 @@
 package main
 
+import "time"
+
 type Response struct {
 	EventResults []Athlete `json:"event_results"`
 }
 
 type Athlete struct {
 	ID               string
+	EventID          string `json:"-"`
+	EventName        string `json:"-"`
 	ResultsBib       string `json:"results_bib"`
 	ResultsFirstName string `json:"results_first_name"`
 	ResultsLastName  string `json:"results_last_name"`
 	ResultsTime      string `json:"results_time"`
 	ResultsGunTime   string `json:"results_gun_time"`
+	ResultsRaceName  string `json:"results_race_name"`
+	ResultsSex       string `json:"results_sex"`
+	ResultsCategory  string `json:"results_primary_bracket_name"`
+	// ResultsStatus is DNF, DNS, DSQ, UNOFFICIAL or empty for an official
+	// finish, see normalizeStatus.
+	ResultsStatus string `json:"results_status"`
+	ResultsAge    string `json:"results_age"`
+	// The places are the ones the source sends, or worked out from the
+	// times when it sends none, see computePlaces.
+	ResultsRank         string `json:"results_rank"`
+	ResultsSexRank      string `json:"results_sex_rank"`
+	ResultsCategoryRank string `json:"results_primary_bracket_rank"`
+	// Splits are only loaded where they are shown, see loadSplits.
+	Splits []Split `json:"-"`
+}
+
+// Split is the time of an athlete at an interval of the course, such as the
+// swim of a triathlon or a checkpoint of a trail.
+type Split struct {
+	Bib  string
+	Name string
+	Time string
+	// Order is the place of the interval on the course.
+	Order int
+}
+
+// sameResult reports whether other carries the same names, times, race
+// details and places.
+func (a *Athlete) sameResult(other *Athlete) bool {
+	return a.ResultsFirstName == other.ResultsFirstName &&
+		a.ResultsLastName == other.ResultsLastName &&
+		a.ResultsTime == other.ResultsTime &&
+		a.ResultsGunTime == other.ResultsGunTime &&
+		a.ResultsRaceName == other.ResultsRaceName &&
+		a.ResultsSex == other.ResultsSex &&
+		a.ResultsCategory == other.ResultsCategory &&
+		a.ResultsStatus == other.ResultsStatus &&
+		a.ResultsAge == other.ResultsAge &&
+		a.ResultsRank == other.ResultsRank &&
+		a.ResultsSexRank == other.ResultsSexRank &&
+		a.ResultsCategoryRank == other.ResultsCategoryRank
 }
 
 type EventInfoResp struct {
@@ -21,4 +66,104 @@ type Event struct {
 	EventID   string `json:"event_id"`
 	EventName string `json:"event_name"`
 	StartTime string `json:"event_start_time"`
+	// SourceType and Active are only kept in the events table.
+	SourceType string `json:"-"`
+	Active     bool   `json:"-"`
+}
+
+// UpsertStats summarises the changes made by a bulk upsert of results.
+type UpsertStats struct {
+	New     int `json:"new"`
+	Changed int `json:"changed"`
+	// EngravedChanged holds the bibs whose result changed after they were
+	// already added to the history, i.e. plaques that may need a reprint.
+	EngravedChanged []string `json:"engraved_changed"`
+}
+
+func (u *UpsertStats) Add(other UpsertStats) {
+	u.New += other.New
+	u.Changed += other.Changed
+	u.EngravedChanged = append(u.EngravedChanged, other.EngravedChanged...)
+}
+
+// JobStatus is the state of an engraving queue job.
+type JobStatus string
+
+const (
+	JobQueued     JobStatus = "queued"
+	JobEngraving  JobStatus = "engraving"
+	JobEngraved   JobStatus = "engraved"
+	JobHandedOver JobStatus = "handed_over"
+	JobFailed     JobStatus = "failed"
+)
+
+// QueueJob is one plaque to engrave. A reprint is a new job with a reason.
+type QueueJob struct {
+	ID     int
+	Status JobStatus
+	// Reason is why the job was queued, for a reprint or a DNF, DNS or DSQ.
+	Reason string
+	// Failure is why the job failed the last time.
+	Failure   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Operator and Station queued the job.
+	Operator string
+	Station  string
+	// Position is the place among the queued jobs of the event, 0 when the
+	// job is not waiting.
+	Position int
+	Athlete  *Athlete
+}
+
+// Stamp names who made a change of the queue and at which station.
+type Stamp struct {
+	Operator string
+	Station  string
+}
+
+// HistoryEntry is one engraved plaque. Every reprint is an entry of its own
+// with the reason it was done again.
+type HistoryEntry struct {
+	ID        int
+	Operator  string
+	Station   string
+	Reason    string
+	CreatedAt time.Time
+	// Reprint is set when the athlete was engraved before.
+	Reprint bool
+	Athlete *Athlete
+}
+
+// EngravingTemplate is the text/template body of the engraving text for the
+// races of an event. An empty RaceName applies to every race.
+type EngravingTemplate struct {
+	EventID  string
+	RaceName string
+	Body     string
+}
+
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"
+	RoleOperator Role = "operator"
+)
+
+// User is an operator who can log in. PasswordHash is a bcrypt hash, see
+// hashPassword.
+type User struct {
+	Username     string
+	PasswordHash string
+	Role         Role
+	CreatedAt    time.Time
+}
+
+// Session is a logged in browser. CSRF is sent back by the page with
+// every change.
+type Session struct {
+	Token     string
+	Username  string
+	CSRF      string
+	ExpiresAt time.Time
 }